@@ -0,0 +1,48 @@
+package client
+
+import "strings"
+
+// backendInfoPrefix starts the payload of the unsolicited pong frame a server
+// using WithHandlerExposeBackend sends to name the backend.
+const backendInfoPrefix = "wst-backend "
+
+// BackendInfo describes the backend connection serving a session. Target is
+// empty when the server could not fit it into the announcement.
+type BackendInfo struct {
+	Target     string
+	RemoteAddr string
+	LocalAddr  string
+}
+
+func parseBackendInfo(payload []byte) (BackendInfo, bool) {
+	rest, ok := strings.CutPrefix(string(payload), backendInfoPrefix)
+	if !ok {
+		return BackendInfo{}, false
+	}
+	fields := strings.SplitN(rest, " ", 3)
+	if len(fields) < 2 {
+		return BackendInfo{}, false
+	}
+	info := BackendInfo{RemoteAddr: fields[0], LocalAddr: fields[1]}
+	if len(fields) == 3 {
+		info.Target = fields[2]
+	}
+	return info, true
+}
+
+// Backend returns the backend serving the session if the server announced it
+// with WithHandlerExposeBackend. The announcement precedes any data from the
+// target and is picked up by Read, so it is known once Read has returned.
+func (c *Conn) Backend() (BackendInfo, bool) {
+	if info := c.fr.backend.Load(); info != nil {
+		return *info, true
+	}
+	return BackendInfo{}, false
+}
+
+// Backend returns the backend serving the session; see Conn.Backend.
+func (c *ResumableConn) Backend() (BackendInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.Backend()
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/zijiren233/gwst/internal/wire"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	CloseNormalClosure = 1000
+	CloseNoStatus      = 1005
+)
+
+type CloseError struct {
+	Reason string
+	Code   int
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+func closePayload(code int, reason string) []byte {
+	if len(reason) > 123 {
+		// Cut at a rune boundary: the reason must stay valid UTF-8.
+		n := 123
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	msg := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(msg, uint16(code))
+	return append(msg, reason...)
+}
+
+func parseClosePayload(payload []byte) *CloseError {
+	if len(payload) < 2 {
+		return &CloseError{Code: CloseNoStatus}
+	}
+	return &CloseError{
+		Code:   int(binary.BigEndian.Uint16(payload)),
+		Reason: string(payload[2:]),
+	}
+}
+
+// HalfCloseHeader tells the server that the client understands the
+// half-close signal. The server echoes it when it propagates half-closes.
+const HalfCloseHeader = "X-WST-Half-Close"
+
+// An empty text frame signals that the peer has finished writing, the
+// websocket equivalent of a TCP FIN. Tunnel data always uses binary frames.
+var halfCloseCodec = websocket.Codec{
+	Marshal: func(any) ([]byte, byte, error) {
+		return nil, websocket.TextFrame, nil
+	},
+}
+
+// peekHalfClose reports whether frame is the half-close signal. Otherwise
+// it returns a reader yielding the complete frame payload.
+func peekHalfClose(frame interface {
+	io.Reader
+	PayloadType() byte
+}) (io.Reader, bool) {
+	if frame.PayloadType() != websocket.TextFrame {
+		return frame, false
+	}
+	var b [1]byte
+	n, _ := io.ReadFull(frame, b[:])
+	if n == 0 {
+		return nil, true
+	}
+	return io.MultiReader(bytes.NewReader(b[:n]), frame), false
+}
+
+type frameReader struct {
+	ws       *websocket.Conn
+	frame    io.Reader
+	closeErr *CloseError
+	eof      bool
+	text     bool
+	pinger   *wire.Pinger
+	backend  atomic.Pointer[BackendInfo]
+}
+
+func (fr *frameReader) Read(b []byte) (int, error) {
+	if fr.eof {
+		return 0, io.EOF
+	}
+	for {
+		if fr.frame == nil {
+			frame, err := fr.ws.NewFrameReader()
+			if err != nil {
+				return 0, err
+			}
+			if frame.PayloadType() == websocket.CloseFrame {
+				payload, _ := io.ReadAll(io.LimitReader(frame, 125))
+				fr.closeErr = parseClosePayload(payload)
+				return 0, fr.closeErr
+			}
+			if frame.PayloadType() == websocket.PongFrame && fr.pinger != nil {
+				payload, _ := io.ReadAll(io.LimitReader(frame, 125))
+				if info, ok := parseBackendInfo(payload); ok {
+					fr.backend.Store(&info)
+				} else {
+					fr.pinger.Pong(payload)
+				}
+				continue
+			}
+			r, err := fr.ws.HandleFrame(frame)
+			if err != nil {
+				return 0, err
+			}
+			if r == nil {
+				continue
+			}
+			isText := r.PayloadType() == websocket.TextFrame
+			payload, halfClose := peekHalfClose(r)
+			if halfClose {
+				fr.eof = true
+				return 0, io.EOF
+			}
+			if fr.text {
+				if !isText {
+					return 0, errBinaryInTextMode
+				}
+				payload = base64.NewDecoder(base64.StdEncoding, payload)
+			}
+			fr.frame = payload
+		}
+		n, err := fr.frame.Read(b)
+		if err == io.EOF {
+			fr.frame = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestCloseWriteWithoutHalfClose(t *testing.T) {
+	// The server did not echo HalfCloseHeader and skips the empty frame like
+	// any other, so CloseWrite must close rather than leave Read waiting.
+	ended := make(chan struct{})
+	c := stallingServer(t, func(ws *websocket.Conn, _ <-chan struct{}) {
+		defer close(ended)
+		_, _ = io.Copy(ws, ws)
+	})
+	if _, err := c.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read after CloseWrite: %v, want the conn closed", err)
+	}
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still serving after CloseWrite")
+	}
+}
+
+func TestClosePayloadTruncatesAtRuneBoundary(t *testing.T) {
+	for _, reason := range []string{
+		strings.Repeat("界", 50),
+		"x" + strings.Repeat("界", 50),
+		"xy" + strings.Repeat("界", 50),
+		strings.Repeat("🙂", 40),
+	} {
+		got := closePayload(CloseNormalClosure, reason)[2:]
+		if !utf8.Valid(got) || !strings.HasPrefix(reason, string(got)) || len(got) < 120 || len(got) > 123 {
+			t.Fatalf("reason %q cut to %d bytes %q", reason, len(got), got)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// StreamCompressionProtocol is the websocket subprotocol under which both
+// directions of the tunneled byte stream are gzip compressed.
+const StreamCompressionProtocol = "wst-gzip"
+
+// WithStreamCompression offers the wst-gzip subprotocol and, if the server
+// selects it, gzips the tunneled stream at the given level. Otherwise the
+// conn is uncompressed.
+func WithStreamCompression(level int) ConnectOption {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		panic(fmt.Sprintf("wst: invalid compression level %d", level))
+	}
+	return func(c *ConnectConfig) {
+		c.Compression = true
+		c.CompressionLevel = level
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+// negotiateCompression enables compression if the server selected the
+// wst-gzip subprotocol, alone or combined with a route.
+func (c *Conn) negotiateCompression(level int) {
+	p := c.respHeader.Get("Sec-WebSocket-Protocol")
+	if p != StreamCompressionProtocol && !strings.HasSuffix(p, "+"+StreamCompressionProtocol) {
+		return
+	}
+	c.zw, _ = gzip.NewWriterLevel(writerFunc(c.writeStream), level)
+	c.zr = &gzipReader{src: c.stream()}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.zw == nil {
+		return c.writeStream(b)
+	}
+	n, err := c.zw.Write(b)
+	if err == nil {
+		err = c.zw.Flush()
+	}
+	return n, err
+}
+
+// gzipReader defers reading the gzip header until the first Read, so that
+// Read does not block before the server sends any data.
+type gzipReader struct {
+	src io.Reader
+	zr  *gzip.Reader
+}
+
+func (r *gzipReader) Read(b []byte) (int, error) {
+	if r.zr == nil {
+		zr, err := gzip.NewReader(r.src)
+		if err != nil {
+			return 0, err
+		}
+		r.zr = zr
+	}
+	return r.zr.Read(b)
+}
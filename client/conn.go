@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zijiren233/gwst/internal/wire"
+	"golang.org/x/net/websocket"
+)
+
+const DefaultBufferSize = 16 * 1024
+
+var closeCodec = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		return v.([]byte), websocket.CloseFrame, nil
+	},
+}
+
+const ConnIDHeader = "X-WST-Conn-Id"
+
+type Conn struct {
+	*websocket.Conn
+	raw          net.Conn
+	fr           *frameReader
+	respHeader   http.Header
+	pinger       wire.Pinger
+	maxFrameSize int
+	text         bool
+	zw           *gzip.Writer
+	zr           *gzipReader
+	or           *wire.ObfuscatingReader
+	ow           *wire.ObfuscatingWriter
+}
+
+func newConn(ws *websocket.Conn, raw net.Conn) *Conn {
+	c := &Conn{
+		Conn: ws,
+		raw:  raw,
+	}
+	c.fr = &frameReader{
+		ws:     ws,
+		pinger: &c.pinger,
+	}
+	return c
+}
+
+// Ping measures the round-trip time to the server. The matching pong is
+// consumed by Read, so another goroutine must be reading from the conn.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	return c.pinger.Ping(ctx, c.Conn)
+}
+
+func (c *Conn) ConnID() string {
+	return c.respHeader.Get(ConnIDHeader)
+}
+
+// ResponseHeader returns the headers of the server's handshake response,
+// such as Sec-WebSocket-Protocol or Sec-WebSocket-Extensions. It is a copy and
+// may be modified.
+func (c *Conn) ResponseHeader() http.Header {
+	return c.respHeader.Clone()
+}
+
+// Subprotocol returns the subprotocol selected by the server, if any. When
+// compression or text mode was negotiated along with a route, it is the
+// route alone.
+func (c *Conn) Subprotocol() string {
+	p := c.respHeader.Get("Sec-WebSocket-Protocol")
+	if c.zw != nil {
+		p = strings.TrimSuffix(p, "+"+StreamCompressionProtocol)
+	}
+	if c.text {
+		p = strings.TrimSuffix(p, "+"+TextModeProtocol)
+	}
+	return p
+}
+
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	err := closeCodec.Send(c.Conn, closePayload(code, reason))
+	if cerr := c.raw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// CloseWrite signals the server that no more data will be sent. If the server
+// agreed to half-close (see HalfCloseHeader), it half-closes its target
+// connection and keeps relaying the other direction until the target
+// finishes, after which Read returns io.EOF. Otherwise the server would not
+// act on the signal, so CloseWrite closes the connection instead.
+func (c *Conn) CloseWrite() error {
+	if c.respHeader.Get(HalfCloseHeader) != "1" {
+		return c.Close()
+	}
+	if c.zw != nil {
+		if err := c.zw.Close(); err != nil {
+			return err
+		}
+	}
+	return halfCloseCodec.Send(c.Conn, nil)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.fr.closeErr != nil {
+		return 0, c.readCloseError()
+	}
+	r := c.stream()
+	if c.zr != nil {
+		r = c.zr
+	}
+	n, err := r.Read(b)
+	if c.fr.closeErr != nil {
+		return n, c.readCloseError()
+	}
+	return n, err
+}
+
+func (c *Conn) readCloseError() error {
+	switch c.fr.closeErr.Code {
+	case CloseNormalClosure, CloseNoStatus:
+		return io.EOF
+	default:
+		return c.fr.closeErr
+	}
+}
+
+func (c *Conn) CloseError() *CloseError {
+	return c.fr.closeErr
+}
+
+type BufferedConn struct {
+	net.Conn
+	*bufio.Reader
+}
+
+func NewBufferedConn(conn net.Conn, size int) *BufferedConn {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &BufferedConn{
+		Conn:   conn,
+		Reader: bufio.NewReaderSize(conn, size),
+	}
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
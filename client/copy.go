@@ -0,0 +1,23 @@
+package client
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/zijiren233/gwst/internal/wire"
+)
+
+type deadlineWriter = wire.DeadlineWriter
+
+// CopyBufferWithWriteTimeout copies src to dst, failing a write that stalls
+// for longer than timeout; see wire.CopyBufferWithWriteTimeout.
+func CopyBufferWithWriteTimeout(dst deadlineWriter, src io.Reader, buf []byte, timeout time.Duration) (written int64, err error) {
+	return wire.CopyBufferWithWriteTimeout(dst, src, buf, timeout)
+}
+
+// CopyWithContext is CopyBufferWithWriteTimeout that stops when ctx is done,
+// returning ctx.Err(); see wire.CopyWithContext.
+func CopyWithContext(ctx context.Context, dst deadlineWriter, src io.Reader, buf []byte, timeout time.Duration) (int64, error) {
+	return wire.CopyWithContext(ctx, dst, src, buf, timeout)
+}
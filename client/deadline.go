@@ -0,0 +1,41 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// SetDeadline sets the read and write deadlines of the underlying connection,
+// with the same semantics as net.Conn: t is an absolute time that applies to
+// pending and future calls, not a per-call timeout, until it is changed. A
+// zero t disables the deadline. Calls that time out return an error wrapping
+// os.ErrDeadlineExceeded.
+//
+// The read deadline bounds Read as a whole; pongs answering Ping are consumed
+// inside Read and neither satisfy nor extend it. After a Read times out the
+// conn can be read again once the deadline is extended, except on a
+// compressed conn, whose decompressor keeps returning the timeout error.
+//
+// The write deadline also applies to the frames sent by Ping, CloseWrite and
+// CloseWithCode. As with tls.Conn, a write that times out may leave a partial
+// frame on the wire, so the conn should be closed afterwards.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.raw.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline; see SetDeadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.raw.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline; see SetDeadline.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.raw.SetWriteDeadline(t)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.As(err, &ne) && ne.Timeout()
+}
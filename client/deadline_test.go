@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// stallingServer accepts websockets and runs serve on each; release unblocks
+// servers waiting on it.
+func stallingServer(t *testing.T, serve func(ws *websocket.Conn, release <-chan struct{})) *Conn {
+	t.Helper()
+	release := make(chan struct{})
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) { serve(ws, release) }))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	conn, err := Connect(context.Background(), WithAddr(strings.TrimPrefix(srv.URL, "http://")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*Conn)
+}
+
+func TestReadDeadline(t *testing.T) {
+	later := make(chan struct{})
+	c := stallingServer(t, func(ws *websocket.Conn, release <-chan struct{}) {
+		select {
+		case <-later:
+			_ = websocket.Message.Send(ws, []byte("late"))
+		case <-release:
+		}
+		<-release
+	})
+
+	_ = c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := c.Read(make([]byte, 16))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read error %v, want os.ErrDeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("read returned after %v", d)
+	}
+
+	// The deadline is absolute: it keeps failing reads until it is moved.
+	if _, err := c.Read(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("second read error %v, want os.ErrDeadlineExceeded", err)
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	close(later)
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "late" {
+		t.Fatalf("read %q, %v after clearing the deadline", b, err)
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	c := stallingServer(t, func(_ *websocket.Conn, release <-chan struct{}) {
+		<-release
+	})
+	_ = c.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	chunk := make([]byte, 64<<10)
+	start := time.Now()
+	for {
+		_, err := c.Write(chunk)
+		if err == nil {
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("writes to a peer that does not read never timed out")
+			}
+			continue
+		}
+		var ne net.Error
+		if !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &ne) || !ne.Timeout() {
+			t.Fatalf("write error %v, want a timeout", err)
+		}
+		break
+	}
+	if _, err := c.Ping(context.Background()); !isTimeout(err) {
+		t.Fatalf("ping after the write deadline: %v, want a timeout", err)
+	}
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// LocalForwarder listens on a local TCP address and tunnels every accepted
+// connection over a new websocket from Dialer, like ssh -L.
+type LocalForwarder struct {
+	ListenAddr   string
+	Dialer       *Dialer
+	BufferSize   int
+	WriteTimeout time.Duration
+
+	mu     sync.Mutex
+	ln     net.Listener
+	closed bool
+}
+
+func (f *LocalForwarder) Serve() error {
+	ln, err := net.Listen("tcp", f.ListenAddr)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	f.ln = ln
+	f.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if f.isClosed() {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go f.forward(conn)
+	}
+}
+
+// Addr returns the listening address, or nil before Serve has started.
+func (f *LocalForwarder) Addr() net.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ln == nil {
+		return nil
+	}
+	return f.ln.Addr()
+}
+
+func (f *LocalForwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.ln == nil {
+		return nil
+	}
+	return f.ln.Close()
+}
+
+func (f *LocalForwarder) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func (f *LocalForwarder) forward(local net.Conn) {
+	defer local.Close()
+	remote, err := f.Dialer.Dial()
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+	pipe(local, remote, f.BufferSize, f.WriteTimeout)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func pipe(a, b net.Conn, bufferSize int, timeout time.Duration) {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pipeHalf(a, b, make([]byte, bufferSize), timeout)
+	}()
+	pipeHalf(b, a, make([]byte, bufferSize), timeout)
+	<-done
+}
+
+func pipeHalf(dst, src net.Conn, buf []byte, timeout time.Duration) {
+	_, err := CopyBufferWithWriteTimeout(dst, src, buf, timeout)
+	if err != nil {
+		dst.Close()
+		src.Close()
+		return
+	}
+	if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+		return
+	}
+	dst.Close()
+}
@@ -0,0 +1,29 @@
+package client
+
+// WithMaxFrameSize caps the payload of each websocket frame the conn writes
+// at n bytes, splitting larger writes into several complete binary frames.
+func WithMaxFrameSize(n int) ConnectOption {
+	return func(c *ConnectConfig) {
+		c.MaxFrameSize = n
+	}
+}
+
+func (c *Conn) writeFrames(b []byte) (int, error) {
+	if c.text {
+		return c.writeText(b)
+	}
+	if c.maxFrameSize <= 0 {
+		return c.Conn.Write(b)
+	}
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), c.maxFrameSize)]
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+)
+
+const (
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// maxHandshakeHeader bounds the response header buffered while a fixed
+	// handshake key is translated.
+	maxHandshakeHeader = 64 << 10
+)
+
+var errHandshakeHeaderTooLarge = errors.New("handshake response header too large")
+
+type handshakeRecorder struct {
+	net.Conn
+	buf       bytes.Buffer
+	recording bool
+
+	// key, when set, is sent as the Sec-WebSocket-Key in place of the nonce
+	// generated by x/net, whose accept value is then put back into the
+	// response so that x/net still validates it.
+	key        string
+	nonce      string
+	request    []byte
+	pending    []byte
+	translated bool
+}
+
+func newHandshakeRecorder(conn net.Conn, key string) *handshakeRecorder {
+	return &handshakeRecorder{
+		Conn:      conn,
+		recording: true,
+		key:       key,
+	}
+}
+
+func (r *handshakeRecorder) Write(b []byte) (int, error) {
+	if r.key == "" || r.nonce != "" {
+		return r.Conn.Write(b)
+	}
+	// The request has no body, so it is complete at the end of its header.
+	r.request = append(r.request, b...)
+	if !bytes.Contains(r.request, []byte("\r\n\r\n")) {
+		return len(b), nil
+	}
+	req, nonce, ok := replaceHeader(r.request, "Sec-WebSocket-Key", r.key)
+	if !ok {
+		return 0, errors.New("handshake request has no Sec-WebSocket-Key")
+	}
+	r.nonce, r.request = nonce, nil
+	if _, err := r.Conn.Write(req); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (r *handshakeRecorder) Read(b []byte) (int, error) {
+	if r.nonce != "" && !r.translated {
+		if err := r.translateResponse(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if len(r.pending) > 0 {
+		n = copy(b, r.pending)
+		r.pending = r.pending[n:]
+	} else {
+		n, err = r.Conn.Read(b)
+	}
+	if r.recording && n > 0 {
+		r.buf.Write(b[:n])
+	}
+	return n, err
+}
+
+// translateResponse buffers the response header and replaces the accept value
+// of the fixed key with that of the nonce x/net expects.
+func (r *handshakeRecorder) translateResponse() error {
+	chunk := make([]byte, 1024)
+	for !bytes.Contains(r.pending, []byte("\r\n\r\n")) {
+		if len(r.pending) > maxHandshakeHeader {
+			return errHandshakeHeaderTooLarge
+		}
+		n, err := r.Conn.Read(chunk)
+		r.pending = append(r.pending, chunk[:n]...)
+		if err != nil {
+			return err
+		}
+	}
+	r.translated = true
+	if resp, accept, ok := replaceHeader(r.pending, "Sec-WebSocket-Accept", acceptKey(r.nonce)); ok &&
+		accept == acceptKey(r.key) {
+		r.pending = resp
+	}
+	return nil
+}
+
+// replaceHeader replaces the value of the first name header in the HTTP
+// header block msg, returning the new message and the old value.
+func replaceHeader(msg []byte, name, value string) ([]byte, string, bool) {
+	end := bytes.Index(msg, []byte("\r\n\r\n"))
+	for i := bytes.Index(msg, []byte("\r\n")); i >= 0 && i < end; {
+		line := msg[i+2:]
+		next := bytes.Index(line, []byte("\r\n"))
+		line = line[:next]
+		if k, v, ok := bytes.Cut(line, []byte(":")); ok &&
+			http.CanonicalHeaderKey(string(bytes.TrimSpace(k))) == http.CanonicalHeaderKey(name) {
+			start := i + 2 + len(k) + 1
+			out := append([]byte{}, msg[:start]...)
+			out = append(out, ' ')
+			out = append(out, value...)
+			out = append(out, msg[i+2+next:]...)
+			return out, string(bytes.TrimSpace(v)), true
+		}
+		i += 2 + next
+	}
+	return msg, "", false
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (r *handshakeRecorder) finish() http.Header {
+	resp := r.response()
+	if resp == nil {
+		return nil
+	}
+	return resp.Header
+}
+
+func (r *handshakeRecorder) response() *http.Response {
+	r.recording = false
+	defer r.buf.Reset()
+	resp, err := http.ReadResponse(bufio.NewReader(&r.buf), nil)
+	if err != nil {
+		return nil
+	}
+	_ = resp.Body.Close()
+	return resp
+}
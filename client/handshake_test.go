@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestHandshakeKey(t *testing.T) {
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	var got string
+	srv := httptest.NewServer(websocket.Server{
+		Handshake: func(_ *websocket.Config, req *http.Request) error {
+			got = req.Header.Get("Sec-WebSocket-Key")
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) { _, _ = io.Copy(ws, ws) },
+	})
+	t.Cleanup(srv.Close)
+
+	conn, err := Connect(context.Background(),
+		WithAddr(strings.TrimPrefix(srv.URL, "http://")),
+		WithHandshakeKey(key),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got != key {
+		t.Fatalf("server saw key %q, want %q", got, key)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
+
+func TestHandshakeKeyInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("WithHandshakeKey accepted a key that is not 16 bytes")
+		}
+	}()
+	WithHandshakeKey("c2hvcnQ=")
+}
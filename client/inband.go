@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/zijiren233/gwst/internal/wire"
+	"golang.org/x/net/websocket"
+)
+
+// InbandStatus is the server's answer to an in-band target; see
+// WithInbandTarget.
+type InbandStatus = wire.InbandStatus
+
+const (
+	InbandOK                 = wire.InbandOK
+	InbandMalformed          = wire.InbandMalformed
+	InbandUnsupportedNetwork = wire.InbandUnsupportedNetwork
+	InbandNotAllowed         = wire.InbandNotAllowed
+	InbandDialFailed         = wire.InbandDialFailed
+	InbandTimeout            = wire.InbandTimeout
+)
+
+// InbandTargetError is returned when the server does not accept the in-band
+// target.
+type InbandTargetError struct {
+	Status InbandStatus
+}
+
+func (e *InbandTargetError) Error() string {
+	return fmt.Sprintf("in-band target rejected: %s", e.Status)
+}
+
+// WithInbandTarget names the target inside the tunnel, for a server using
+// WithInbandTarget, rather than in headers or the path visible to
+// TLS-terminating middleboxes. Connect sends addr, as "tcp:" + addr, in the
+// first message and returns once the server has dialed it, or an
+// *InbandTargetError if it refused.
+func WithInbandTarget(addr string) ConnectOption {
+	return func(c *ConnectConfig) {
+		c.InbandTarget = addr
+	}
+}
+
+// requestInbandTarget sends the in-band target preamble and waits for the
+// server's status.
+func (c *Conn) requestInbandTarget(ctx context.Context, addr string) error {
+	target := "tcp:" + addr
+	if len(target) > wire.MaxInbandTarget {
+		return fmt.Errorf("in-band target too long: %d bytes", len(target))
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.raw.SetDeadline(time.Unix(1, 0))
+	})
+	status, err := c.exchangeInbandTarget(target)
+	if !stop() {
+		err = errors.Join(err, ctx.Err())
+		_ = c.raw.SetDeadline(time.Time{})
+	}
+	if err == nil && status != InbandOK {
+		err = &InbandTargetError{Status: status}
+	}
+	return err
+}
+
+func (c *Conn) exchangeInbandTarget(target string) (InbandStatus, error) {
+	preamble := binary.BigEndian.AppendUint16(nil, uint16(len(target)))
+	msg := append(preamble, target...)
+	var err error
+	if c.text {
+		_, err = c.writeText(msg)
+	} else {
+		err = websocket.Message.Send(c.Conn, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(c.fr, status[:]); err != nil {
+		if c.fr.closeErr != nil {
+			return 0, c.readCloseError()
+		}
+		return 0, err
+	}
+	return InbandStatus(status[0]), nil
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"errors"
+	"io"
+
+	"github.com/zijiren233/gwst/internal/wire"
+)
+
+const (
+	ObfuscationHeader = wire.ObfuscationHeader
+	ObfuscationScheme = wire.ObfuscationScheme
+)
+
+// ErrObfuscationRejected is returned by Connect when WithObfuscation is set
+// but the server did not agree to obfuscate the stream.
+var ErrObfuscationRejected = errors.New("server did not accept obfuscation")
+
+// WithObfuscation scrambles the tunneled byte stream with psk, which must
+// match the server's WithObfuscation key, so that the traffic inside the
+// websocket does not look like the protocol it carries. It defeats naive DPI
+// and is not security: there is no authentication or integrity, and
+// confidentiality still depends on TLS. Off by default.
+func WithObfuscation(psk []byte) ConnectOption {
+	if len(psk) == 0 {
+		panic("wst: obfuscation key must not be empty")
+	}
+	return func(c *ConnectConfig) {
+		c.ObfuscationKey = psk
+	}
+}
+
+// negotiateObfuscation checks that the server echoed the obfuscation scheme
+// and sets up the stream ciphers.
+func (c *Conn) negotiateObfuscation(psk []byte) error {
+	if c.respHeader.Get(ObfuscationHeader) != ObfuscationScheme {
+		return ErrObfuscationRejected
+	}
+	block := wire.NewObfuscationCipher(psk)
+	c.or = wire.NewObfuscatingReader(c.fr, block)
+	c.ow = wire.NewObfuscatingWriter(writerFunc(c.writeFrames), block)
+	return nil
+}
+
+// stream returns the reader of the tunneled stream below any decompression.
+func (c *Conn) stream() io.Reader {
+	if c.or != nil {
+		return c.or
+	}
+	return c.fr
+}
+
+func (c *Conn) writeStream(b []byte) (int, error) {
+	if c.ow != nil {
+		return c.ow.Write(b)
+	}
+	return c.writeFrames(b)
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"strings"
+)
+
+var ErrPathTemplate = errors.New("invalid path template")
+
+// WithPathTemplate sets the path from tmpl, replacing each {name} placeholder
+// with the path-escaped value of vars[name] at dial time. Connecting fails
+// with ErrPathTemplate if a placeholder has no value or a brace is unmatched.
+// It overrides WithPath.
+func WithPathTemplate(tmpl string, vars map[string]string) ConnectOption {
+	vars = maps.Clone(vars)
+	return func(c *ConnectConfig) {
+		c.PathTemplate = tmpl
+		c.PathVars = vars
+	}
+}
+
+func expandPathTemplate(tmpl string, vars map[string]string) (string, error) {
+	var b strings.Builder
+	var missing []string
+	for rest := tmpl; ; {
+		i := strings.IndexAny(rest, "{}")
+		if i < 0 {
+			b.WriteString(rest)
+			break
+		}
+		if rest[i] == '}' {
+			return "", fmt.Errorf("%w: unmatched '}' in %q", ErrPathTemplate, tmpl)
+		}
+		b.WriteString(rest[:i])
+		var name string
+		var ok bool
+		name, rest, ok = strings.Cut(rest[i+1:], "}")
+		if !ok || strings.Contains(name, "{") {
+			return "", fmt.Errorf("%w: unmatched '{' in %q", ErrPathTemplate, tmpl)
+		}
+		if name == "" {
+			return "", fmt.Errorf("%w: empty placeholder in %q", ErrPathTemplate, tmpl)
+		}
+		value, ok := vars[name]
+		if !ok {
+			missing = append(missing, name)
+		}
+		b.WriteString(url.PathEscape(value))
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%w: no value for %s", ErrPathTemplate, strings.Join(missing, ", "))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPoolMaxIdle     = 4
+	DefaultPoolPingTimeout = 2 * time.Second
+)
+
+var ErrPoolClosed = errors.New("dial pool closed")
+
+// DialPool keeps idle conns from Dialer for explicit reuse. Get returns the
+// most recently returned idle conn that still answers a ping, or dials a new
+// one; Put hands a conn back once the caller knows the tunneled stream is in a
+// reusable state. Nothing is pooled implicitly.
+type DialPool struct {
+	Dialer *Dialer
+	// MaxIdle caps the idle conns kept; extra conns passed to Put are closed.
+	// It defaults to DefaultPoolMaxIdle.
+	MaxIdle int
+	// IdleTimeout closes conns that have been idle for longer. Zero keeps
+	// them until Close.
+	IdleTimeout time.Duration
+	// PingTimeout bounds the liveness check in Get. It defaults to
+	// DefaultPoolPingTimeout.
+	PingTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   []idleConn
+	timer  *time.Timer
+	closed bool
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+func (p *DialPool) Get(ctx context.Context) (net.Conn, error) {
+	for {
+		conn, err := p.popIdle()
+		if err != nil {
+			return nil, err
+		}
+		if conn == nil {
+			return p.Dialer.DialContext(ctx)
+		}
+		if p.alive(ctx, conn) {
+			return conn, nil
+		}
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (p *DialPool) Put(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	maxIdle := p.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = DefaultPoolMaxIdle
+	}
+	if p.closed || len(p.idle) >= maxIdle {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, idleConn{conn: conn, since: time.Now()})
+	if p.IdleTimeout > 0 && p.timer == nil {
+		p.timer = time.AfterFunc(p.IdleTimeout, p.evict)
+	}
+}
+
+// Close closes all idle conns. Conns passed to Put afterwards are closed.
+func (p *DialPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	for _, ic := range p.idle {
+		ic.conn.Close()
+	}
+	p.idle = nil
+	return nil
+}
+
+func (p *DialPool) popIdle() (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	for len(p.idle) > 0 {
+		ic := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.IdleTimeout > 0 && time.Since(ic.since) > p.IdleTimeout {
+			ic.conn.Close()
+			continue
+		}
+		return ic.conn, nil
+	}
+	return nil, nil
+}
+
+func (p *DialPool) evict() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timer = nil
+	if p.closed {
+		return
+	}
+	// idle is ordered oldest first.
+	var n int
+	for n < len(p.idle) && time.Since(p.idle[n].since) >= p.IdleTimeout {
+		p.idle[n].conn.Close()
+		n++
+	}
+	p.idle = append(p.idle[:0], p.idle[n:]...)
+	if len(p.idle) > 0 {
+		p.timer = time.AfterFunc(p.IdleTimeout-time.Since(p.idle[0].since), p.evict)
+	}
+}
+
+// alive pings an idle conn. The pong is consumed by a frame read, below any
+// decompressor so the timeout does not stick, that is then interrupted with a
+// read deadline. Data received while idle means the stream is not reusable.
+func (p *DialPool) alive(ctx context.Context, conn net.Conn) bool {
+	c, ok := conn.(*Conn)
+	if !ok {
+		return true
+	}
+	timeout := p.PingTimeout
+	if timeout <= 0 {
+		timeout = DefaultPoolPingTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	readErr := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		n, err := c.fr.Read(b[:])
+		if n > 0 {
+			err = errors.New("unexpected data on idle conn")
+		}
+		readErr <- err
+	}()
+	_, err := c.Ping(ctx)
+	_ = c.SetReadDeadline(time.Unix(1, 0))
+	rerr := <-readErr
+	_ = c.SetReadDeadline(time.Time{})
+	return err == nil && isTimeout(rerr)
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const maxRedirects = 5
+
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// RedirectError is returned when the server answers the handshake with a
+// redirect and redirects are not followed.
+type RedirectError struct {
+	Location   string
+	StatusCode int
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("websocket handshake redirected (%d) to %s", e.StatusCode, e.Location)
+}
+
+// WithFollowRedirects makes the dialer reconnect to the location of a
+// redirect returned by the server, up to 5 times.
+func WithFollowRedirects() ConnectOption {
+	return func(c *ConnectConfig) {
+		c.FollowRedirects = true
+	}
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *ConnectConfig) redirect(location string) error {
+	scheme := "ws"
+	if c.TLS {
+		scheme = "wss"
+	}
+	path, query, _ := strings.Cut(c.Path, "?")
+	base := &url.URL{Scheme: scheme, Host: c.Addr, Path: path, RawQuery: query}
+	u, err := base.Parse(location)
+	if err != nil {
+		return fmt.Errorf("invalid redirect location %q: %w", location, err)
+	}
+	switch u.Scheme {
+	case "ws", "http":
+		c.TLS = false
+	case "wss", "https":
+		c.TLS = true
+	default:
+		return fmt.Errorf("unsupported redirect scheme %q", u.Scheme)
+	}
+	if u.Host != c.Addr {
+		c.Addr = u.Host
+		c.Host = ""
+		c.ServerName = ""
+		c.ConnectIP = ""
+		c.ConnectAddr = ""
+	}
+	// The location replaces the path, and a template would expand over it.
+	c.Path = u.Path
+	if u.RawQuery != "" {
+		c.Path += "?" + u.RawQuery
+	}
+	c.PathTemplate = ""
+	c.PathVars = nil
+	return nil
+}
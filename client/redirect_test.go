@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestRedirect(t *testing.T) {
+	for _, tc := range []struct {
+		path, location, want string
+	}{
+		{"/a", "/b", "/b"},
+		{"/a", "/b?token=x", "/b?token=x"},
+		{"/a/b?q=1", "c?r=2", "/a/c?r=2"},
+		{"/a?q=1", "?r=2", "/a?r=2"},
+	} {
+		c := ConnectConfig{}
+		c.Addr = "example.com"
+		c.Path = tc.path
+		c.PathTemplate = "/{x}"
+		c.PathVars = map[string]string{"x": "y"}
+		if err := c.redirect(tc.location); err != nil {
+			t.Fatal(err)
+		}
+		if c.Path != tc.want || c.PathTemplate != "" || c.PathVars != nil {
+			t.Errorf("%s -> %s: path %q template %q, want %q", tc.path, tc.location, c.Path, c.PathTemplate, tc.want)
+		}
+	}
+}
+
+func TestFollowRedirectKeepsQuery(t *testing.T) {
+	ws := websocket.Server{Handler: func(ws *websocket.Conn) {}}
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/old" {
+			http.Redirect(w, req, "/new?token=abc", http.StatusFound)
+			return
+		}
+		got = req.URL.RequestURI()
+		ws.ServeHTTP(w, req)
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, err := Connect(context.Background(),
+		WithAddr(strings.TrimPrefix(srv.URL, "http://")),
+		WithPathTemplate("/{p}", map[string]string{"p": "old"}),
+		WithFollowRedirects(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got != "/new?token=abc" {
+		t.Fatalf("redirected to %q, want /new?token=abc", got)
+	}
+}
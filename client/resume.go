@@ -0,0 +1,353 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	ResumeHeader       = "X-WST-Resume"
+	ResumeOffsetHeader = "X-WST-Resume-Offset"
+
+	// DefaultResumeBuffer is how much sent data is kept for replay after a
+	// reconnect. It matches the server's replay buffer and has to cover what
+	// may be in flight on a dropped websocket, socket buffers included.
+	DefaultResumeBuffer = 4 << 20
+)
+
+var ErrResumeFailed = errors.New("failed to resume session")
+
+// WithResumableSessions asks the server to keep the target connection open
+// for grace after the websocket drops. Connect then returns a ResumableConn,
+// which reconnects within grace and re-attaches to the same target instead
+// of failing. The server must enable WithResumableSessions too; otherwise the
+// conn is an ordinary one. Stream compression is not used on resumable conns.
+func WithResumableSessions(grace time.Duration) ConnectOption {
+	return func(c *ConnectConfig) {
+		c.ResumeGrace = grace
+	}
+}
+
+func setResumeHeaders(header http.Header, cfg *ConnectDialConfig) {
+	if cfg.ResumeGrace <= 0 {
+		return
+	}
+	if cfg.resumeToken == "" {
+		header.Set(ResumeHeader, "new")
+		return
+	}
+	header.Set(ResumeHeader, cfg.resumeToken)
+	header.Set(ResumeOffsetHeader, strconv.FormatInt(cfg.resumeOffset, 10))
+}
+
+// ResumableConn is a tunnel that survives transport drops. When the websocket
+// fails without a close frame, Read and Write block while it reconnects with
+// the session's resume token; both ends then replay the bytes the other did
+// not receive. Once the server's grace period has passed, or the server no
+// longer knows the session, Read and Write fail with ErrResumeFailed.
+type ResumableConn struct {
+	cfg   ConnectConfig
+	token string
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	conn          *Conn
+	gen           int
+	broken        bool
+	err           error
+	closed        bool
+	writeClosed   bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readMu sync.Mutex
+	recvd  int64
+
+	// sent holds the last bytes written, ending at offset sentEnd.
+	writeMu sync.Mutex
+	sent    []byte
+	sentEnd int64
+}
+
+func connectResumable(ctx context.Context, cfg ConnectConfig) (net.Conn, error) {
+	cfg.Compression = false
+	conn, err := connectWithRedirects(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := conn.(*Conn)
+	token := c.respHeader.Get(ResumeHeader)
+	if token == "" {
+		return c, nil
+	}
+	rc := &ResumableConn{
+		cfg:   cfg,
+		token: token,
+		conn:  c,
+	}
+	rc.cond = sync.NewCond(&rc.mu)
+	return rc, nil
+}
+
+// current waits for a pending reconnect and returns the live conn.
+func (c *ResumableConn) current() (*Conn, int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.broken && c.err == nil && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return nil, 0, net.ErrClosed
+	}
+	if c.err != nil {
+		return nil, 0, c.err
+	}
+	return c.conn, c.gen, nil
+}
+
+// transportLost reports whether err means the websocket dropped rather than
+// being closed by the server or timing out.
+func transportLost(conn *Conn, err error) bool {
+	return conn.fr.closeErr == nil && !conn.fr.eof && !isTimeout(err)
+}
+
+func (c *ResumableConn) Read(b []byte) (int, error) {
+	for {
+		conn, gen, err := c.current()
+		if err != nil {
+			return 0, err
+		}
+		c.readMu.Lock()
+		n, err := conn.Read(b)
+		c.recvd += int64(n)
+		c.readMu.Unlock()
+		if err == nil || !transportLost(conn, err) {
+			return n, err
+		}
+		c.lose(gen)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (c *ResumableConn) Write(b []byte) (int, error) {
+	for {
+		conn, gen, err := c.current()
+		if err != nil {
+			return 0, err
+		}
+		c.writeMu.Lock()
+		c.mu.Lock()
+		stale := c.gen != gen
+		c.mu.Unlock()
+		if stale {
+			c.writeMu.Unlock()
+			continue
+		}
+		c.remember(b)
+		n, err := conn.Write(b)
+		c.writeMu.Unlock()
+		if err == nil || isTimeout(err) {
+			return n, err
+		}
+		// The whole of b is replayed after reconnecting.
+		c.lose(gen)
+		if _, _, err := c.current(); err != nil {
+			return n, err
+		}
+		return len(b), nil
+	}
+}
+
+// remember appends b to the replay buffer, keeping at least the last
+// DefaultResumeBuffer bytes.
+func (c *ResumableConn) remember(b []byte) {
+	c.sent = append(c.sent, b...)
+	c.sentEnd += int64(len(b))
+	if len(c.sent) > 2*DefaultResumeBuffer {
+		c.sent = append(c.sent[:0], c.sent[len(c.sent)-DefaultResumeBuffer:]...)
+	}
+}
+
+// lose starts reconnecting unless the transport of generation gen was already
+// replaced.
+func (c *ResumableConn) lose(gen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen || c.broken || c.closed {
+		return
+	}
+	c.broken = true
+	_ = c.conn.raw.Close()
+	go c.reconnect()
+}
+
+func (c *ResumableConn) reconnect() {
+	// The old transport is closed, so pending reads and writes on it return
+	// promptly and the counters are settled once the locks are held.
+	c.readMu.Lock()
+	recvd := c.recvd
+	c.readMu.Unlock()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	deadline := time.Now().Add(c.cfg.ResumeGrace)
+	backoff := 100 * time.Millisecond
+	for {
+		conn, err := c.resume(deadline, recvd)
+		if err == nil {
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				_ = conn.raw.Close()
+				return
+			}
+			// The server announces the backend only when it dials it.
+			if info := c.conn.fr.backend.Load(); info != nil {
+				conn.fr.backend.CompareAndSwap(nil, info)
+			}
+			c.conn = conn
+			c.gen++
+			c.broken = false
+			c.cond.Broadcast()
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed || errors.Is(err, websocket.ErrBadStatus) || time.Now().Add(backoff).After(deadline) {
+			c.fail(errors.Join(ErrResumeFailed, err))
+			return
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, 2*time.Second)
+	}
+}
+
+// resume reconnects and replays what the server has not received.
+func (c *ResumableConn) resume(deadline time.Time, recvd int64) (*Conn, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	cfg := c.cfg
+	cfg.resumeToken = c.token
+	cfg.resumeOffset = recvd
+	nc, err := connectWithRedirects(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn := nc.(*Conn)
+	offset, err := strconv.ParseInt(conn.respHeader.Get(ResumeOffsetHeader), 10, 64)
+	if err == nil && (offset < c.sentEnd-int64(len(c.sent)) || offset > c.sentEnd) {
+		err = errors.New("server offset outside replay buffer")
+	}
+	if err == nil {
+		c.mu.Lock()
+		rd, wd, writeClosed := c.readDeadline, c.writeDeadline, c.writeClosed
+		c.mu.Unlock()
+		_ = conn.raw.SetReadDeadline(rd)
+		_ = conn.raw.SetWriteDeadline(wd)
+		if pending := c.sent[len(c.sent)-int(c.sentEnd-offset):]; len(pending) > 0 {
+			_, err = conn.Write(pending)
+		}
+		if err == nil && writeClosed {
+			err = conn.CloseWrite()
+		}
+	}
+	if err != nil {
+		_ = conn.raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *ResumableConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	c.cond.Broadcast()
+}
+
+// ResponseHeader returns the handshake response headers of the current
+// transport; see Conn.ResponseHeader.
+func (c *ResumableConn) ResponseHeader() http.Header {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.ResponseHeader()
+}
+
+// Token returns the resume token identifying the session on the server.
+func (c *ResumableConn) Token() string {
+	return c.token
+}
+
+func (c *ResumableConn) CloseWrite() error {
+	conn, _, err := c.current()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.writeClosed = true
+	c.mu.Unlock()
+	return conn.CloseWrite()
+}
+
+func (c *ResumableConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	conn, broken := c.conn, c.broken
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	if broken {
+		return nil
+	}
+	return conn.CloseWithCode(CloseNormalClosure, "")
+}
+
+func (c *ResumableConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.LocalAddr()
+}
+
+func (c *ResumableConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines, which carry over to the
+// transports of later reconnects. Waiting for a reconnect is not bounded by
+// them.
+func (c *ResumableConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	return c.conn.SetDeadline(t)
+}
+
+func (c *ResumableConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *ResumableConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"syscall"
+)
+
+var ErrSourcePortsExhausted = errors.New("no free source port in range")
+
+// WithSourcePortRange binds outgoing connections to a local port in [min, max].
+// Ports are tried starting from a random offset; a port that is already in use,
+// either bound locally (EADDRINUSE) or already connected to the same server
+// address (EADDRNOTAVAIL), is skipped and the next one is tried, until every
+// port in the range has been attempted, after which ErrSourcePortsExhausted is
+// returned.
+func WithSourcePortRange(min, max int) ConnectOption {
+	return func(c *ConnectConfig) {
+		c.SourcePortMin = min
+		c.SourcePortMax = max
+	}
+}
+
+func dialFromSourcePort(cfg *ConnectDialConfig, dial func(*net.Dialer) (net.Conn, error)) (net.Conn, error) {
+	if cfg.SourcePortMin <= 0 || cfg.SourcePortMax < cfg.SourcePortMin {
+		return dial(cfg.Dialer)
+	}
+
+	var localIP net.IP
+	if addr, ok := cfg.Dialer.LocalAddr.(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+
+	n := cfg.SourcePortMax - cfg.SourcePortMin + 1
+	start := rand.IntN(n)
+	for i := 0; i < n; i++ {
+		dialer := *cfg.Dialer
+		dialer.LocalAddr = &net.TCPAddr{
+			IP:   localIP,
+			Port: cfg.SourcePortMin + (start+i)%n,
+		}
+		conn, err := dial(&dialer)
+		if err == nil {
+			return conn, nil
+		}
+		if !isPortConflict(err) {
+			return nil, err
+		}
+	}
+	return nil, ErrSourcePortsExhausted
+}
+
+func isPortConflict(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
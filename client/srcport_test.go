@@ -0,0 +1,62 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestSourcePortRetriesConflicts(t *testing.T) {
+	cfg := &ConnectDialConfig{Dialer: &net.Dialer{}, SourcePortMin: 40000, SourcePortMax: 40003}
+	var tried []int
+	conflicts := []error{
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)},
+		&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EADDRNOTAVAIL)},
+	}
+	conn, err := dialFromSourcePort(cfg, func(d *net.Dialer) (net.Conn, error) {
+		tried = append(tried, d.LocalAddr.(*net.TCPAddr).Port)
+		if len(tried) <= len(conflicts) {
+			return nil, conflicts[len(tried)-1]
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(tried) != 3 {
+		t.Fatalf("tried ports %v, want 3 attempts", tried)
+	}
+	for _, p := range tried {
+		if p < 40000 || p > 40003 {
+			t.Fatalf("port %d outside the range", p)
+		}
+	}
+}
+
+func TestSourcePortExhausted(t *testing.T) {
+	cfg := &ConnectDialConfig{Dialer: &net.Dialer{}, SourcePortMin: 40000, SourcePortMax: 40003}
+	seen := map[int]bool{}
+	_, err := dialFromSourcePort(cfg, func(d *net.Dialer) (net.Conn, error) {
+		seen[d.LocalAddr.(*net.TCPAddr).Port] = true
+		return nil, syscall.EADDRNOTAVAIL
+	})
+	if !errors.Is(err, ErrSourcePortsExhausted) || len(seen) != 4 {
+		t.Fatalf("got %v after %d ports, want ErrSourcePortsExhausted after 4", err, len(seen))
+	}
+}
+
+func TestSourcePortOtherError(t *testing.T) {
+	cfg := &ConnectDialConfig{Dialer: &net.Dialer{}, SourcePortMin: 40000, SourcePortMax: 40003}
+	attempts := 0
+	_, err := dialFromSourcePort(cfg, func(*net.Dialer) (net.Conn, error) {
+		attempts++
+		return nil, syscall.ECONNREFUSED
+	})
+	if !errors.Is(err, syscall.ECONNREFUSED) || attempts != 1 {
+		t.Fatalf("got %v after %d attempts, want ECONNREFUSED after 1", err, attempts)
+	}
+}
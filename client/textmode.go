@@ -0,0 +1,57 @@
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// TextModeProtocol is the websocket subprotocol under which the tunneled
+// stream travels as base64 in text frames, for paths that only pass text
+// messages.
+const TextModeProtocol = "wst-base64"
+
+var errBinaryInTextMode = errors.New("binary frame in text mode session")
+
+// WithTextMode offers the wst-base64 subprotocol and, if the server selects
+// it, sends and receives the stream as base64 in text frames, as browser
+// clients do, at the cost of a third more bytes on the wire. Compression is
+// not offered in text mode. If the server does not select it, the conn uses
+// binary frames.
+func WithTextMode() ConnectOption {
+	return func(c *ConnectConfig) {
+		c.TextMode = true
+	}
+}
+
+// negotiateTextMode enables text mode if the server selected the wst-base64
+// subprotocol, alone or combined with a route.
+func (c *Conn) negotiateTextMode() {
+	p := c.respHeader.Get("Sec-WebSocket-Protocol")
+	if p != TextModeProtocol && !strings.HasSuffix(p, "+"+TextModeProtocol) {
+		return
+	}
+	c.text = true
+	c.fr.text = true
+}
+
+// writeText writes b as base64 text frames, each encoding at most
+// c.maxFrameSize bytes.
+func (c *Conn) writeText(b []byte) (int, error) {
+	size := len(b)
+	if c.maxFrameSize > 0 {
+		size = max(c.maxFrameSize/4*3, 3)
+	}
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), size)]
+		if err := websocket.Message.Send(c.Conn, base64.StdEncoding.EncodeToString(chunk)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
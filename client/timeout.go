@@ -0,0 +1,32 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+const DefaultDialTimeout = 5 * time.Second
+
+// WithDialTimeout bounds the TCP dial to the server, excluding the TLS and
+// websocket handshakes. It defaults to DefaultDialTimeout.
+func WithDialTimeout(d time.Duration) ConnectOption {
+	return func(c *ConnectConfig) {
+		c.DialTimeout = d
+	}
+}
+
+// WithConnectTimeout bounds the whole connect: the TCP dial, the TLS
+// handshake, the websocket upgrade and any redirects followed. Without it only
+// the caller's context limits the handshakes.
+func WithConnectTimeout(d time.Duration) ConnectOption {
+	return func(c *ConnectConfig) {
+		c.ConnectTimeout = d
+	}
+}
+
+func withConnectTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
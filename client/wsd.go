@@ -1,10 +1,16 @@
-package main
+// Package client dials wst servers and returns the tunnel as a net.Conn; a
+// Dialer keeps shared options, and a LocalForwarder serves local connections
+// over it.
+package client
 
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"strings"
 	"time"
@@ -12,9 +18,7 @@ import (
 	"golang.org/x/net/websocket"
 )
 
-var defaultDialer = &net.Dialer{
-	Timeout: time.Second * 5,
-}
+var defaultDialer = &net.Dialer{}
 
 type ConnectAddrConfig struct {
 	Addr string
@@ -27,12 +31,43 @@ func (c *ConnectAddrConfig) Clone() *ConnectAddrConfig {
 }
 
 type ConnectDialConfig struct {
-	Dialer     *net.Dialer
-	Host       string
-	Path       string
-	ServerName string
-	TLS        bool
-	Insecure   bool
+	Dialer *net.Dialer
+	// DialContext, if set, dials the server instead of Dialer, for example
+	// through a proxy. WithSourcePortRange does not apply to it.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// TLSConfig is the base of the TLS configuration; ServerName and
+	// Insecure fill in what it leaves unset.
+	TLSConfig *tls.Config
+	// Header holds extra handshake request headers.
+	Header http.Header
+	// HandshakeKey, if set, is sent as the Sec-WebSocket-Key instead of a
+	// random nonce. See WithHandshakeKey.
+	HandshakeKey     string
+	ConnectIP        string
+	ConnectAddr      string
+	InbandTarget     string
+	Host             string
+	Path             string
+	PathTemplate     string
+	PathVars         map[string]string
+	ServerName       string
+	BufferSize       int
+	MaxFrameSize     int
+	CompressionLevel int
+	DialTimeout      time.Duration
+	ConnectTimeout   time.Duration
+	ResumeGrace      time.Duration
+	Subprotocols     []string
+	ObfuscationKey   []byte
+	SourcePortMin    int
+	SourcePortMax    int
+	TLS              bool
+	Insecure         bool
+	FollowRedirects  bool
+	Compression      bool
+	TextMode         bool
+	resumeToken      string
+	resumeOffset     int64
 }
 
 type splitedConnectDialConfig struct {
@@ -43,9 +78,26 @@ type splitedConnectDialConfig struct {
 
 func (c *ConnectDialConfig) Clone() *ConnectDialConfig {
 	clone := *c
+	clone.Header = c.Header.Clone()
 	return &clone
 }
 
+func (c *ConnectDialConfig) tlsConfig() *tls.Config {
+	var cfg *tls.Config
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = c.ServerName
+	}
+	if c.Insecure {
+		cfg.InsecureSkipVerify = true
+	}
+	return cfg
+}
+
 type ConnectConfig struct {
 	ConnectAddrConfig
 	ConnectDialConfig
@@ -79,6 +131,33 @@ func WithAddr(addr string) ConnectOption {
 	}
 }
 
+func WithConnectIP(ip string) ConnectOption {
+	return func(c *ConnectConfig) {
+		c.ConnectIP = ip
+	}
+}
+
+// WithEndpoints sets the three addresses of a connection independently: the
+// address dialed (host or host:port, the port defaulting to that of the
+// server address), the TLS server name, and the handshake Host header. They
+// take precedence over WithConnectIP and over deriving each from the others,
+// which SNI-based routers that expect all three to differ need. An empty
+// argument keeps the default for that address, or the value an earlier option
+// such as WithHost or WithDialTLS set.
+func WithEndpoints(connectAddr, sni, hostHeader string) ConnectOption {
+	return func(c *ConnectConfig) {
+		if connectAddr != "" {
+			c.ConnectAddr = connectAddr
+		}
+		if sni != "" {
+			c.ServerName = sni
+		}
+		if hostHeader != "" {
+			c.Host = hostHeader
+		}
+	}
+}
+
 func WithHost(host string) ConnectOption {
 	return func(c *ConnectConfig) {
 		c.Host = host
@@ -105,6 +184,64 @@ func WithDialer(dialer *net.Dialer) ConnectOption {
 	}
 }
 
+// WithDialContext dials the server with fn instead of a net.Dialer.
+func WithDialContext(fn func(ctx context.Context, network, addr string) (net.Conn, error)) ConnectOption {
+	return func(c *ConnectConfig) {
+		c.DialContext = fn
+	}
+}
+
+// WithTLSConfig enables TLS with cfg as the base configuration, for example
+// to set root CAs or a client certificate. Its ServerName, if set, overrides
+// the server name derived from the address.
+func WithTLSConfig(cfg *tls.Config) ConnectOption {
+	return func(c *ConnectConfig) {
+		c.TLS = true
+		c.TLSConfig = cfg
+	}
+}
+
+// WithHeader adds a header to the handshake request.
+func WithHeader(key, value string) ConnectOption {
+	return func(c *ConnectConfig) {
+		if c.Header == nil {
+			c.Header = make(http.Header)
+		}
+		c.Header.Add(key, value)
+	}
+}
+
+// WithHandshakeKey sends key, the base64 encoding of 16 bytes, as the
+// Sec-WebSocket-Key instead of a random nonce. It is meant for reproducible
+// handshake tests and for debugging proxies that act on the key; a fixed key
+// defeats the nonce's protection against caching intermediaries, so do not
+// use it otherwise.
+func WithHandshakeKey(key string) ConnectOption {
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		panic(fmt.Sprintf("wst: invalid handshake key %q", key))
+	}
+	return func(c *ConnectConfig) {
+		c.HandshakeKey = key
+	}
+}
+
+// WithSubprotocols offers the given websocket subprotocols, in order of
+// preference, for example to select a target on a server using subprotocol
+// routing. With WithStreamCompression or WithTextMode, each is first offered
+// combined with that mode, as "db.prod+wst-gzip", so that a routing server
+// can apply it.
+func WithSubprotocols(protocols ...string) ConnectOption {
+	return func(c *ConnectConfig) {
+		c.Subprotocols = protocols
+	}
+}
+
+func WithBufferSize(size int) ConnectOption {
+	return func(c *ConnectConfig) {
+		c.BufferSize = size
+	}
+}
+
 func Connect(ctx context.Context, opts ...ConnectOption) (net.Conn, error) {
 	cfg := ConnectConfig{}
 	for _, opt := range opts {
@@ -115,17 +252,41 @@ func Connect(ctx context.Context, opts ...ConnectOption) (net.Conn, error) {
 }
 
 func ConnectWithConfig(ctx context.Context, cfg ConnectConfig) (net.Conn, error) {
+	if cfg.ResumeGrace > 0 {
+		return connectResumable(ctx, cfg)
+	}
+	return connectWithRedirects(ctx, cfg)
+}
+
+func connectWithRedirects(ctx context.Context, cfg ConnectConfig) (net.Conn, error) {
+	ctx, cancel := withConnectTimeout(ctx, cfg.ConnectTimeout)
+	defer cancel()
+	for redirects := 0; ; redirects++ {
+		conn, err := connectOnce(ctx, cfg)
+		var redirect *RedirectError
+		if err == nil || !cfg.FollowRedirects || !errors.As(err, &redirect) {
+			return conn, err
+		}
+		if redirects >= maxRedirects {
+			return nil, fmt.Errorf("%w: stopped after %d redirects", ErrTooManyRedirects, maxRedirects)
+		}
+		if err := cfg.redirect(redirect.Location); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func connectOnce(ctx context.Context, cfg ConnectConfig) (net.Conn, error) {
 	dialCfg, err := generateDialConfig(cfg.Addr, cfg.ConnectDialConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	ws, err := connect(ctx, dialCfg)
+	c, err := connect(ctx, dialCfg)
 	if err != nil {
 		return nil, err
 	}
-	ws.PayloadType = websocket.BinaryFrame
-	return ws, nil
+	return c, nil
 }
 
 func generateDialConfig(addr string, cfg ConnectDialConfig) (*splitedConnectDialConfig, error) {
@@ -142,6 +303,15 @@ func generateDialConfig(addr string, cfg ConnectDialConfig) (*splitedConnectDial
 		splitPort:         port,
 		ConnectDialConfig: &cfg,
 	}
+	if cfg.ConnectIP != "" {
+		splitCfg.splitAddr = cfg.ConnectIP
+	}
+	if cfg.ConnectAddr != "" {
+		splitCfg.splitAddr = cfg.ConnectAddr
+		if host, port, err := net.SplitHostPort(cfg.ConnectAddr); err == nil {
+			splitCfg.splitAddr, splitCfg.splitPort = host, port
+		}
+	}
 
 	if cfg.Host == "" {
 		if cfg.ServerName != "" {
@@ -155,6 +325,11 @@ func generateDialConfig(addr string, cfg ConnectDialConfig) (*splitedConnectDial
 		cfg.ServerName = cfg.Host
 	}
 
+	if cfg.PathTemplate != "" {
+		if cfg.Path, err = expandPathTemplate(cfg.PathTemplate, cfg.PathVars); err != nil {
+			return nil, err
+		}
+	}
 	cfg.Path = ensureLeadingSlash(cfg.Path)
 
 	return &splitCfg, nil
@@ -185,36 +360,118 @@ func ensureLeadingSlash(path string) string {
 	return path
 }
 
-func connect(ctx context.Context, cfg *splitedConnectDialConfig) (*websocket.Conn, error) {
+func connect(ctx context.Context, cfg *splitedConnectDialConfig) (*Conn, error) {
 	wsConfig, err := createWebsocketConfig(cfg.ConnectDialConfig)
 	if err != nil {
 		return nil, err
 	}
 
 	var conn net.Conn
-	if cfg.TLS {
-		tlsConn, err := tls.DialWithDialer(cfg.Dialer, "tcp", fmt.Sprintf("%s:%s", cfg.splitAddr, cfg.splitPort), &tls.Config{
-			InsecureSkipVerify: cfg.Insecure,
-			ServerName:         cfg.ServerName,
+	if cfg.DialContext != nil {
+		conn, err = dialWithTimeout(ctx, cfg.DialContext, cfg.splitAddr, cfg.splitPort, cfg.DialTimeout)
+	} else {
+		conn, err = dialFromSourcePort(cfg.ConnectDialConfig, func(dialer *net.Dialer) (net.Conn, error) {
+			return dialWithTimeout(ctx, dialer.DialContext, cfg.splitAddr, cfg.splitPort, cfg.DialTimeout)
 		})
-		if err != nil {
+	}
+	if err != nil {
+		return nil, err
+	}
+	return handshakeOver(ctx, cfg, wsConfig, conn)
+}
+
+// handshakeOver runs the TLS handshake, when configured, and the websocket
+// handshake over conn, then sets up the negotiated stream. conn is closed on
+// failure.
+func handshakeOver(ctx context.Context, cfg *splitedConnectDialConfig, wsConfig *websocket.Config, conn net.Conn) (*Conn, error) {
+	if cfg.TLS {
+		tlsConn := tls.Client(conn, cfg.tlsConfig())
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
 			return nil, err
 		}
 		conn = tlsConn
-	} else {
-		dialConn, err := dialWithTimeout(ctx, cfg.Dialer, cfg.splitAddr, cfg.splitPort)
-		if err != nil {
+	}
+
+	c, err := newClient(ctx, wsConfig, conn, cfg.HandshakeKey)
+	if err != nil {
+		return nil, err
+	}
+	c.maxFrameSize = cfg.MaxFrameSize
+	if cfg.TextMode {
+		c.negotiateTextMode()
+	}
+	if len(cfg.ObfuscationKey) > 0 {
+		if err := c.negotiateObfuscation(cfg.ObfuscationKey); err != nil {
+			_ = c.raw.Close()
+			return nil, err
+		}
+	}
+	if cfg.Compression {
+		c.negotiateCompression(cfg.CompressionLevel)
+	}
+	// A resumed session already has its target.
+	if cfg.InbandTarget != "" && cfg.resumeToken == "" {
+		if err := c.requestInbandTarget(ctx, cfg.InbandTarget); err != nil {
+			_ = c.raw.Close()
 			return nil, err
 		}
-		conn = dialConn
 	}
+	c.PayloadType = websocket.BinaryFrame
+	return c, nil
+}
 
-	ws, err := websocket.NewClient(wsConfig, conn)
+// newClient runs the websocket handshake over conn, closing it on failure.
+func newClient(ctx context.Context, wsConfig *websocket.Config, conn net.Conn, key string) (*Conn, error) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	recorder := newHandshakeRecorder(conn, key)
+	ws, err := websocket.NewClient(wsConfig, recorder)
+	if !stop() {
+		err = errors.Join(err, ctx.Err())
+		_ = conn.SetDeadline(time.Time{})
+	}
 	if err != nil {
+		if resp := recorder.response(); resp != nil && isRedirect(resp.StatusCode) {
+			err = &RedirectError{
+				StatusCode: resp.StatusCode,
+				Location:   resp.Header.Get("Location"),
+			}
+		}
 		conn.Close()
 		return nil, err
 	}
-	return ws, nil
+	c := newConn(ws, conn)
+	c.respHeader = recorder.finish()
+	return c, nil
+}
+
+// ConnectOverConn runs the websocket handshake, preceded by a TLS handshake
+// when configured, over conn instead of dialing. The address options only
+// determine the Host, SNI and path. conn is closed if the handshake fails.
+func ConnectOverConn(ctx context.Context, conn net.Conn, opts ...ConnectOption) (net.Conn, error) {
+	cfg := ConnectConfig{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	ctx, cancel := withConnectTimeout(ctx, cfg.ConnectTimeout)
+	defer cancel()
+	dialCfg, err := generateDialConfig(cfg.Addr, cfg.ConnectDialConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	wsConfig, err := createWebsocketConfig(dialCfg.ConnectDialConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, err := handshakeOver(ctx, dialCfg, wsConfig, conn)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 func createWebsocketConfig(cfg *ConnectDialConfig) (*websocket.Config, error) {
@@ -231,6 +488,30 @@ func createWebsocketConfig(cfg *ConnectDialConfig) (*websocket.Config, error) {
 		return nil, fmt.Errorf("failed to create websocket config: %w", err)
 	}
 	setReqHeader(wsConfig)
+	for k, v := range cfg.Header {
+		wsConfig.Header[k] = v
+	}
+	setResumeHeaders(wsConfig.Header, cfg)
+	wsConfig.Header.Set(HalfCloseHeader, "1")
+	if len(cfg.ObfuscationKey) > 0 {
+		wsConfig.Header.Set(ObfuscationHeader, ObfuscationScheme)
+	}
+	var mode string
+	switch {
+	case cfg.TextMode:
+		mode = TextModeProtocol
+	case cfg.Compression:
+		mode = StreamCompressionProtocol
+	}
+	for _, p := range cfg.Subprotocols {
+		if mode != "" {
+			wsConfig.Protocol = append(wsConfig.Protocol, p+"+"+mode)
+		}
+		wsConfig.Protocol = append(wsConfig.Protocol, p)
+	}
+	if mode != "" {
+		wsConfig.Protocol = append(wsConfig.Protocol, mode)
+	}
 	wsConfig.Dialer = cfg.Dialer
 	return wsConfig, nil
 }
@@ -239,10 +520,13 @@ func setReqHeader(wsConfig *websocket.Config) {
 	wsConfig.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.198 Safari/537.36")
 }
 
-func dialWithTimeout(ctx context.Context, dialer *net.Dialer, addr, port string) (net.Conn, error) {
-	timeoutCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+func dialWithTimeout(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error), addr, port string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	return dialer.DialContext(timeoutCtx, "tcp", fmt.Sprintf("%s:%s", addr, port))
+	return dial(timeoutCtx, "tcp", net.JoinHostPort(addr, port))
 }
 
 type Dialer struct {
@@ -276,3 +560,19 @@ func (wc *Dialer) DialTCP(options ...ConnectOption) (net.Conn, error) {
 func (wc *Dialer) DialContextTCP(ctx context.Context, options ...ConnectOption) (net.Conn, error) {
 	return wc.DialContext(ctx, options...)
 }
+
+func (wc *Dialer) DialContextBuffered(ctx context.Context, options ...ConnectOption) (*BufferedConn, error) {
+	cfg := wc.config.Clone()
+	for _, option := range options {
+		option(cfg)
+	}
+	conn, err := ConnectWithConfig(ctx, *cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewBufferedConn(conn, cfg.BufferSize), nil
+}
+
+func (wc *Dialer) DialBuffered(options ...ConnectOption) (*BufferedConn, error) {
+	return wc.DialContextBuffered(context.Background(), options...)
+}
@@ -0,0 +1,44 @@
+package client
+
+import "testing"
+
+func dialConfigFor(t *testing.T, opts ...ConnectOption) *splitedConnectDialConfig {
+	t.Helper()
+	cfg := ConnectConfig{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	dialCfg, err := generateDialConfig(cfg.Addr, cfg.ConnectDialConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialCfg
+}
+
+func TestWithEndpoints(t *testing.T) {
+	cfg := dialConfigFor(t,
+		WithAddr("example.com:443"),
+		WithEndpoints("192.0.2.1:8443", "sni.example", "host.example"),
+	)
+	if cfg.splitAddr != "192.0.2.1" || cfg.splitPort != "8443" {
+		t.Fatalf("dials %s:%s", cfg.splitAddr, cfg.splitPort)
+	}
+	if cfg.ServerName != "sni.example" || cfg.Host != "host.example" {
+		t.Fatalf("server name %q, host %q", cfg.ServerName, cfg.Host)
+	}
+}
+
+func TestWithEndpointsEmptyKeepsEarlierOptions(t *testing.T) {
+	cfg := dialConfigFor(t,
+		WithAddr("example.com:443"),
+		WithHost("host.example"),
+		WithDialTLS("sni.example", false),
+		WithEndpoints("192.0.2.1", "", ""),
+	)
+	if cfg.splitAddr != "192.0.2.1" || cfg.splitPort != "443" {
+		t.Fatalf("dials %s:%s", cfg.splitAddr, cfg.splitPort)
+	}
+	if cfg.ServerName != "sni.example" || cfg.Host != "host.example" {
+		t.Fatalf("server name %q, host %q", cfg.ServerName, cfg.Host)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/zijiren233/gwst/client"
+)
+
+var (
+	target string
+	listen string
+)
+
+func init() {
+	flag.StringVar(&target, "target", "ws://127.0.0.1:8081/ws", "target url")
+	flag.StringVar(&listen, "listen", "", "forward connections accepted on this local address instead of stdio")
+}
+
+func main() {
+	flag.Parse()
+
+	u, err := url.Parse(target)
+	if err != nil {
+		panic(err)
+	}
+	dialer := client.NewDialer(
+		client.WithURL(u),
+	)
+	if listen != "" {
+		f := &client.LocalForwarder{
+			ListenAddr: listen,
+			Dialer:     dialer,
+		}
+		if err := f.Serve(); err != nil {
+			panic(err)
+		}
+		return
+	}
+	conn, err := dialer.Dial()
+	if err != nil {
+		panic(err)
+	}
+	if c, ok := conn.(*client.Conn); ok && c.ConnID() != "" {
+		fmt.Fprintln(os.Stderr, "conn id:", c.ConnID())
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(os.Stdout, conn)
+	}()
+	_, _ = io.Copy(conn, os.Stdin)
+	if c, ok := conn.(interface{ CloseWrite() error }); ok && c.CloseWrite() == nil {
+		<-done
+	}
+	_ = conn.Close()
+}
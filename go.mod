@@ -2,4 +2,8 @@ module github.com/zijiren233/gwst
 
 go 1.22.0
 
-require golang.org/x/net v0.31.0
+require (
+	golang.org/x/crypto v0.29.0
+	golang.org/x/net v0.31.0
+	golang.org/x/sys v0.27.0
+)
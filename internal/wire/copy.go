@@ -0,0 +1,114 @@
+// Package wire holds the parts of the tunnel protocol that the server and
+// the client share: copying with write timeouts, pings, stream obfuscation
+// and the in-band target status.
+package wire
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+type DeadlineWriter interface {
+	io.Writer
+	SetWriteDeadline(time.Time) error
+}
+
+// CopyBufferWithWriteTimeout copies src to dst, failing a write that stalls
+// for longer than timeout. To avoid resetting the deadline for every chunk,
+// it is only pushed forward once a quarter of timeout has passed since it
+// was last set, so a write may fail after as little as three quarters of
+// timeout.
+func CopyBufferWithWriteTimeout(dst DeadlineWriter, src io.Reader, buf []byte, timeout time.Duration) (written int64, err error) {
+	var armed time.Time
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			if timeout > 0 {
+				if now := time.Now(); now.Sub(armed) > timeout/4 {
+					err = dst.SetWriteDeadline(now.Add(timeout))
+					if err != nil {
+						break
+					}
+					armed = now
+				}
+			}
+			nw, ew := dst.Write(buf[0:nr])
+			if nw < 0 || nr < nw {
+				nw = 0
+				if ew == nil {
+					ew = errors.New("invalid write result")
+				}
+			}
+			written += int64(nw)
+			if ew != nil {
+				err = ew
+				break
+			}
+			if nr != nw {
+				err = io.ErrShortWrite
+				break
+			}
+		}
+		if er != nil {
+			if er != io.EOF {
+				err = er
+			}
+			break
+		}
+	}
+	return written, err
+}
+
+// CopyWithContext is CopyBufferWithWriteTimeout that stops when ctx is done,
+// returning ctx.Err(). Cancellation also sets an expired deadline on dst and,
+// if it supports one, on src, so a blocked Write or Read returns promptly;
+// those deadlines are left in place.
+func CopyWithContext(ctx context.Context, dst DeadlineWriter, src io.Reader, buf []byte, timeout time.Duration) (int64, error) {
+	cw := &ctxWriter{DeadlineWriter: dst, ctx: ctx}
+	stop := context.AfterFunc(ctx, func() {
+		cw.mu.Lock()
+		defer cw.mu.Unlock()
+		_ = dst.SetWriteDeadline(time.Unix(1, 0))
+		if rd, ok := src.(interface{ SetReadDeadline(time.Time) error }); ok {
+			_ = rd.SetReadDeadline(time.Unix(1, 0))
+		}
+	})
+	defer stop()
+	n, err := CopyBufferWithWriteTimeout(cw, &ctxReader{Reader: src, ctx: ctx}, buf, timeout)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return n, ctxErr
+	}
+	return n, err
+}
+
+type ctxReader struct {
+	io.Reader
+	ctx context.Context
+}
+
+func (r *ctxReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(b)
+}
+
+// ctxWriter refuses to extend the write deadline once ctx is done, so the
+// per-write timeout cannot undo the expired deadline set on cancellation.
+type ctxWriter struct {
+	DeadlineWriter
+	ctx context.Context
+	mu  sync.Mutex
+}
+
+func (w *ctxWriter) SetWriteDeadline(t time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	return w.DeadlineWriter.SetWriteDeadline(t)
+}
@@ -0,0 +1,205 @@
+package wire
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type deadlineRecorder struct {
+	bytes.Buffer
+	deadlines int
+}
+
+func (w *deadlineRecorder) SetWriteDeadline(time.Time) error {
+	w.deadlines++
+	return nil
+}
+
+func TestCopyBufferWithWriteTimeoutArmsLazily(t *testing.T) {
+	var dst deadlineRecorder
+	src := strings.NewReader(strings.Repeat("x", 64*1024))
+	n, err := CopyBufferWithWriteTimeout(&dst, src, make([]byte, 1024), time.Hour)
+	if err != nil || n != 64*1024 {
+		t.Fatalf("copied %d, %v; want %d, nil", n, err, 64*1024)
+	}
+	if dst.deadlines != 1 {
+		t.Fatalf("set the deadline %d times, want 1", dst.deadlines)
+	}
+}
+
+func TestCopyBufferWithWriteTimeoutStalledWrite(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	_, err := CopyBufferWithWriteTimeout(a, strings.NewReader("never read"), make([]byte, 16), 50*time.Millisecond)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+}
+
+func TestCopyBufferWithWriteTimeoutStallAfterProgress(t *testing.T) {
+	// The peer reads 64 chunks, then stops: the write that stalls fails
+	// within timeout of the stall even though the deadline was armed lazily.
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	stalled := make(chan time.Time, 1)
+	go func() {
+		buf := make([]byte, 16)
+		for i := 0; i < 64; i++ {
+			if _, err := io.ReadFull(b, buf); err != nil {
+				return
+			}
+		}
+		stalled <- time.Now()
+	}()
+	const timeout = 200 * time.Millisecond
+	src := strings.NewReader(strings.Repeat("x", 1024*16))
+	n, err := CopyBufferWithWriteTimeout(a, src, make([]byte, 16), timeout)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if n != 64*16 {
+		t.Fatalf("copied %d bytes, want %d", n, 64*16)
+	}
+	if elapsed := time.Since(<-stalled); elapsed > timeout+100*time.Millisecond {
+		t.Fatalf("stalled write failed after %v, timeout %v", elapsed, timeout)
+	}
+}
+
+func TestCopyBufferWithWriteTimeoutSlowReader(t *testing.T) {
+	// Each write completes well within timeout, but the copy as a whole
+	// takes several timeouts: the deadline must keep moving forward.
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			time.Sleep(20 * time.Millisecond)
+			if _, err := b.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	src := strings.NewReader(strings.Repeat("x", 16*15))
+	if _, err := CopyBufferWithWriteTimeout(a, src, make([]byte, 16), 60*time.Millisecond); err != nil {
+		t.Fatalf("slow but steady reader: %v", err)
+	}
+}
+
+func TestCopyWithContextCancel(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	src, srcPeer := net.Pipe()
+	defer src.Close()
+	defer srcPeer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := CopyWithContext(ctx, a, src, make([]byte, 16), time.Hour)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("copy blocked in Read did not return on cancel")
+	}
+}
+
+func TestCopyWithContextEOF(t *testing.T) {
+	var dst deadlineRecorder
+	n, err := CopyWithContext(context.Background(), &dst, strings.NewReader("hello"), make([]byte, 16), 0)
+	if err != nil || n != 5 || dst.String() != "hello" {
+		t.Fatalf("copied %d %q, %v", n, dst.String(), err)
+	}
+	if dst.deadlines != 0 {
+		t.Fatalf("set %d deadlines without a timeout", dst.deadlines)
+	}
+}
+
+// deadlineCounter counts SetWriteDeadline calls on a conn; with everyWrite
+// set it arms the deadline before each write, as the copy loop used to.
+type deadlineCounter struct {
+	net.Conn
+	deadlines  int
+	everyWrite time.Duration
+}
+
+func (c *deadlineCounter) SetWriteDeadline(t time.Time) error {
+	c.deadlines++
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *deadlineCounter) Write(b []byte) (int, error) {
+	if c.everyWrite > 0 {
+		if err := c.SetWriteDeadline(time.Now().Add(c.everyWrite)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// benchmarkCopyDeadlines copies 16 KiB chunks to a loopback TCP conn and
+// reports the SetWriteDeadline calls per chunk.
+func benchmarkCopyDeadlines(b *testing.B, everyWrite bool) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	const chunk, timeout = 16 << 10, time.Minute
+	dst := &deadlineCounter{Conn: conn}
+	lazy := timeout
+	if everyWrite {
+		dst.everyWrite, lazy = timeout, 0
+	}
+	src := io.LimitReader(zeroReader{}, int64(b.N)*chunk)
+	b.SetBytes(chunk)
+	b.ResetTimer()
+	if _, err := CopyBufferWithWriteTimeout(dst, src, make([]byte, chunk), lazy); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(dst.deadlines)/float64(b.N), "deadlines/op")
+}
+
+func BenchmarkCopyBufferWithWriteTimeout(b *testing.B) {
+	b.Run("lazy", func(b *testing.B) { benchmarkCopyDeadlines(b, false) })
+	b.Run("every-write", func(b *testing.B) { benchmarkCopyDeadlines(b, true) })
+}
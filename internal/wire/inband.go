@@ -0,0 +1,46 @@
+package wire
+
+import "strconv"
+
+// With an in-band target the client names its target in the tunnel rather
+// than in the handshake. Its first message is a big-endian uint16 length
+// followed by that many bytes of UTF-8 "network:address", for example
+// "tcp:db.internal:5432". The server answers with a one-byte InbandStatus
+// message and, if it is InbandOK, relays to the target.
+
+type InbandStatus byte
+
+const (
+	InbandOK InbandStatus = iota
+	// InbandMalformed means the preamble was not a valid target.
+	InbandMalformed
+	// InbandUnsupportedNetwork means the network was not tcp, tcp4 or tcp6.
+	InbandUnsupportedNetwork
+	// InbandNotAllowed means the server's policy rejected the target.
+	InbandNotAllowed
+	InbandDialFailed
+	// InbandTimeout means the preamble did not arrive in time.
+	InbandTimeout
+)
+
+func (s InbandStatus) String() string {
+	switch s {
+	case InbandOK:
+		return "ok"
+	case InbandMalformed:
+		return "malformed"
+	case InbandUnsupportedNetwork:
+		return "unsupported network"
+	case InbandNotAllowed:
+		return "not allowed"
+	case InbandDialFailed:
+		return "dial failed"
+	case InbandTimeout:
+		return "timeout"
+	default:
+		return "status " + strconv.Itoa(int(s))
+	}
+}
+
+// MaxInbandTarget bounds the "network:address" of a preamble.
+const MaxInbandTarget = 1024
@@ -0,0 +1,16 @@
+package wire
+
+import "testing"
+
+func TestInbandStatusString(t *testing.T) {
+	for s, want := range map[InbandStatus]string{
+		InbandOK:         "ok",
+		InbandDialFailed: "dial failed",
+		InbandTimeout:    "timeout",
+		42:               "status 42",
+	} {
+		if got := s.String(); got != want {
+			t.Errorf("%d: got %q, want %q", byte(s), got, want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestObfuscationRoundTrip(t *testing.T) {
+	block := NewObfuscationCipher([]byte("psk"))
+	var stream bytes.Buffer
+	w := NewObfuscatingWriter(&stream, block)
+	msg := []byte("the quick brown fox")
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.Contains(stream.Bytes(), msg) {
+		t.Fatal("plaintext visible in the obfuscated stream")
+	}
+	if got := stream.Len(); got != block.BlockSize()+3*len(msg) {
+		t.Fatalf("stream is %d bytes, want the iv and the payload", got)
+	}
+
+	got, err := io.ReadAll(NewObfuscatingReader(&stream, NewObfuscationCipher([]byte("psk"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Repeat(msg, 3); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestObfuscationWrongKey(t *testing.T) {
+	var stream bytes.Buffer
+	_, _ = NewObfuscatingWriter(&stream, NewObfuscationCipher([]byte("a"))).Write([]byte("secret"))
+	got, _ := io.ReadAll(NewObfuscatingReader(&stream, NewObfuscationCipher([]byte("b"))))
+	if string(got) == "secret" {
+		t.Fatal("decoded with the wrong key")
+	}
+}
+
+func TestObfuscationTruncatedIV(t *testing.T) {
+	r := NewObfuscatingReader(bytes.NewReader([]byte{1, 2, 3}), NewObfuscationCipher([]byte("psk")))
+	if _, err := r.Read(make([]byte, 8)); !errors.Is(err, ErrObfuscationIV) {
+		t.Fatalf("got %v, want ErrObfuscationIV", err)
+	}
+}
+
+func TestObfuscatingWriterDeadline(t *testing.T) {
+	var dst deadlineRecorder
+	var w DeadlineWriter = NewObfuscatingWriter(&dst, NewObfuscationCipher([]byte("psk")))
+	if err := w.SetWriteDeadline(time.Time{}); err != nil || dst.deadlines != 1 {
+		t.Fatalf("deadline not forwarded: %v, %d", err, dst.deadlines)
+	}
+}
@@ -0,0 +1,84 @@
+package wire
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// PingPayloadSize is the size of the payload of a Pinger ping: a sequence
+// number and the send time.
+const PingPayloadSize = 16
+
+// PingCodec sends its []byte value as a ping frame.
+var PingCodec = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		payload, _ := v.([]byte)
+		return payload, websocket.PingFrame, nil
+	},
+}
+
+// Pinger measures round trips with pings that its Pong method matches to the
+// pongs read from the peer. It is safe for concurrent use.
+type Pinger struct {
+	waiters map[uint64]chan struct{}
+	seq     atomic.Uint64
+	mu      sync.Mutex
+}
+
+func (p *Pinger) register(id uint64) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.waiters == nil {
+		p.waiters = make(map[uint64]chan struct{})
+	}
+	ch := make(chan struct{})
+	p.waiters[id] = ch
+	return ch
+}
+
+func (p *Pinger) unregister(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.waiters, id)
+}
+
+// Ping sends a ping on ws and waits for its pong, returning the round trip.
+func (p *Pinger) Ping(ctx context.Context, ws *websocket.Conn) (time.Duration, error) {
+	id := p.seq.Add(1)
+	ch := p.register(id)
+	defer p.unregister(id)
+
+	start := time.Now()
+	payload := make([]byte, PingPayloadSize)
+	binary.BigEndian.PutUint64(payload, id)
+	binary.BigEndian.PutUint64(payload[8:], uint64(start.UnixNano()))
+	if err := PingCodec.Send(ws, payload); err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Pong completes the Ping whose payload a pong carries.
+func (p *Pinger) Pong(payload []byte) {
+	if len(payload) != PingPayloadSize {
+		return
+	}
+	id := binary.BigEndian.Uint64(payload)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ch, ok := p.waiters[id]; ok {
+		close(ch)
+		delete(p.waiters, id)
+	}
+}
@@ -0,0 +1,96 @@
+package wire
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialDiscard connects to a websocket server that discards what it reads,
+// answering pings with pongs.
+func dialDiscard(t *testing.T) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		_, _ = io.Copy(io.Discard, ws)
+	}})
+	t.Cleanup(srv.Close)
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ws.Close() })
+	return ws
+}
+
+func TestPinger(t *testing.T) {
+	ws := dialDiscard(t)
+	var p Pinger
+	go func() {
+		for {
+			frame, err := ws.NewFrameReader()
+			if err != nil {
+				return
+			}
+			if frame.PayloadType() == websocket.PongFrame {
+				payload, _ := io.ReadAll(frame)
+				p.Pong(payload)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		rtt, err := p.Ping(ctx, ws)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtt <= 0 {
+			t.Fatalf("rtt %v", rtt)
+		}
+	}
+}
+
+func TestPingerContext(t *testing.T) {
+	// Nothing reads the pong, so only ctx can end the ping.
+	ws := dialDiscard(t)
+	var p Pinger
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.Ping(ctx, ws); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if len(p.waiters) != 0 {
+		t.Fatalf("%d waiters left registered", len(p.waiters))
+	}
+}
+
+func TestPingerIgnoresUnknownPongs(t *testing.T) {
+	var p Pinger
+	ch := p.register(1)
+	p.Pong([]byte("short"))
+	other := make([]byte, PingPayloadSize)
+	binary.BigEndian.PutUint64(other, 2)
+	p.Pong(other)
+	select {
+	case <-ch:
+		t.Fatal("unrelated pong completed the ping")
+	default:
+	}
+	mine := make([]byte, PingPayloadSize)
+	binary.BigEndian.PutUint64(mine, 1)
+	p.Pong(mine)
+	p.Pong(mine)
+	select {
+	case <-ch:
+	default:
+		t.Fatal("matching pong did not complete the ping")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "net/http"
+
+// WithHandlerAcceptRateLimit bounds the rate of new handshakes to perSec with
+// bursts of up to burst, rejecting the excess with 429 before any other
+// limit is consulted. The limit is global unless
+// WithHandlerAcceptRateLimitPerIP is also given.
+func WithHandlerAcceptRateLimit(perSec, burst int) HandlerOption {
+	return func(h *Handler) {
+		h.acceptRate = perSec
+		h.acceptBurst = burst
+	}
+}
+
+// WithHandlerAcceptRateLimitPerIP applies the accept rate limit to each
+// client IP, or IPv6 /64, separately.
+func WithHandlerAcceptRateLimitPerIP() HandlerOption {
+	return func(h *Handler) {
+		h.acceptPerIP = true
+	}
+}
+
+func (h *Handler) initAcceptLimit() {
+	if h.acceptRate <= 0 {
+		return
+	}
+	if !h.acceptPerIP {
+		h.acceptLimit = newTokenBucket(h.acceptRate, h.acceptBurst)
+		return
+	}
+	h.acceptPerIPLimit = newPerIPLimiter(0, 0)
+	h.acceptPerIPLimit.newBucket = func() *tokenBucket {
+		return newTokenBucket(h.acceptRate, h.acceptBurst)
+	}
+}
+
+func (h *Handler) allowAccept(req *http.Request) bool {
+	switch {
+	case h.acceptLimit != nil:
+		return h.acceptLimit.allow()
+	case h.acceptPerIPLimit != nil:
+		release, ok := h.acceptPerIPLimit.acquire(h.clientIP(req))
+		if ok {
+			release()
+		}
+		return ok
+	default:
+		return true
+	}
+}
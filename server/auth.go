@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// authenticator checks a handshake request, returning it, possibly with
+// identity attached to its context, when the credentials are valid.
+type authenticator struct {
+	check     func(*http.Request) (*http.Request, error)
+	challenge string
+	// describe adds the failure to the challenge as an RFC 6750 error.
+	describe bool
+}
+
+// WithAuthToken requires a bearer token matching one of tokens, so that keys
+// can be rotated by listing the old and new token together. The token is
+// read from the Authorization header, or from the query parameter set by
+// WithAuthQueryParam.
+func WithAuthToken(tokens ...string) HandlerOption {
+	return func(h *Handler) {
+		h.auth = append(h.auth, authenticator{
+			check: func(req *http.Request) (*http.Request, error) {
+				return req, checkToken(h.bearerToken(req), tokens)
+			},
+			challenge: `Bearer realm="wst"`,
+		})
+	}
+}
+
+// WithAuthQueryParam also accepts the bearer token from the named query
+// parameter, for clients that cannot set headers.
+func WithAuthQueryParam(name string) HandlerOption {
+	return func(h *Handler) {
+		h.authQueryParam = name
+	}
+}
+
+// WithAuthFunc authenticates handshakes with fn; a non-nil error rejects the
+// request with 401 before the upgrade and the target is never dialed.
+func WithAuthFunc(fn func(*http.Request) error) HandlerOption {
+	return func(h *Handler) {
+		h.auth = append(h.auth, authenticator{
+			check: func(req *http.Request) (*http.Request, error) {
+				return req, fn(req)
+			},
+		})
+	}
+}
+
+func (h *Handler) bearerToken(req *http.Request) string {
+	if scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	if h.authQueryParam != "" {
+		return req.URL.Query().Get(h.authQueryParam)
+	}
+	return ""
+}
+
+func checkToken(token string, tokens []string) error {
+	if token == "" {
+		return ErrMissingCredentials
+	}
+	match := 0
+	for _, t := range tokens {
+		match |= subtle.ConstantTimeCompare([]byte(token), []byte(t))
+	}
+	if match != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// authenticate runs every configured authenticator; all of them must pass.
+func (h *Handler) authenticate(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	for i, a := range h.auth {
+		next, err := a.check(req)
+		if err == nil {
+			req = next
+			continue
+		}
+		h.logRejected(req, http.StatusUnauthorized, err.Error())
+		h.metrics.Handshake(HandshakeRejectedAuth)
+		if h.fallbackOnAuth && h.fallback != nil {
+			h.fallback.ServeHTTP(w, req)
+			return req, false
+		}
+		for j, other := range h.auth {
+			challenge := other.challenge
+			if challenge == "" {
+				continue
+			}
+			if other.describe && j == i {
+				challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, err.Error())
+			}
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return req, false
+	}
+	return req, true
+}
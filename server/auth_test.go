@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuthToken(t *testing.T) {
+	target, dials := countingTarget(t)
+	// During a rotation both the old and the new token are listed.
+	url := startHandler(t, NewHandler(target, WithAuthToken("old-token", "new-token")))
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"missing", nil, http.StatusUnauthorized},
+		{"wrong", http.Header{"Authorization": {"Bearer wrong"}}, http.StatusUnauthorized},
+		{"not bearer", http.Header{"Authorization": {"Basic old-token"}}, http.StatusUnauthorized},
+		{"rotated old", http.Header{"Authorization": {"Bearer old-token"}}, http.StatusSwitchingProtocols},
+		{"rotated new", http.Header{"Authorization": {"bearer new-token"}}, http.StatusSwitchingProtocols},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := dials.Load()
+			resp := upgradeResponse(t, url, tc.header)
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tc.want)
+			}
+			if tc.want != http.StatusUnauthorized {
+				return
+			}
+			if got := resp.Header.Get("WWW-Authenticate"); !strings.HasPrefix(got, "Bearer") {
+				t.Fatalf("WWW-Authenticate %q, want a Bearer challenge", got)
+			}
+			if dials.Load() != before {
+				t.Fatal("target dialed for a rejected handshake")
+			}
+		})
+	}
+}
+
+func TestAuthTokenQueryParam(t *testing.T) {
+	url := startHandler(t, NewHandler(echoTarget(t), WithAuthToken("secret"), WithAuthQueryParam("token")))
+	if resp := upgradeResponse(t, url+"?token=secret", nil); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d with the query token, want 101", resp.StatusCode)
+	}
+	if resp := upgradeResponse(t, url+"?token=wrong", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status %d with a wrong query token, want 401", resp.StatusCode)
+	}
+}
+
+func TestAuthFunc(t *testing.T) {
+	target, dials := countingTarget(t)
+	h := NewHandler(target, WithAuthFunc(func(req *http.Request) error {
+		if req.Header.Get("X-Team") != "infra" {
+			return errors.New("not on the team")
+		}
+		return nil
+	}))
+	url := startHandler(t, h)
+	if resp := upgradeResponse(t, url, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status %d, want 401", resp.StatusCode)
+	}
+	if dials.Load() != 0 {
+		t.Fatal("target dialed for a rejected handshake")
+	}
+	ws := dialWS(t, url, http.Header{"X-Team": {"infra"}})
+	sendBinary(t, ws, []byte("ok"))
+	if f := readFrame(t, ws); string(f.payload) != "ok" {
+		t.Fatalf("echo = %q", f.payload)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type userContextKey struct{}
+
+// dummyHash is compared against for unknown users so that a missing user
+// costs as much as a wrong password.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("wst"), bcrypt.DefaultCost)
+	return hash
+})
+
+// WithBasicAuth requires HTTP Basic credentials matching users, which maps
+// usernames to bcrypt password hashes. The authenticated username is
+// available from UserFromContext on the request context and in Session.User.
+func WithBasicAuth(users map[string]string) HandlerOption {
+	return func(h *Handler) {
+		h.auth = append(h.auth, authenticator{
+			check: func(req *http.Request) (*http.Request, error) {
+				if err := checkBasicAuth(req, users); err != nil {
+					return req, err
+				}
+				return withUser(req), nil
+			},
+			challenge: `Basic realm="wst", charset="UTF-8"`,
+		})
+	}
+}
+
+func UserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userContextKey{}).(string)
+	return user
+}
+
+func checkBasicAuth(req *http.Request, users map[string]string) error {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return ErrMissingCredentials
+	}
+	hash, known := users[user]
+	if !known {
+		hash = string(dummyHash())
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil || !known {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func withUser(req *http.Request) *http.Request {
+	user, _, _ := req.BasicAuth()
+	return req.WithContext(context.WithValue(req.Context(), userContextKey{}, user))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func basicAuthHeader(user, password string) http.Header {
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth(user, password)
+	return req.Header
+}
+
+// syncBuffer is a bytes.Buffer safe for the handler's concurrent logging.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestBasicAuth(t *testing.T) {
+	target, dials := countingTarget(t)
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	h := NewHandler(target, WithBasicAuth(basicAuthUsers(t, "alice")), WithLogger(logger))
+	url := startHandler(t, h)
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"success", basicAuthHeader("alice", "secret"), http.StatusSwitchingProtocols},
+		{"bad password", basicAuthHeader("alice", "hunter2"), http.StatusUnauthorized},
+		{"unknown user", basicAuthHeader("mallory", "secret"), http.StatusUnauthorized},
+		{"missing", nil, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := upgradeResponse(t, url, tc.header)
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tc.want)
+			}
+			if tc.want == http.StatusUnauthorized {
+				if got := resp.Header.Get("WWW-Authenticate"); !strings.Contains(got, `realm="wst"`) {
+					t.Fatalf("WWW-Authenticate %q, want the realm", got)
+				}
+			}
+		})
+	}
+	if n := dials.Load(); n > 1 {
+		t.Fatalf("target dialed %d times, want only for the accepted handshake", n)
+	}
+	if out := logs.String(); strings.Contains(out, "hunter2") || strings.Contains(out, "secret") {
+		t.Fatalf("credentials logged:\n%s", out)
+	}
+}
+
+func TestBasicAuthUserRouting(t *testing.T) {
+	target := echoTarget(t)
+	users := make(chan string, 1)
+	log := newCallbackLog()
+	h := NewHandler("",
+		WithBasicAuth(basicAuthUsers(t, "alice")),
+		WithGetTarget(func(req *http.Request) (string, []string, error) {
+			users <- UserFromContext(req.Context())
+			return target, nil, nil
+		}),
+		log.option(),
+	)
+	ws := dialWS(t, startHandler(t, h), basicAuthHeader("alice", "secret"))
+	if user := <-users; user != "alice" {
+		t.Fatalf("GetTarget saw user %q, want alice", user)
+	}
+	ws.Close()
+	connects, _ := log.wait(t)
+	if len(connects) != 1 || connects[0].User != "alice" {
+		t.Fatalf("onConnect saw %+v, want user alice", connects)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// SmallBufferSize is the copy buffer a direction starts with when the
+	// configured buffer size is larger, unless WithHandlerStartBufferSize
+	// sets another.
+	SmallBufferSize = 4 * 1024
+
+	// growAfterFullReads is how many consecutive reads must fill the small
+	// buffer before a direction switches to the configured size.
+	growAfterFullReads = 4
+)
+
+var errGrowBuffer = errors.New("grow copy buffer")
+
+// bufferPools holds one pool per buffer size, shared by all handlers.
+var bufferPools sync.Map // int -> *bufferPool
+
+// BufferPoolStats describes a copy buffer pool. Pools are shared by all
+// handlers in the process that use the same buffer size.
+type BufferPoolStats struct {
+	Size   int
+	Gets   int64
+	Puts   int64
+	Misses int64
+	// BytesHeld is the size of the buffers returned to the pool and not
+	// taken out again. The garbage collector may free some of them, so this
+	// is an upper bound.
+	BytesHeld int64
+}
+
+type bufferPool struct {
+	size   int
+	pool   sync.Pool
+	gets   atomic.Int64
+	puts   atomic.Int64
+	misses atomic.Int64
+	held   atomic.Int64
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	if p, ok := bufferPools.Load(size); ok {
+		return p.(*bufferPool)
+	}
+	actual, _ := bufferPools.LoadOrStore(size, &bufferPool{size: size})
+	return actual.(*bufferPool)
+}
+
+func (p *bufferPool) stats() BufferPoolStats {
+	return BufferPoolStats{
+		Size:      p.size,
+		Gets:      p.gets.Load(),
+		Puts:      p.puts.Load(),
+		Misses:    p.misses.Load(),
+		BytesHeld: max(p.held.Load(), 0),
+	}
+}
+
+func getBuffer(pool *bufferPool) *[]byte {
+	pool.gets.Add(1)
+	if buffer, ok := pool.pool.Get().(*[]byte); ok {
+		pool.held.Add(-int64(cap(*buffer)))
+		return buffer
+	}
+	pool.misses.Add(1)
+	buffer := make([]byte, pool.size)
+	return &buffer
+}
+
+func putBuffer(pool *bufferPool, buffer *[]byte) {
+	if buffer != nil {
+		*buffer = (*buffer)[:cap(*buffer)]
+		pool.puts.Add(1)
+		pool.held.Add(int64(cap(*buffer)))
+		pool.pool.Put(buffer)
+	}
+}
+
+// growReader reports errGrowBuffer, along with the data read, once
+// growAfterFullReads consecutive reads have filled the buffer.
+type growReader struct {
+	io.Reader
+	full int
+}
+
+func (r *growReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n == len(b) {
+		r.full++
+	} else {
+		r.full = 0
+	}
+	if err == nil && r.full >= growAfterFullReads {
+		return n, errGrowBuffer
+	}
+	return n, err
+}
+
+// copyAdaptive is CopyBufferWithWriteTimeout with a buffer from pool, except
+// that it starts with a buffer from the smaller start pool and only switches
+// to pool once the source sustains reads that fill it. Mostly idle sessions
+// then hold a small buffer while bulk transfers still use the configured size.
+func copyAdaptive(dst deadlineWriter, src io.Reader, start, pool *bufferPool, timeout time.Duration) (int64, error) {
+	var written int64
+	if start.size < pool.size {
+		buffer := getBuffer(start)
+		n, err := CopyBufferWithWriteTimeout(dst, &growReader{Reader: src}, *buffer, timeout)
+		putBuffer(start, buffer)
+		if err != errGrowBuffer {
+			return n, err
+		}
+		written = n
+	}
+	buffer := getBuffer(pool)
+	defer putBuffer(pool, buffer)
+	n, err := CopyBufferWithWriteTimeout(dst, src, *buffer, timeout)
+	return written + n, err
+}
+
+// copyPools are the buffer pools a session copies with, fixed when it starts.
+type copyPools struct {
+	all   *bufferPool
+	up    *bufferPool
+	down  *bufferPool
+	start *bufferPool
+}
+
+func (h *Handler) newCopyPools(size int) *copyPools {
+	all := newBufferPool(size)
+	direction := func(size int) *bufferPool {
+		if size == 0 || size == all.size {
+			return all
+		}
+		return newBufferPool(size)
+	}
+	start := h.startBufferSize
+	if start == 0 {
+		start = SmallBufferSize
+	}
+	return &copyPools{
+		all:   all,
+		up:    direction(h.upBufferSize),
+		down:  direction(h.downBufferSize),
+		start: newBufferPool(start),
+	}
+}
+
+// SetBufferSize changes the copy buffer size of sessions started from now on;
+// running sessions keep their buffers. Sizes set with WithHandlerUpBufferSize
+// or WithHandlerDownBufferSize still take precedence for their direction.
+func (h *Handler) SetBufferSize(size int) {
+	if size <= 0 {
+		panic("wst: buffer size must be positive")
+	}
+	h.pools.Store(h.newCopyPools(size))
+}
+
+// bufferPoolStats returns the stats of the pools the handler copies with.
+func (h *Handler) bufferPoolStats() []BufferPoolStats {
+	cp := h.pools.Load()
+	pools := []*bufferPool{cp.all, cp.up, cp.down}
+	if cp.start.size < cp.up.size || cp.start.size < cp.down.size {
+		pools = append(pools, cp.start)
+	}
+	var stats []BufferPoolStats
+	seen := make(map[*bufferPool]bool)
+	for _, p := range pools {
+		if !seen[p] {
+			seen[p] = true
+			stats = append(stats, p.stats())
+		}
+	}
+	return stats
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// writeSizes records the size of each write.
+type writeSizes struct {
+	sizes []int
+}
+
+func (w *writeSizes) Write(b []byte) (int, error) {
+	w.sizes = append(w.sizes, len(b))
+	return len(b), nil
+}
+
+func (w *writeSizes) SetWriteDeadline(time.Time) error { return nil }
+
+func TestCopyAdaptiveGrows(t *testing.T) {
+	data := make([]byte, 1<<20)
+	w := &writeSizes{}
+	h := NewHandler("", WithHandlerBufferSize(64<<10))
+	cp := h.pools.Load()
+	n, err := copyAdaptive(w, bytes.NewReader(data), cp.start, cp.down, 0)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("copied %d, %v", n, err)
+	}
+	for i, size := range w.sizes[:growAfterFullReads] {
+		if size != SmallBufferSize {
+			t.Fatalf("write %d is %d bytes, want %d", i, size, SmallBufferSize)
+		}
+	}
+	if size := w.sizes[growAfterFullReads]; size != 64<<10 {
+		t.Fatalf("write after growing is %d bytes, want %d", size, 64<<10)
+	}
+}
+
+func TestCopyAdaptiveStartBufferSize(t *testing.T) {
+	data := make([]byte, 1<<20)
+	w := &writeSizes{}
+	h := NewHandler("", WithHandlerBufferSize(64<<10), WithHandlerStartBufferSize(64<<10))
+	cp := h.pools.Load()
+	if _, err := copyAdaptive(w, bytes.NewReader(data), cp.start, cp.down, 0); err != nil {
+		t.Fatal(err)
+	}
+	if w.sizes[0] != 64<<10 {
+		t.Fatalf("first write is %d bytes, want the full buffer", w.sizes[0])
+	}
+	for _, s := range h.bufferPoolStats() {
+		if s.Size == SmallBufferSize {
+			t.Fatal("stats list the unused small pool")
+		}
+	}
+}
+
+func TestCopyAdaptiveIdleKeepsSmallBuffer(t *testing.T) {
+	// Short reads, as from an interactive session, never take a buffer of
+	// the configured size. The size is unusual so no other test shares the
+	// pool.
+	r, w := io.Pipe()
+	go func() {
+		for i := 0; i < 3*growAfterFullReads; i++ {
+			_, _ = w.Write([]byte("keystroke"))
+		}
+		w.Close()
+	}()
+	dst := &writeSizes{}
+	h := NewHandler("", WithHandlerBufferSize(48<<10+1))
+	cp := h.pools.Load()
+	if _, err := copyAdaptive(dst, r, cp.start, cp.down, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(dst.sizes) != 3*growAfterFullReads {
+		t.Fatalf("%d writes, want %d", len(dst.sizes), 3*growAfterFullReads)
+	}
+	if gets := cp.down.stats().Gets; gets != 0 {
+		t.Fatalf("%d full-size buffers taken", gets)
+	}
+}
+
+// BenchmarkCopyAdaptive copies a bulk transfer with the adaptive start and
+// with the full buffer from the start.
+func BenchmarkCopyAdaptive(b *testing.B) {
+	data := make([]byte, 4<<20)
+	for _, bc := range []struct {
+		name  string
+		start int
+	}{
+		{"adaptive", SmallBufferSize},
+		{"full", DefaultBufferSize},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			h := NewHandler("", WithHandlerStartBufferSize(bc.start))
+			cp := h.pools.Load()
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := copyAdaptive(discardDeadline{}, bytes.NewReader(data), cp.start, cp.down, time.Second); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type discardDeadline struct{}
+
+func (discardDeadline) Write(b []byte) (int, error)      { return len(b), nil }
+func (discardDeadline) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+type Session struct {
+	Start     time.Time
+	ID        string
+	RequestID string
+	// ClientAddr is the client's IP address, taken from the forwarding
+	// headers of proxies trusted with WithTrustedProxies.
+	ClientAddr string
+	Path       string
+	Target     string
+	User       string
+	// TargetAddr is the resolved address of the target connection, and
+	// TCPNoDelay and TCPKeepAlive the options applied to it. They are zero
+	// until it has been dialed, which precedes onConnect only with
+	// WithPreflightDial.
+	TargetAddr   string
+	TCPKeepAlive time.Duration
+	TCPNoDelay   bool
+	// Labels are the session's WithSessionLabeler labels, and MetricLabels
+	// those of them allowed by WithMetricLabelKeys. Neither may be modified.
+	Labels       map[string]string
+	MetricLabels map[string]string
+
+	ctx context.Context
+}
+
+type SessionStats = ConnStats
+
+// WithConnectionCallbacks registers callbacks invoked synchronously on the
+// session goroutine: onConnect once the websocket is upgraded, and
+// onDisconnect exactly once when the session ends. Every session gets both,
+// including when the target dial fails; with WithPreflightDial that happens
+// before the upgrade, and both run before the error response is written.
+func WithConnectionCallbacks(onConnect func(Session), onDisconnect func(Session, SessionStats, error)) HandlerOption {
+	return func(h *Handler) {
+		h.onConnect = onConnect
+		h.onDisconnect = onDisconnect
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *session) clientAddr() string {
+	if ip := s.h.clientIP(s.req); ip.IsValid() {
+		return ip.String()
+	}
+	return s.req.RemoteAddr
+}
+
+func (s *session) info() Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Session{
+		ID:           s.id,
+		RequestID:    RequestIDFromContext(s.ctx),
+		ClientAddr:   s.clientAddr(),
+		Path:         s.req.URL.Path,
+		Target:       s.target,
+		User:         UserFromContext(s.ctx),
+		Start:        s.start,
+		TargetAddr:   s.targetAddr,
+		TCPKeepAlive: s.tcpKeepAlive,
+		TCPNoDelay:   s.tcpNoDelay,
+		Labels:       s.labels,
+		MetricLabels: s.metricLabels,
+		ctx:          s.ctx,
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type callbackLog struct {
+	mu          sync.Mutex
+	connects    []Session
+	disconnects []error
+	done        chan struct{}
+}
+
+func newCallbackLog() *callbackLog {
+	return &callbackLog{done: make(chan struct{}, 1)}
+}
+
+func (l *callbackLog) option() HandlerOption {
+	return WithConnectionCallbacks(func(s Session) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.connects = append(l.connects, s)
+	}, func(_ Session, _ SessionStats, err error) {
+		l.mu.Lock()
+		l.disconnects = append(l.disconnects, err)
+		l.mu.Unlock()
+		l.done <- struct{}{}
+	})
+}
+
+func (l *callbackLog) wait(t *testing.T) (connects []Session, disconnects []error) {
+	t.Helper()
+	select {
+	case <-l.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onDisconnect not called")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.connects, l.disconnects
+}
+
+func TestConnectionCallbacks(t *testing.T) {
+	l := newCallbackLog()
+	ws := dialWS(t, startHandler(t, NewHandler(echoTarget(t), l.option())), nil)
+	sendBinary(t, ws, []byte("hi"))
+	readFrame(t, ws)
+	ws.Close()
+	connects, disconnects := l.wait(t)
+	if len(connects) != 1 || len(disconnects) != 1 {
+		t.Fatalf("%d connects and %d disconnects, want 1 each", len(connects), len(disconnects))
+	}
+	if connects[0].ClientAddr != "127.0.0.1" {
+		t.Fatalf("ClientAddr = %q, want 127.0.0.1", connects[0].ClientAddr)
+	}
+}
+
+func TestConnectionCallbacksClientAddr(t *testing.T) {
+	l := newCallbackLog()
+	h := NewHandler(echoTarget(t), l.option(), WithTrustedProxies("127.0.0.0/8"))
+	ws := dialWS(t, startHandler(t, h), http.Header{"X-Forwarded-For": {"203.0.113.7"}})
+	ws.Close()
+	connects, _ := l.wait(t)
+	if len(connects) != 1 || connects[0].ClientAddr != "203.0.113.7" {
+		t.Fatalf("connects %+v, want ClientAddr 203.0.113.7", connects)
+	}
+}
+
+func TestConnectionCallbacksDialFailure(t *testing.T) {
+	for _, preflight := range []bool{false, true} {
+		l := newCallbackLog()
+		h := NewHandler("127.0.0.1:1", l.option(), WithPreflightDial(preflight))
+		resp := upgradeResponse(t, startHandler(t, h), nil)
+		resp.Body.Close()
+		if preflight && resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("preflight: status %d, want 502", resp.StatusCode)
+		}
+		connects, disconnects := l.wait(t)
+		if len(connects) != 1 || len(disconnects) != 1 {
+			t.Fatalf("preflight %v: %d connects and %d disconnects, want 1 each", preflight, len(connects), len(disconnects))
+		}
+		if disconnects[0] == nil {
+			t.Fatalf("preflight %v: onDisconnect got no error", preflight)
+		}
+	}
+}
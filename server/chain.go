@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/zijiren233/gwst/client"
+)
+
+// TargetHintHeader names the target a chained hop asks the next wst server
+// to relay to. The next server honors it only with WithTargetHint.
+const TargetHintHeader = "X-WST-Target"
+
+var errTargetHint = errors.New("target hint not allowed")
+
+// WithUpstreamWST relays every session through another wst server, connected
+// with cfg, instead of dialing the target directly. The session target is
+// sent in TargetHintHeader. Unless cfg sets its own Dialer or DialContext,
+// the next hop is dialed with the Handler's dialer, so options such as
+// WithUpstreamSOCKS5 apply to it.
+func WithUpstreamWST(cfg client.ConnectConfig) HandlerOption {
+	return func(h *Handler) {
+		h.upstreamWST = &cfg
+	}
+}
+
+// WithTargetHint lets a client, such as a wst server chained with
+// WithUpstreamWST, pick its target with TargetHintHeader. policy vets each
+// hint; a rejected hint fails the handshake with 403. A hint takes precedence
+// over WithGetTarget and the backends; requests without one are unaffected.
+func WithTargetHint(policy TargetPolicy) HandlerOption {
+	if policy == nil {
+		panic("wst: nil target policy")
+	}
+	return func(h *Handler) {
+		h.targetHintPolicy = policy
+	}
+}
+
+// resolveTargetHint stores the hinted target of req, reporting false after
+// rejecting a hint the policy does not allow.
+func (h *Handler) resolveTargetHint(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	hint := req.Header.Get(TargetHintHeader)
+	if hint == "" {
+		return req, true
+	}
+	if err := h.targetHintPolicy("tcp", hint); err != nil {
+		h.logRejected(req, http.StatusForbidden, errTargetHint.Error()+": "+err.Error())
+		h.metrics.Handshake(HandshakeRejectedTarget)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return req, false
+	}
+	rt := &resolvedTarget{target: hint, hinted: true}
+	return req.WithContext(context.WithValue(req.Context(), targetContextKey{}, rt)), true
+}
+
+type wstDialer struct {
+	cfg *client.ConnectConfig
+}
+
+func newWSTDialer(cfg *client.ConnectConfig, forward ContextDialer) *wstDialer {
+	cfg = cfg.Clone()
+	if cfg.Dialer == nil && cfg.DialContext == nil {
+		cfg.DialContext = forward.DialContext
+	}
+	return &wstDialer{cfg: cfg}
+}
+
+func (d *wstDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	cfg := d.cfg.Clone()
+	if cfg.Header == nil {
+		cfg.Header = make(http.Header)
+	}
+	cfg.Header.Set(TargetHintHeader, addr)
+	return client.ConnectWithConfig(ctx, *cfg)
+}
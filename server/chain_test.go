@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/gwst/client"
+	"golang.org/x/net/websocket"
+)
+
+func TestUpstreamWSTChain(t *testing.T) {
+	target := echoTarget(t)
+	var hinted []string
+	next := httptest.NewTLSServer(NewHandler("127.0.0.1:1", WithTargetHint(func(network, addr string) error {
+		hinted = append(hinted, network+" "+addr)
+		return nil
+	})))
+	defer next.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(next.Certificate())
+
+	var cfg client.ConnectConfig
+	client.WithAddr(strings.TrimPrefix(next.URL, "https://"))(&cfg)
+	client.WithTLSConfig(&tls.Config{RootCAs: roots, ServerName: "example.com"})(&cfg)
+	first := startHandler(t, NewHandler(target, WithUpstreamWST(cfg)))
+
+	ws := dialWS(t, first, nil)
+	sendBinary(t, ws, []byte("through two hops"))
+	if f := readFrame(t, ws); string(f.payload) != "through two hops" {
+		t.Fatalf("got %q", f.payload)
+	}
+	if len(hinted) != 1 || hinted[0] != "tcp "+target {
+		t.Fatalf("next hop saw hints %q, want %q", hinted, target)
+	}
+}
+
+func TestTargetHintRejected(t *testing.T) {
+	next := startHandler(t, NewHandler(echoTarget(t), WithTargetHint(func(string, string) error {
+		return errors.New("no")
+	})))
+	resp := upgradeResponse(t, next, map[string][]string{TargetHintHeader: {"10.0.0.1:22"}})
+	if resp.StatusCode != 403 {
+		t.Fatalf("status %d, want 403", resp.StatusCode)
+	}
+
+	var cfg client.ConnectConfig
+	client.WithAddr(strings.TrimPrefix(next, "ws://"))(&cfg)
+	ws := dialWS(t, startHandler(t, NewHandler("10.0.0.1:22", WithUpstreamWST(cfg))), nil)
+	if code := readClose(t, ws); code != CloseInternalError {
+		t.Fatalf("close code %d, want %d", code, CloseInternalError)
+	}
+}
+
+func TestTargetHintIgnoredWithoutOption(t *testing.T) {
+	target := echoTarget(t)
+	ws := dialWS(t, startHandler(t, NewHandler(target)), map[string][]string{TargetHintHeader: {"127.0.0.1:1"}})
+	sendBinary(t, ws, []byte("x"))
+	if f := readFrame(t, ws); f.opcode != websocket.BinaryFrame || string(f.payload) != "x" {
+		t.Fatalf("got frame %d %q, want the echo from the configured target", f.opcode, f.payload)
+	}
+}
+
+func TestUpstreamWSTUsesHandlerDialer(t *testing.T) {
+	next := startHandler(t, NewHandler(echoTarget(t), WithTargetHint(func(string, string) error { return nil })))
+	dialed := make(chan string, 1)
+	var cfg client.ConnectConfig
+	client.WithAddr(strings.TrimPrefix(next, "ws://"))(&cfg)
+	h := NewHandler("127.0.0.1:9", WithUpstreamWST(cfg), WithHandlerDialer(dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return nil, errors.New("refused")
+	})))
+	ws := dialWS(t, startHandler(t, h), nil)
+	readClose(t, ws)
+	select {
+	case addr := <-dialed:
+		if addr != strings.TrimPrefix(next, "ws://") {
+			t.Fatalf("dialed %q, want the next hop", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler dialer not used for the next hop")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+var errClientCertRejected = fmt.Errorf("%w: client certificate", ErrInvalidCredentials)
+
+// ClientCertificate returns the verified client certificate of req, or nil if
+// the client did not present one that chains to the configured CAs. Its
+// Subject.CommonName, DNSNames, URIs and EmailAddresses identify the client.
+func ClientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// ClientCertCommonName returns the common name of the verified client
+// certificate of req, or "" if there is none.
+func ClientCertCommonName(req *http.Request) string {
+	if cert := ClientCertificate(req); cert != nil {
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// ClientCertDNSNames returns the DNS subject alternative names of the
+// verified client certificate of req.
+func ClientCertDNSNames(req *http.Request) []string {
+	if cert := ClientCertificate(req); cert != nil {
+		return cert.DNSNames
+	}
+	return nil
+}
+
+// ClientCertURIs returns the URI subject alternative names of the verified
+// client certificate of req, such as SPIFFE IDs.
+func ClientCertURIs(req *http.Request) []*url.URL {
+	if cert := ClientCertificate(req); cert != nil {
+		return cert.URIs
+	}
+	return nil
+}
+
+// WithRequireClientCertCN only accepts clients whose verified certificate
+// has a common name matching one of patterns, in path.Match syntax such as
+// "*.clients.example.com".
+func WithRequireClientCertCN(patterns ...string) HandlerOption {
+	return requireClientCert("common name", patterns, func(cert *x509.Certificate) []string {
+		return []string{cert.Subject.CommonName}
+	})
+}
+
+// WithRequireClientCertDNS only accepts clients whose verified certificate
+// has a DNS subject alternative name matching one of patterns, in path.Match
+// syntax.
+func WithRequireClientCertDNS(patterns ...string) HandlerOption {
+	return requireClientCert("DNS name", patterns, func(cert *x509.Certificate) []string {
+		return cert.DNSNames
+	})
+}
+
+// WithRequireClientCertURI only accepts clients whose verified certificate
+// has a URI subject alternative name matching one of patterns, in path.Match
+// syntax such as "spiffe://example.com/tunnel/*".
+func WithRequireClientCertURI(patterns ...string) HandlerOption {
+	return requireClientCert("URI", patterns, func(cert *x509.Certificate) []string {
+		uris := make([]string, len(cert.URIs))
+		for i, u := range cert.URIs {
+			uris[i] = u.String()
+		}
+		return uris
+	})
+}
+
+func requireClientCert(kind string, patterns []string, names func(*x509.Certificate) []string) HandlerOption {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			panic(fmt.Sprintf("wst: invalid %s pattern %q", kind, p))
+		}
+	}
+	return func(h *Handler) {
+		h.auth = append(h.auth, authenticator{
+			check: func(req *http.Request) (*http.Request, error) {
+				cert := ClientCertificate(req)
+				if cert == nil {
+					return req, ErrMissingCredentials
+				}
+				for _, name := range names(cert) {
+					for _, p := range patterns {
+						if ok, _ := path.Match(p, name); ok {
+							return req, nil
+						}
+					}
+				}
+				return req, errClientCertRejected
+			},
+		})
+	}
+}
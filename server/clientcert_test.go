@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/gwst/client"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate signed by ca for tmpl, filling in the
+// validity, serial number and key.
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) clientCert(t *testing.T, cn string, dns []string, uris ...string) tls.Certificate {
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		DNSNames:    dns,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, s := range uris {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+	return ca.issue(t, tmpl)
+}
+
+// startMTLSServer serves h over TLS requiring certificates from ca, giving
+// WithClientCAs before WithServerTLS, and returns its address.
+func startMTLSServer(t *testing.T, ca *testCA, h *Handler) string {
+	t.Helper()
+	serverCert := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	addr := make(chan net.Addr, 1)
+	srv := NewServer("127.0.0.1:0", "/", h,
+		WithClientCAs(ca.pool),
+		WithServerTLS(&tls.Config{Certificates: []tls.Certificate{serverCert}}),
+		WithOnListen(func(a net.Addr) { addr <- a }),
+	)
+	go func() { _ = srv.Serve() }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return (<-addr).String()
+}
+
+func dialMTLS(addr string, ca *testCA, cert tls.Certificate) (net.Conn, error) {
+	return client.Connect(context.Background(),
+		client.WithAddr(addr),
+		client.WithTLSConfig(&tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{cert}}),
+	)
+}
+
+func TestClientCertRouting(t *testing.T) {
+	ca := newTestCA(t)
+	targets := map[string]string{
+		"db.clients.example.com":    prefixTarget(t, "db:"),
+		"cache.clients.example.com": prefixTarget(t, "cache:"),
+	}
+	h := NewHandler("", WithGetTarget(func(req *http.Request) (string, []string, error) {
+		for _, name := range ClientCertDNSNames(req) {
+			if target, ok := targets[name]; ok {
+				return target, nil, nil
+			}
+		}
+		return "", nil, errors.New("no route")
+	}))
+	addr := startMTLSServer(t, ca, h)
+
+	for name, want := range map[string]string{
+		"db.clients.example.com":    "db:hi",
+		"cache.clients.example.com": "cache:hi",
+	} {
+		conn, err := dialMTLS(addr, ca, ca.clientCert(t, "client", []string{name}))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		_, _ = conn.Write([]byte("hi"))
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != want {
+			t.Fatalf("%s: got %q, %v; want %q", name, got, err, want)
+		}
+		conn.Close()
+	}
+	if _, err := dialMTLS(addr, ca, ca.clientCert(t, "client", []string{"other.example.com"})); err == nil {
+		t.Fatal("unrouted certificate accepted")
+	}
+}
+
+func TestClientCertRequireCA(t *testing.T) {
+	ca := newTestCA(t)
+	addr := startMTLSServer(t, ca, NewHandler(echoTarget(t)))
+	other := newTestCA(t)
+	if _, err := dialMTLS(addr, ca, other.clientCert(t, "client", nil)); err == nil {
+		t.Fatal("certificate from another CA accepted")
+	}
+}
+
+func TestRequireClientCertPolicies(t *testing.T) {
+	ca := newTestCA(t)
+	for _, tc := range []struct {
+		name   string
+		option HandlerOption
+		cert   tls.Certificate
+		ok     bool
+	}{
+		{"cn", WithRequireClientCertCN("*.clients.example.com"), ca.clientCert(t, "a.clients.example.com", nil), true},
+		{"cn mismatch", WithRequireClientCertCN("*.clients.example.com"), ca.clientCert(t, "a.example.com", nil), false},
+		{"dns", WithRequireClientCertDNS("*.svc"), ca.clientCert(t, "x", []string{"other", "db.svc"}), true},
+		{"dns mismatch", WithRequireClientCertDNS("*.svc"), ca.clientCert(t, "db.svc", nil), false},
+		{"uri", WithRequireClientCertURI("spiffe://example.com/tunnel/*"), ca.clientCert(t, "x", nil, "spiffe://example.com/tunnel/db"), true},
+		{"uri mismatch", WithRequireClientCertURI("spiffe://example.com/tunnel/*"), ca.clientCert(t, "x", nil, "spiffe://example.com/other/db"), false},
+	} {
+		addr := startMTLSServer(t, ca, NewHandler(echoTarget(t), tc.option))
+		conn, err := dialMTLS(addr, ca, tc.cert)
+		if (err == nil) != tc.ok {
+			t.Fatalf("%s: got %v, want accepted %v", tc.name, err, tc.ok)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestClientCertHelpers(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.clientCert(t, "alice", []string{"alice.example.com"}, "spiffe://example.com/alice")
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	req := &http.Request{TLS: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, ca.cert}}}}
+	if got := ClientCertCommonName(req); got != "alice" {
+		t.Fatalf("common name %q", got)
+	}
+	if got := ClientCertDNSNames(req); len(got) != 1 || got[0] != "alice.example.com" {
+		t.Fatalf("DNS names %q", got)
+	}
+	if got := ClientCertURIs(req); len(got) != 1 || got[0].String() != "spiffe://example.com/alice" {
+		t.Fatalf("URIs %v", got)
+	}
+	plain := &http.Request{}
+	if ClientCertCommonName(plain) != "" || ClientCertDNSNames(plain) != nil || ClientCertURIs(plain) != nil {
+		t.Fatal("helpers returned values without a certificate")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+func WithTrustedProxies(cidrs ...string) HandlerOption {
+	prefixes := mustParsePrefixes(cidrs)
+	return func(h *Handler) {
+		h.trustedProxies = prefixes
+	}
+}
+
+func mustParsePrefixes(cidrs []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := parsePrefix(cidr)
+		if err != nil {
+			panic(err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address %q: %w", s, err)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid cidr %q: %w", s, err)
+	}
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+func (h *Handler) isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range h.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteAddr(req *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+func (h *Handler) clientIP(req *http.Request) netip.Addr {
+	addr := remoteAddr(req)
+	if len(h.trustedProxies) == 0 || !h.isTrustedProxy(addr) {
+		return addr
+	}
+
+	for _, hop := range h.forwardedHops(req) {
+		addr = hop
+		if !h.isTrustedProxy(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// forwardedHops returns the proxy chain nearest hop first, preferring the
+// RFC 7239 Forwarded header over X-Forwarded-For. Parsing stops at the first
+// hop that is not an IP address, such as an obfuscated or "unknown" node.
+func (h *Handler) forwardedHops(req *http.Request) []netip.Addr {
+	var nodes []string
+	if values := req.Header.Values("Forwarded"); len(values) > 0 {
+		for _, fe := range parseForwarded(values) {
+			nodes = append(nodes, fe.For)
+		}
+	} else {
+		nodes = strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	}
+
+	hops := make([]netip.Addr, 0, len(nodes))
+	for i := len(nodes) - 1; i >= 0; i-- {
+		addr, ok := parseForwardedNode(strings.TrimSpace(nodes[i]))
+		if !ok {
+			break
+		}
+		hops = append(hops, addr)
+	}
+	return hops
+}
+
+// isSecure reports whether the client connected over TLS, either directly or
+// to a trusted proxy that reported it via Forwarded or X-Forwarded-Proto.
+func (h *Handler) isSecure(req *http.Request) bool {
+	if req.TLS != nil {
+		return true
+	}
+	if len(h.trustedProxies) == 0 || !h.isTrustedProxy(remoteAddr(req)) {
+		return false
+	}
+	var proto string
+	if values := req.Header.Values("Forwarded"); len(values) > 0 {
+		if elems := parseForwarded(values); len(elems) > 0 {
+			proto = elems[len(elems)-1].Proto
+		}
+	} else {
+		values := strings.Split(req.Header.Get("X-Forwarded-Proto"), ",")
+		proto = values[len(values)-1]
+	}
+	switch strings.ToLower(strings.TrimSpace(proto)) {
+	case "https", "wss":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zijiren233/gwst/internal/wire"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	CloseNormalClosure   = 1000
+	CloseGoingAway       = 1001
+	CloseUnsupportedData = 1003
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+type CloseError struct {
+	Reason string
+	Code   int
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+var closeCodec = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		return v.([]byte), websocket.CloseFrame, nil
+	},
+}
+
+func closePayload(code int, reason string) []byte {
+	if len(reason) > 123 {
+		// Cut at a rune boundary: the reason must stay valid UTF-8.
+		n := 123
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	msg := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(msg, uint16(code))
+	return append(msg, reason...)
+}
+
+func parseClosePayload(payload []byte) *CloseError {
+	if len(payload) < 2 {
+		return &CloseError{Code: 1005}
+	}
+	return &CloseError{
+		Code:   int(binary.BigEndian.Uint16(payload)),
+		Reason: string(payload[2:]),
+	}
+}
+
+// readErrorClose maps errors from frameReader that are the client's fault to
+// a close code and reason.
+func readErrorClose(err error) (int, string, bool) {
+	switch {
+	case errors.Is(err, errMessageTooBig):
+		return CloseMessageTooBig, "message too big", true
+	case errors.Is(err, errBinaryInTextMode):
+		return CloseUnsupportedData, err.Error(), true
+	case errors.Is(err, errInvalidBase64):
+		return CloseInvalidPayload, err.Error(), true
+	default:
+		return 0, "", false
+	}
+}
+
+func writeClose(ws *websocket.Conn, code int, reason string) error {
+	return closeCodec.Send(ws, closePayload(code, reason))
+}
+
+// HalfCloseHeader is sent by clients that understand the half-close signal.
+// The server echoes it when it propagates half-closes for the session; other
+// sessions end as a whole when either side finishes.
+const HalfCloseHeader = "X-WST-Half-Close"
+
+// DefaultHalfCloseTimeout bounds how long a session stays half-open after the
+// target has finished, waiting for the client to finish too.
+const DefaultHalfCloseTimeout = 30 * time.Second
+
+// WithHalfCloseTimeout sets how long a session stays half-open after the
+// target has finished writing before it is closed.
+func WithHalfCloseTimeout(d time.Duration) HandlerOption {
+	if d <= 0 {
+		panic("wst: half-close timeout must be positive")
+	}
+	return func(h *Handler) {
+		h.halfCloseTimeout = d
+	}
+}
+
+func (h *Handler) negotiateHalfClose(config *websocket.Config, req *http.Request) {
+	if !h.halfClose || req.Header.Get(HalfCloseHeader) != "1" {
+		return
+	}
+	if config.Header == nil {
+		config.Header = make(http.Header)
+	}
+	config.Header.Set(HalfCloseHeader, "1")
+}
+
+// halfClosing reports whether half-closes are propagated for the session.
+func (s *session) halfClosing() bool {
+	return s.h.halfClose && s.ws.Request().Header.Get(HalfCloseHeader) == "1"
+}
+
+// WithHalfClose enables half-close propagation for clients that send
+// HalfCloseHeader: when one side finishes writing, the other is told so and
+// the opposite direction keeps relaying until it ends too, or for at most the
+// half-close timeout after the target finished. By default, and for clients
+// that do not send the header, the end of either direction closes the whole
+// session, so a tunnel never stays half open after the target or the client
+// goes away.
+func WithHalfClose(enabled bool) HandlerOption {
+	return func(h *Handler) {
+		h.halfClose = enabled
+	}
+}
+
+// An empty text frame signals that the peer has finished writing, the
+// websocket equivalent of a TCP FIN. Tunnel data uses binary frames, or
+// non-empty base64 text frames in text mode.
+var halfCloseCodec = websocket.Codec{
+	Marshal: func(any) ([]byte, byte, error) {
+		return nil, websocket.TextFrame, nil
+	},
+}
+
+func writeHalfClose(ws *websocket.Conn) error {
+	return halfCloseCodec.Send(ws, nil)
+}
+
+// peekHalfClose reports whether frame is the half-close signal. Otherwise
+// it returns a reader yielding the complete frame payload.
+func peekHalfClose(frame interface {
+	io.Reader
+	PayloadType() byte
+}) (io.Reader, bool) {
+	if frame.PayloadType() != websocket.TextFrame {
+		return frame, false
+	}
+	var b [1]byte
+	n, _ := io.ReadFull(frame, b[:])
+	if n == 0 {
+		return nil, true
+	}
+	return io.MultiReader(bytes.NewReader(b[:n]), frame), false
+}
+
+type frameReader struct {
+	ws        *websocket.Conn
+	frame     io.Reader
+	closeErr  *CloseError
+	eof       bool
+	lastFrame *atomic.Int64
+	// waitSince, if set, holds when the reader began waiting for the next
+	// frame, or zero while it is not waiting.
+	waitSince *atomic.Int64
+	maxSize   int
+	// msgSize is the payload seen so far of the message being read, which
+	// spans its continuation frames.
+	msgSize int
+	text    bool
+	// wire, if set, counts the payload bytes of data frames.
+	wire   *atomic.Int64
+	pinger *wire.Pinger
+}
+
+func newFrameReader(ws *websocket.Conn) *frameReader {
+	return &frameReader{ws: ws}
+}
+
+// frameHasMore reports whether the frame being read has payload left. It
+// consumes a byte when it does.
+func (fr *frameReader) frameHasMore() bool {
+	if fr.frame == nil {
+		return false
+	}
+	var b [1]byte
+	n, _ := fr.frame.Read(b[:])
+	return n > 0
+}
+
+func (fr *frameReader) Read(b []byte) (int, error) {
+	if fr.eof {
+		return 0, io.EOF
+	}
+	for {
+		if fr.frame == nil {
+			if fr.waitSince != nil {
+				fr.waitSince.Store(time.Now().UnixNano())
+			}
+			frame, err := fr.ws.NewFrameReader()
+			if fr.waitSince != nil {
+				fr.waitSince.Store(0)
+			}
+			if err != nil {
+				return 0, err
+			}
+			if fr.lastFrame != nil {
+				fr.lastFrame.Store(time.Now().UnixNano())
+			}
+			if frame.PayloadType() == websocket.CloseFrame {
+				payload, _ := io.ReadAll(io.LimitReader(frame, 125))
+				fr.closeErr = parseClosePayload(payload)
+				return 0, io.EOF
+			}
+			if frame.PayloadType() == websocket.PongFrame && fr.pinger != nil {
+				payload, _ := io.ReadAll(io.LimitReader(frame, 125))
+				fr.pinger.Pong(payload)
+				continue
+			}
+			size := payloadLen(frame)
+			switch frame.PayloadType() {
+			case websocket.TextFrame, websocket.BinaryFrame:
+				fr.msgSize = size
+			case websocket.ContinuationFrame:
+				fr.msgSize += size
+			}
+			if fr.maxSize > 0 && (size > fr.maxSize || fr.msgSize > fr.maxSize) {
+				return 0, errMessageTooBig
+			}
+			r, err := fr.ws.HandleFrame(frame)
+			if err != nil {
+				return 0, err
+			}
+			if r == nil {
+				continue
+			}
+			isText := r.PayloadType() == websocket.TextFrame
+			payload, halfClose := peekHalfClose(r)
+			if halfClose {
+				fr.eof = true
+				return 0, io.EOF
+			}
+			if fr.wire != nil {
+				fr.wire.Add(int64(size))
+			}
+			if fr.text {
+				if !isText {
+					return 0, errBinaryInTextMode
+				}
+				payload = base64Reader{base64.NewDecoder(base64.StdEncoding, payload)}
+			}
+			fr.frame = payload
+		}
+		n, err := fr.frame.Read(b)
+		if err == io.EOF {
+			fr.frame = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zijiren233/gwst/client"
+	"golang.org/x/net/websocket"
+)
+
+func TestHalfCloseTargetFirst(t *testing.T) {
+	got := make(chan []byte, 1)
+	target := startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = conn.Write([]byte("hello"))
+		_ = conn.(*net.TCPConn).CloseWrite()
+		b, _ := io.ReadAll(conn)
+		got <- b
+	})
+	ws := dialWS(t, startHandler(t, NewHandler(target, WithHalfClose(true))), halfCloseHeader())
+
+	if f := readFrame(t, ws); f.opcode != websocket.BinaryFrame || string(f.payload) != "hello" {
+		t.Fatalf("got frame %d %q, want binary hello", f.opcode, f.payload)
+	}
+	if f := readFrame(t, ws); f.opcode != websocket.TextFrame || len(f.payload) != 0 {
+		t.Fatalf("got frame %d %q, want half-close", f.opcode, f.payload)
+	}
+	sendBinary(t, ws, []byte("after fin"))
+	if err := writeHalfClose(ws); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-got:
+		if string(b) != "after fin" {
+			t.Fatalf("target got %q, want %q", b, "after fin")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target did not see client data and EOF")
+	}
+	if code := readClose(t, ws); code != CloseNormalClosure {
+		t.Fatalf("close code %d, want %d", code, CloseNormalClosure)
+	}
+}
+
+func TestHalfCloseClientFirst(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		_, _ = conn.Write(bytes.ToUpper(b))
+	})
+	ws := dialWS(t, startHandler(t, NewHandler(target, WithHalfClose(true))), halfCloseHeader())
+
+	sendBinary(t, ws, []byte("upload"))
+	if err := writeHalfClose(ws); err != nil {
+		t.Fatal(err)
+	}
+	if f := readFrame(t, ws); string(f.payload) != "UPLOAD" {
+		t.Fatalf("got %q, want %q", f.payload, "UPLOAD")
+	}
+	if code := readClose(t, ws); code != CloseNormalClosure {
+		t.Fatalf("close code %d, want %d", code, CloseNormalClosure)
+	}
+}
+
+func TestLinkedTeardownOnTargetClose(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		opts   []HandlerOption
+		header http.Header
+	}{
+		{"default", nil, halfCloseHeader()},
+		{"not negotiated", []HandlerOption{WithHalfClose(true)}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := startTarget(t, func(conn net.Conn) {
+				_, _ = conn.Write([]byte("bye"))
+				_ = conn.(*net.TCPConn).CloseWrite()
+				_, _ = io.Copy(io.Discard, conn)
+				conn.Close()
+			})
+			ws := dialWS(t, startHandler(t, NewHandler(target, tc.opts...)), tc.header)
+
+			if f := readFrame(t, ws); string(f.payload) != "bye" {
+				t.Fatalf("got %q, want %q", f.payload, "bye")
+			}
+			if f := readFrame(t, ws); f.opcode != websocket.CloseFrame {
+				t.Fatalf("got frame %d, want close while the client is idle", f.opcode)
+			}
+		})
+	}
+}
+
+func TestLinkedTeardownOnClientHalfClose(t *testing.T) {
+	closed := make(chan struct{})
+	target := startTarget(t, func(conn net.Conn) {
+		defer close(closed)
+		_, _ = io.Copy(io.Discard, conn)
+		// The handler closes the conn rather than half-closing it, so a
+		// write after EOF fails once the RST arrives.
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if _, err := conn.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("target conn still open after the client half-closed")
+	})
+	ws := dialWS(t, startHandler(t, NewHandler(target)), halfCloseHeader())
+
+	if err := writeHalfClose(ws); err != nil {
+		t.Fatal(err)
+	}
+	if code := readClose(t, ws); code != CloseNormalClosure {
+		t.Fatalf("close code %d, want %d", code, CloseNormalClosure)
+	}
+	<-closed
+}
+
+func TestHalfCloseTimeout(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		_ = conn.(*net.TCPConn).CloseWrite()
+		_, _ = io.Copy(io.Discard, conn)
+		conn.Close()
+	})
+	h := NewHandler(target, WithHalfClose(true), WithHalfCloseTimeout(100*time.Millisecond))
+	ws := dialWS(t, startHandler(t, h), halfCloseHeader())
+
+	if f := readFrame(t, ws); f.opcode != websocket.TextFrame {
+		t.Fatalf("got frame %d, want half-close", f.opcode)
+	}
+	start := time.Now()
+	if code := readClose(t, ws); code != CloseNormalClosure {
+		t.Fatalf("close code %d, want %d", code, CloseNormalClosure)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("session stayed half open for %v", d)
+	}
+}
+
+func TestHalfCloseHeaderEcho(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    []HandlerOption
+		offered bool
+		want    string
+	}{
+		{"negotiated", []HandlerOption{WithHalfClose(true)}, true, "1"},
+		{"not offered", []HandlerOption{WithHalfClose(true)}, false, ""},
+		{"default", nil, true, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var header http.Header
+			if tc.offered {
+				header = halfCloseHeader()
+			}
+			resp := upgradeResponse(t, startHandler(t, NewHandler(echoTarget(t), tc.opts...)), header)
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d, want 101", resp.StatusCode)
+			}
+			if got := resp.Header.Get(HalfCloseHeader); got != tc.want {
+				t.Fatalf("%s = %q, want %q", HalfCloseHeader, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCloseStatusTargetEOF(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("bye"))
+		conn.Close()
+	})
+	ws := dialWS(t, startHandler(t, NewHandler(target)), nil)
+	if f := readFrame(t, ws); string(f.payload) != "bye" {
+		t.Fatalf("got %q, want %q", f.payload, "bye")
+	}
+	if code := readClose(t, ws); code != CloseNormalClosure {
+		t.Fatalf("close code %d, want %d", code, CloseNormalClosure)
+	}
+}
+
+func TestCloseStatusShutdown(t *testing.T) {
+	h := NewHandler(echoTarget(t))
+	ws := dialWS(t, startHandler(t, h), nil)
+	sendBinary(t, ws, []byte("ping"))
+	readFrame(t, ws)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = h.Shutdown(ctx)
+	if ce := readCloseError(t, ws); ce.Code != CloseGoingAway || ce.Reason != "server shutting down" {
+		t.Fatalf("closed with %d %q, want %d", ce.Code, ce.Reason, CloseGoingAway)
+	}
+}
+
+func TestCloseFromClientEndsTarget(t *testing.T) {
+	done := make(chan []byte, 1)
+	target := startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		done <- b
+	})
+	ws := dialWS(t, startHandler(t, NewHandler(target)), nil)
+	sendBinary(t, ws, []byte("last"))
+	ws.Close()
+	select {
+	case b := <-done:
+		if string(b) != "last" {
+			t.Fatalf("target got %q, want %q", b, "last")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target conn still open after the client closed")
+	}
+}
+
+func TestClientReadCloseError(t *testing.T) {
+	d := dialerFunc(func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("refused by test")
+	})
+	url := startHandler(t, NewHandler("127.0.0.1:1", WithHandlerDialer(d)))
+	conn, err := client.Connect(context.Background(), client.WithAddr(strings.TrimPrefix(url, "ws://")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1))
+	var ce *client.CloseError
+	if !errors.As(err, &ce) || ce.Code != CloseInternalError || ce.Reason != "target dial failed" {
+		t.Fatalf("read error %v, want close %d", err, CloseInternalError)
+	}
+}
+
+func TestClosePayloadTruncatesAtRuneBoundary(t *testing.T) {
+	// With zero to two ASCII bytes in front of the three- and four-byte
+	// runes, byte 123 falls at each position within a rune.
+	for _, reason := range []string{
+		strings.Repeat("界", 50),
+		"x" + strings.Repeat("界", 50),
+		"xy" + strings.Repeat("界", 50),
+		strings.Repeat("🙂", 40),
+	} {
+		payload := closePayload(CloseInternalError, reason)
+		got := payload[2:]
+		if len(payload) > 125 || !utf8.Valid(got) || !strings.HasPrefix(reason, string(got)) {
+			t.Fatalf("reason %q cut to %d bytes %q", reason, len(got), got)
+		}
+		if len(got) < 120 {
+			t.Fatalf("reason cut to %d bytes, want the longest valid prefix", len(got))
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WithHandlerCoalesce batches small target reads into fewer websocket frames.
+// Buffered data is flushed once maxBytes are pending, maxDelay after the
+// first pending byte, or as soon as the next read from the target would
+// block, so a lone small write is sent without delay and only bursts are
+// batched. Where that cannot be determined, such as on Windows or for targets
+// that are not plain sockets, only maxBytes and maxDelay apply. Pending data
+// is flushed before the session closes. A non-positive maxDelay or maxBytes
+// disables coalescing.
+func WithHandlerCoalesce(maxDelay time.Duration, maxBytes int) HandlerOption {
+	return func(h *Handler) {
+		h.coalesceDelay = maxDelay
+		h.coalesceBytes = maxBytes
+	}
+}
+
+// idleFlushReader flushes w before a read from conn that would block.
+type idleFlushReader struct {
+	io.Reader
+	conn syscall.Conn
+	w    *coalescingWriter
+}
+
+func (r *idleFlushReader) Read(b []byte) (int, error) {
+	if r.w.pending() {
+		if ready, ok := readable(r.conn); ok && !ready {
+			if err := r.w.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return r.Reader.Read(b)
+}
+
+type coalescingWriter struct {
+	dst      deadlineWriter
+	err      error
+	timer    *time.Timer
+	buf      []byte
+	maxDelay time.Duration
+	mu       sync.Mutex
+}
+
+func newCoalescingWriter(dst deadlineWriter, maxDelay time.Duration, maxBytes int) *coalescingWriter {
+	return &coalescingWriter{
+		dst:      dst,
+		buf:      make([]byte, 0, maxBytes),
+		maxDelay: maxDelay,
+	}
+}
+
+func (w *coalescingWriter) SetWriteDeadline(t time.Time) error {
+	return w.dst.SetWriteDeadline(t)
+}
+
+func (w *coalescingWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if len(w.buf)+len(b) > cap(w.buf) {
+		if err := w.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+	if len(b) >= cap(w.buf) {
+		n, err := w.dst.Write(b)
+		if err != nil {
+			w.err = err
+		}
+		return n, err
+	}
+
+	w.buf = append(w.buf, b...)
+	if len(w.buf) == cap(w.buf) {
+		if err := w.flushLocked(); err != nil {
+			return 0, err
+		}
+	} else if w.timer == nil {
+		w.timer = time.AfterFunc(w.maxDelay, func() {
+			_ = w.Flush()
+		})
+	}
+	return len(b), nil
+}
+
+func (w *coalescingWriter) pending() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.buf) > 0
+}
+
+func (w *coalescingWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLocked()
+}
+
+func (w *coalescingWriter) flushLocked() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.err != nil || len(w.buf) == 0 {
+		return w.err
+	}
+	_, err := w.dst.Write(w.buf)
+	w.buf = w.buf[:0]
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
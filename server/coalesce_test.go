@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// frameLog records each write as a frame; the coalescing timer writes from
+// its own goroutine.
+type frameLog struct {
+	mu     sync.Mutex
+	frames [][]byte
+	err    error
+}
+
+func (w *frameLog) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.frames = append(w.frames, bytes.Clone(b))
+	return len(b), nil
+}
+
+func (w *frameLog) SetWriteDeadline(time.Time) error { return nil }
+
+func (w *frameLog) written() [][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.frames
+}
+
+func TestCoalescingWriter(t *testing.T) {
+	log := &frameLog{}
+	w := newCoalescingWriter(log, time.Hour, 8)
+	for _, s := range []string{"ab", "cd", "ef"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(log.written()); n != 0 {
+		t.Fatalf("%d frames written before a flush", n)
+	}
+	// The next write does not fit, so the pending bytes go out first; a
+	// write as large as the buffer is passed through.
+	_, _ = w.Write([]byte("ghi"))
+	_, _ = w.Write([]byte("0123456789"))
+	_, _ = w.Write([]byte("12345"))
+	_ = w.Flush()
+	want := []string{"abcdef", "ghi", "0123456789", "12345"}
+	frames := log.written()
+	if len(frames) != len(want) {
+		t.Fatalf("frames %q, want %q", frames, want)
+	}
+	for i := range want {
+		if string(frames[i]) != want[i] {
+			t.Fatalf("frames %q, want %q", frames, want)
+		}
+	}
+}
+
+func TestCoalescingWriterFullBuffer(t *testing.T) {
+	log := &frameLog{}
+	w := newCoalescingWriter(log, time.Hour, 4)
+	_, _ = w.Write([]byte("ab"))
+	_, _ = w.Write([]byte("cd"))
+	if frames := log.written(); len(frames) != 1 || string(frames[0]) != "abcd" {
+		t.Fatalf("frames %q, want the full buffer flushed", frames)
+	}
+}
+
+func TestCoalescingWriterMaxDelay(t *testing.T) {
+	log := &frameLog{}
+	w := newCoalescingWriter(log, 50*time.Millisecond, 1024)
+	start := time.Now()
+	_, _ = w.Write([]byte("x"))
+	for len(log.written()) == 0 {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("pending byte not flushed after maxDelay")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("flushed after %v, before maxDelay", elapsed)
+	}
+}
+
+func TestCoalescingWriterError(t *testing.T) {
+	errBroken := errors.New("broken")
+	log := &frameLog{err: errBroken}
+	w := newCoalescingWriter(log, time.Hour, 8)
+	_, _ = w.Write([]byte("ab"))
+	if err := w.Flush(); !errors.Is(err, errBroken) {
+		t.Fatalf("Flush = %v, want %v", err, errBroken)
+	}
+	if _, err := w.Write([]byte("cd")); !errors.Is(err, errBroken) {
+		t.Fatalf("Write after a failed flush = %v, want %v", err, errBroken)
+	}
+}
+
+// burstTarget writes each of msgs separately, pausing between them, then
+// closes.
+func burstTarget(t *testing.T, pause time.Duration, msgs ...string) string {
+	return startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		for _, m := range msgs {
+			if _, err := io.WriteString(conn, m); err != nil {
+				return
+			}
+			time.Sleep(pause)
+		}
+	})
+}
+
+// readUntilClose returns the data frames ws receives before the close frame.
+func readUntilClose(t *testing.T, ws *websocket.Conn) (frames []string) {
+	t.Helper()
+	for {
+		f := readFrame(t, ws)
+		if f.opcode == websocket.CloseFrame {
+			return frames
+		}
+		frames = append(frames, string(f.payload))
+	}
+}
+
+// pipeTarget returns a dialer for a net.Pipe target run by serve. Whether
+// a pipe has data cannot be polled, so only maxBytes and maxDelay flush it.
+func pipeTarget(t *testing.T, serve func(net.Conn)) HandlerOption {
+	return WithHandlerDialer(dialerFunc(func(context.Context, string, string) (net.Conn, error) {
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { peer.Close() })
+		go serve(peer)
+		return conn, nil
+	}))
+}
+
+func TestWriteCoalescingBatches(t *testing.T) {
+	h := NewHandler("pipe:1", pipeTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		for i := 0; i < 20; i++ {
+			_, _ = conn.Write([]byte("k"))
+			time.Sleep(time.Millisecond)
+		}
+	}), WithHandlerCoalesce(time.Second, 1024))
+	frames := readUntilClose(t, dialWS(t, startHandler(t, h), nil))
+	// Everything is still pending when the target closes, so it is flushed
+	// in one frame before the close.
+	if len(frames) != 1 || frames[0] != "kkkkkkkkkkkkkkkkkkkk" {
+		t.Fatalf("frames %q, want one frame of 20 bytes", frames)
+	}
+}
+
+func TestWriteCoalescingFlushesWhenIdle(t *testing.T) {
+	// A lone keystroke is not held back for maxDelay.
+	h := NewHandler(burstTarget(t, time.Hour, "a"), WithHandlerCoalesce(time.Hour, 1024))
+	ws := dialWS(t, startHandler(t, h), nil)
+	start := time.Now()
+	if f := readFrame(t, ws); string(f.payload) != "a" {
+		t.Fatalf("read %q", f.payload)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("idle target's write delivered after %v", elapsed)
+	}
+}
+
+func TestWriteCoalescingMaxDelay(t *testing.T) {
+	h := NewHandler("pipe:1", pipeTarget(t, func(conn net.Conn) {
+		_, _ = conn.Write([]byte("a"))
+	}), WithHandlerCoalesce(50*time.Millisecond, 1024))
+	ws := dialWS(t, startHandler(t, h), nil)
+	start := time.Now()
+	if f := readFrame(t, ws); string(f.payload) != "a" {
+		t.Fatalf("read %q", f.payload)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("pending write delivered after %v, want about maxDelay", elapsed)
+	}
+}
+
+// benchmarkSmallWrites relays a target that writes 32-byte chunks and
+// reports the frames the client receives per second.
+func benchmarkSmallWrites(b *testing.B, opts ...HandlerOption) {
+	const chunk = 32
+	target := startTarget(b, func(conn net.Conn) {
+		defer conn.Close()
+		msg := bytes.Repeat([]byte("x"), chunk)
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(msg); err != nil {
+				return
+			}
+		}
+	})
+	ws := dialWS(b, startHandler(b, NewHandler(target, opts...)), nil)
+	b.SetBytes(chunk)
+	b.ResetTimer()
+	var frames, total int
+	for total < b.N*chunk {
+		fr, err := ws.NewFrameReader()
+		if err != nil {
+			b.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, fr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if fr.PayloadType() == websocket.BinaryFrame {
+			frames++
+			total += int(n)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(frames)/b.Elapsed().Seconds(), "frames/s")
+	b.ReportMetric(float64(frames)/float64(b.N), "frames/op")
+}
+
+func BenchmarkSmallWrites(b *testing.B) {
+	b.Run("plain", func(b *testing.B) { benchmarkSmallWrites(b) })
+	b.Run("coalesced", func(b *testing.B) {
+		benchmarkSmallWrites(b, WithHandlerCoalesce(time.Millisecond, 16<<10))
+	})
+}
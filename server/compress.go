@@ -0,0 +1,73 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/websocket"
+)
+
+// StreamCompressionProtocol is the websocket subprotocol under which both
+// directions of the tunneled byte stream are gzip compressed.
+const StreamCompressionProtocol = "wst-gzip"
+
+// WithStreamCompression gzips the tunneled stream at the given level for
+// clients that offer the wst-gzip subprotocol. Other clients are relayed
+// uncompressed.
+func WithStreamCompression(level int) HandlerOption {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		panic(fmt.Sprintf("wst: invalid compression level %d", level))
+	}
+	return func(h *Handler) {
+		h.compress = true
+		h.compressLevel = level
+	}
+}
+
+func (h *Handler) isCompressed(config *websocket.Config) bool {
+	return h.protocolMode(config) == StreamCompressionProtocol
+}
+
+// gzipWriter flushes after every write so that compressed data is not held
+// back waiting for more input.
+type gzipWriter struct {
+	deadlineWriter
+	zw *gzip.Writer
+}
+
+func newGzipWriter(dst deadlineWriter, level int) *gzipWriter {
+	zw, _ := gzip.NewWriterLevel(dst, level)
+	return &gzipWriter{deadlineWriter: dst, zw: zw}
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	n, err := w.zw.Write(b)
+	if err == nil {
+		err = w.zw.Flush()
+	}
+	return n, err
+}
+
+// Close writes the gzip trailer without closing the underlying writer.
+func (w *gzipWriter) Close() error {
+	return w.zw.Close()
+}
+
+// gzipReader defers reading the gzip header until the first Read, so that
+// the relay does not block before the peer sends any data.
+type gzipReader struct {
+	src io.Reader
+	zr  *gzip.Reader
+}
+
+func (r *gzipReader) Read(b []byte) (int, error) {
+	if r.zr == nil {
+		zr, err := gzip.NewReader(r.src)
+		if err != nil {
+			return 0, err
+		}
+		r.zr = zr
+	}
+	return r.zr.Read(b)
+}
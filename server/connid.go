@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+const (
+	ConnIDHeader    = "X-WST-Conn-Id"
+	RequestIDHeader = "X-Request-Id"
+	maxRequestIDLen = 128
+)
+
+type connIDContextKey struct{}
+
+type requestIDContextKey struct{}
+
+func ConnIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(connIDContextKey{}).(string)
+	return id
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+func withConnID(req *http.Request) *http.Request {
+	ctx := context.WithValue(req.Context(), connIDContextKey{}, newSessionID())
+	if requestID := req.Header.Get(RequestIDHeader); requestID != "" && len(requestID) <= maxRequestIDLen {
+		ctx = context.WithValue(ctx, requestIDContextKey{}, requestID)
+	}
+	return req.WithContext(ctx)
+}
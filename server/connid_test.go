@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/gwst/client"
+)
+
+func TestConnIDHeader(t *testing.T) {
+	target := echoTarget(t)
+	seen := make(chan [2]string, 2)
+	h := NewHandler("", WithGetTarget(func(req *http.Request) (string, []string, error) {
+		seen <- [2]string{ConnIDFromContext(req.Context()), RequestIDFromContext(req.Context())}
+		return target, nil, nil
+	}))
+	url := startHandler(t, h)
+
+	header := http.Header{RequestIDHeader: {"req-42"}}
+	first := upgradeResponse(t, url, header).Header.Get(ConnIDHeader)
+	second := upgradeResponse(t, url, nil).Header.Get(ConnIDHeader)
+	if first == "" || second == "" || first == second {
+		t.Fatalf("connection ids %q and %q, want two distinct ids", first, second)
+	}
+	if got := <-seen; got != [2]string{first, "req-42"} {
+		t.Fatalf("GetTarget saw ids %q, want %q and the request id", got, first)
+	}
+	if got := <-seen; got != [2]string{second, ""} {
+		t.Fatalf("GetTarget saw ids %q, want %q and no request id", got, second)
+	}
+}
+
+func TestConnIDCallbacks(t *testing.T) {
+	log := newCallbackLog()
+	h := NewHandler(echoTarget(t), log.option())
+	url := startHandler(t, h)
+	header := http.Header{RequestIDHeader: {"req-7"}}
+	resp := upgradeResponse(t, url, header)
+	id := resp.Header.Get(ConnIDHeader)
+	resp.Body.Close()
+	connects, _ := log.wait(t)
+	if len(connects) != 1 || connects[0].ID != id || connects[0].RequestID != "req-7" {
+		t.Fatalf("onConnect saw %+v, want id %q and request id req-7", connects, id)
+	}
+}
+
+func TestClientConnID(t *testing.T) {
+	url := startHandler(t, NewHandler(echoTarget(t)))
+	conn, err := client.Connect(context.Background(), client.WithAddr(strings.TrimPrefix(url, "ws://")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if id := conn.(*client.Conn).ConnID(); id == "" {
+		t.Fatal("client did not get a connection id")
+	}
+}
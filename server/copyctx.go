@@ -0,0 +1,15 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/zijiren233/gwst/internal/wire"
+)
+
+// CopyWithContext is CopyBufferWithWriteTimeout that stops when ctx is done,
+// returning ctx.Err(); see wire.CopyWithContext.
+func CopyWithContext(ctx context.Context, dst deadlineWriter, src io.Reader, buf []byte, timeout time.Duration) (int64, error) {
+	return wire.CopyWithContext(ctx, dst, src, buf, timeout)
+}
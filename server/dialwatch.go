@@ -0,0 +1,55 @@
+package main
+
+// clientWatch reads ahead from the client while the target is dialed, so
+// that the client closing or failing cancels the dial instead of leaving it
+// to run until the dial timeout. Read returns what was read ahead before
+// reading on from the frame reader.
+type clientWatch struct {
+	fr   *frameReader
+	done chan struct{}
+	buf  []byte
+	err  error
+}
+
+func watchClient(s *session, fr *frameReader) *clientWatch {
+	w := &clientWatch{fr: fr, done: make(chan struct{}), buf: make([]byte, SmallBufferSize)}
+	go func() {
+		defer close(w.done)
+		n, err := fr.Read(w.buf)
+		w.buf, w.err = w.buf[:n], err
+		// A half-close still wants its data delivered, a protocol error is
+		// reported by the relay with its own close status, and a resumable
+		// session that lost its transport is parked once dialed.
+		_, _, protocolErr := readErrorClose(err)
+		if err == nil || fr.eof || protocolErr {
+			return
+		}
+		if fr.closeErr == nil && resumeFromContext(s.req) != nil {
+			return
+		}
+		s.cancel()
+	}()
+	return w
+}
+
+// wait returns once the read ahead has ended.
+func (w *clientWatch) wait() {
+	<-w.done
+}
+
+func (w *clientWatch) Read(b []byte) (int, error) {
+	if w.done == nil {
+		return w.fr.Read(b)
+	}
+	<-w.done
+	if len(w.buf) > 0 {
+		n := copy(b, w.buf)
+		w.buf = w.buf[n:]
+		return n, nil
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.done = nil
+	return w.fr.Read(b)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dnsFailureCooldown    = 5 * time.Second
+	dnsMaxFailureCooldown = time.Minute
+)
+
+// WithHandlerDNSCacheFor caches target hostname lookups for d. The system
+// resolver does not report record TTLs, so d applies to every name whatever
+// its TTL; keep it at or below the shortest TTL of the targets. A failed dial
+// evicts the name early. Sessions rotate round-robin across the returned IPs,
+// and an IP that failed to connect is tried last until its cooldown, doubling
+// with each consecutive failure, expires.
+func WithHandlerDNSCacheFor(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.dnsCacheFor = d
+	}
+}
+
+type dnsEntry struct {
+	expires time.Time
+	ips     []net.IP
+	next    atomic.Uint32
+}
+
+type ipFailure struct {
+	until    time.Time
+	failures int
+}
+
+type cachingDialer struct {
+	forward  ContextDialer
+	resolver *net.Resolver
+	cache    map[string]*dnsEntry
+	failed   map[string]*ipFailure
+	cacheFor time.Duration
+	mu       sync.Mutex
+}
+
+func newCachingDialer(forward ContextDialer, cacheFor time.Duration) *cachingDialer {
+	return &cachingDialer{
+		forward:  forward,
+		resolver: net.DefaultResolver,
+		cache:    make(map[string]*dnsEntry),
+		failed:   make(map[string]*ipFailure),
+		cacheFor: cacheFor,
+	}
+}
+
+func (d *cachingDialer) lookup(ctx context.Context, host string) (*dnsEntry, error) {
+	d.mu.Lock()
+	entry, ok := d.cache[host]
+	d.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry, nil
+	}
+
+	addrs, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	entry = &dnsEntry{
+		ips:     make([]net.IP, len(addrs)),
+		expires: time.Now().Add(d.cacheFor),
+	}
+	for i, addr := range addrs {
+		entry.ips[i] = addr.IP
+	}
+
+	d.mu.Lock()
+	d.cache[host] = entry
+	d.mu.Unlock()
+	return entry, nil
+}
+
+// order returns the entry's IPs starting at the next rotation offset, with
+// IPs still cooling down after a failure moved to the end.
+func (d *cachingDialer) order(entry *dnsEntry) []net.IP {
+	n := len(entry.ips)
+	start := int(entry.next.Add(1)-1) % n
+	now := time.Now()
+	healthy := make([]net.IP, 0, n)
+	var cooling []net.IP
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := 0; i < n; i++ {
+		ip := entry.ips[(start+i)%n]
+		if f, ok := d.failed[ip.String()]; ok && now.Before(f.until) {
+			cooling = append(cooling, ip)
+			continue
+		}
+		healthy = append(healthy, ip)
+	}
+	return append(healthy, cooling...)
+}
+
+func (d *cachingDialer) markFailed(ip net.IP) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, ok := d.failed[ip.String()]
+	if !ok {
+		f = &ipFailure{}
+		d.failed[ip.String()] = f
+	}
+	f.failures++
+	cooldown := dnsMaxFailureCooldown
+	if f.failures <= 4 {
+		cooldown = min(dnsFailureCooldown<<(f.failures-1), dnsMaxFailureCooldown)
+	}
+	now := time.Now()
+	f.until = now.Add(cooldown)
+
+	for key, f := range d.failed {
+		if now.Sub(f.until) > dnsMaxFailureCooldown {
+			delete(d.failed, key)
+		}
+	}
+}
+
+func (d *cachingDialer) markSuccess(ip net.IP) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.failed, ip.String())
+}
+
+func (d *cachingDialer) evict(host string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.cache, host)
+}
+
+func (d *cachingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.forward.DialContext(ctx, network, addr)
+	}
+
+	entry, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(entry.ips) == 0 {
+		d.evict(host)
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var errs []error
+	for _, ip := range d.order(entry) {
+		conn, err := d.forward.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			d.markSuccess(ip)
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+		d.markFailed(ip)
+	}
+	d.evict(host)
+	return nil, errors.Join(errs...)
+}
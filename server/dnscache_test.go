@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSCache(t *testing.T) {
+	var dialed []string
+	fail := false
+	d := newCachingDialer(dialerFunc(func(_ context.Context, _, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if fail {
+			return nil, errors.New("refused")
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}), time.Minute)
+
+	conn, err := d.DialContext(context.Background(), "tcp", "localhost:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	host, _, _ := net.SplitHostPort(dialed[0])
+	if net.ParseIP(host) == nil {
+		t.Fatalf("dialed %q, want a resolved IP", dialed[0])
+	}
+	entry := d.cache["localhost"]
+	if entry == nil {
+		t.Fatal("lookup not cached")
+	}
+	if left := time.Until(entry.expires); left <= 0 || left > time.Minute {
+		t.Fatalf("entry expires in %v, want within the minute", left)
+	}
+
+	fail = true
+	if _, err := d.DialContext(context.Background(), "tcp", "localhost:80"); err == nil {
+		t.Fatal("dial succeeded")
+	}
+	if _, ok := d.cache["localhost"]; ok {
+		t.Fatal("entry kept after every IP failed")
+	}
+	if len(d.failed) == 0 {
+		t.Fatal("failed IPs not recorded")
+	}
+}
+
+func TestDNSCacheOrder(t *testing.T) {
+	d := newCachingDialer(nil, time.Minute)
+	a, b, c := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")
+	entry := &dnsEntry{ips: []net.IP{a, b, c}}
+	d.markFailed(a)
+	for i := 0; i < 3; i++ {
+		if got := d.order(entry); !got[2].Equal(a) {
+			t.Fatalf("order %v, want %v last", got, a)
+		}
+	}
+	d.markSuccess(a)
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[d.order(entry)[0].String()] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("first IPs %v, want a rotation over all three", seen)
+	}
+}
+
+func TestDNSCacheIPLiteral(t *testing.T) {
+	var dialed string
+	d := newCachingDialer(dialerFunc(func(_ context.Context, _, addr string) (net.Conn, error) {
+		dialed = addr
+		return nil, errors.New("refused")
+	}), time.Minute)
+	_, _ = d.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+	if dialed != "192.0.2.1:80" || len(d.cache) != 0 {
+		t.Fatalf("dialed %q with %d cached names", dialed, len(d.cache))
+	}
+}
+
+// seedDNS caches ips for host as if the resolver had returned them.
+func seedDNS(d *cachingDialer, host string, ips ...string) {
+	entry := &dnsEntry{expires: time.Now().Add(time.Minute)}
+	for _, ip := range ips {
+		entry.ips = append(entry.ips, net.ParseIP(ip))
+	}
+	d.cache[host] = entry
+}
+
+func TestDNSCacheRotationSkipsDeadIP(t *testing.T) {
+	var dialed []string
+	d := newCachingDialer(dialerFunc(func(_ context.Context, _, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == "10.0.0.2:80" {
+			return nil, errors.New("refused")
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}), time.Minute)
+	seedDNS(d, "backend.test", "10.0.0.1", "10.0.0.2", "10.0.0.3")
+
+	var used []string
+	for i := 0; i < 6; i++ {
+		dialed = dialed[:0]
+		conn, err := d.DialContext(context.Background(), "tcp", "backend.test:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		used = append(used, dialed[len(dialed)-1])
+		if i > 1 && dialed[0] == "10.0.0.2:80" {
+			t.Fatalf("dial %d tried the dead IP first: %v", i, dialed)
+		}
+	}
+	// 10.0.0.2 fails on its first turn and then cools down, so sessions
+	// alternate between the other two.
+	counts := map[string]int{}
+	for _, addr := range used {
+		counts[addr]++
+	}
+	if counts["10.0.0.2:80"] != 0 || counts["10.0.0.1:80"] < 2 || counts["10.0.0.3:80"] < 2 {
+		t.Fatalf("sessions used %v", used)
+	}
+}
+
+func TestDNSCacheSessionTargetAddr(t *testing.T) {
+	_, port, _ := net.SplitHostPort(echoTarget(t))
+	log := newCallbackLog()
+	h := NewHandler("localhost:"+port, WithHandlerDNSCacheFor(time.Minute), WithPreflightDial(true), log.option())
+	ws := dialWS(t, startHandler(t, h), nil)
+	ws.Close()
+	connects, _ := log.wait(t)
+	if len(connects) != 1 || connects[0].TargetAddr != "127.0.0.1:"+port {
+		t.Fatalf("onConnect saw %+v, want the resolved address", connects)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Version is reported in echo probe replies. It can be set at build time with
+// -ldflags "-X main.Version=...".
+var Version = "dev"
+
+// EchoProbe is an 8-byte frame that an echo handler answers, instead of
+// echoing it, with EchoProbe followed by the server's Unix time in nanoseconds
+// as a big-endian uint64 and then Version.
+var EchoProbe = []byte("WSTPROBE")
+
+// WithEchoMode echoes every frame back to the client instead of dialing a
+// target, to check that the websocket path works end to end. Auth, origin
+// and limit options apply as usual, including the per-connection rate limit
+// and byte quota, with the echoed bytes counted in both directions. Mount it
+// next to the tunnel with WithHandle.
+func WithEchoMode() HandlerOption {
+	return func(h *Handler) {
+		h.echo = true
+	}
+}
+
+// NewEchoHandler returns a Handler in echo mode; see WithEchoMode.
+func NewEchoHandler(opts ...HandlerOption) *Handler {
+	return NewHandler("", append(opts, WithEchoMode())...)
+}
+
+func echoProbeReply() []byte {
+	reply := make([]byte, 0, len(EchoProbe)+8+len(Version))
+	reply = append(reply, EchoProbe...)
+	reply = binary.BigEndian.AppendUint64(reply, uint64(time.Now().UnixNano()))
+	return append(reply, Version...)
+}
+
+func (h *Handler) handleEcho(s *session) {
+	defer s.recoverPanic()
+	fr := newFrameReader(s.ws)
+	fr.lastFrame = &s.lastFrame
+	fr.waitSince = &s.readWait
+	fr.pinger = &s.pinger
+	fr.maxSize = h.maxMessageSize
+	fr.text = h.isTextMode(s.ws.Config())
+	fr.wire = &s.wireUp
+	var dst deadlineWriter = &countingWriter{deadlineWriter: h.wsWriter(s), n: &s.wireDown}
+	if fr.text {
+		s.ws.PayloadType = websocket.TextFrame
+		dst = &base64Writer{deadlineWriter: dst}
+	}
+	dst = s.meter(dst, &s.bytesDown, peerClient)
+	upLimit, downLimit := s.rateLimiters()
+	src := s.limit(s.track(fr, peerClient), upLimit)
+	upQuota := s.countsQuota(&s.bytesUp)
+
+	// fr never returns data spanning frames, so each read is echoed as one
+	// frame unless the frame is larger than the buffer.
+	buffer := getBuffer(s.pools.all)
+	defer putBuffer(s.pools.all, buffer)
+	for {
+		n, err := src.Read(*buffer)
+		if n > 0 {
+			if upQuota && !s.takeQuota(n) {
+				s.abort(ClosePolicyViolation, ErrQuotaExceeded.Error())
+				return
+			}
+			s.bytesUp.Add(int64(n))
+			msg := (*buffer)[:n]
+			if bytes.Equal(msg, EchoProbe) {
+				msg = echoProbeReply()
+			}
+			if downLimit != nil && downLimit.wait(s.ctx, len(msg)) != nil {
+				s.abort(CloseGoingAway, "echo canceled")
+				return
+			}
+			if h.downWriteTimeout > 0 {
+				_ = dst.SetWriteDeadline(time.Now().Add(h.downWriteTimeout))
+			}
+			if _, err := dst.Write(msg); err != nil {
+				if !errors.Is(err, ErrQuotaExceeded) {
+					s.abort(CloseInternalError, "echo write failed")
+				}
+				return
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if fr.closeErr != nil {
+			s.setClientClose(fr.closeErr)
+		}
+		if code, reason, ok := readErrorClose(err); ok {
+			s.abort(code, reason)
+			return
+		}
+		switch {
+		case err == io.EOF && fr.eof && s.halfClosing():
+			_ = writeHalfClose(s.ws)
+			s.abort(CloseNormalClosure, "client closed")
+		case err == io.EOF:
+			s.abort(CloseNormalClosure, "client closed")
+		default:
+			s.abort(CloseInternalError, "client relay failed")
+		}
+		return
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zijiren233/gwst/client"
+	"golang.org/x/net/websocket"
+)
+
+func TestEchoHandler(t *testing.T) {
+	url := startHandler(t, NewEchoHandler())
+	conn, err := client.NewDialer(client.WithAddr(strings.TrimPrefix(url, "ws://"))).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := bytes.Repeat([]byte("0123456789"), 1000)
+	go func() { _, _ = conn.Write(msg) }()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("echo differs from what was sent")
+	}
+}
+
+func TestEchoProbe(t *testing.T) {
+	ws := dialWS(t, startHandler(t, NewEchoHandler()), nil)
+	sendBinary(t, ws, EchoProbe)
+	f := readFrame(t, ws)
+	if !bytes.HasPrefix(f.payload, EchoProbe) || string(f.payload[len(EchoProbe)+8:]) != Version {
+		t.Fatalf("probe reply %q", f.payload)
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(f.payload[len(EchoProbe):])))
+	if d := time.Since(sent); d < 0 || d > time.Minute {
+		t.Fatalf("probe time off by %v", d)
+	}
+}
+
+func TestEchoByteQuota(t *testing.T) {
+	// 600 bytes up fit the 1000 but their echo does not, so it is not sent.
+	ws := dialWS(t, startHandler(t, NewEchoHandler(WithByteQuota(1000))), nil)
+	sendBinary(t, ws, make([]byte, 600))
+	var got int
+	for {
+		f := readFrame(t, ws)
+		if f.opcode == websocket.CloseFrame {
+			if code := closeCode(parseClosePayload(f.payload)); code != ClosePolicyViolation {
+				t.Fatalf("close code %d, want %d", code, ClosePolicyViolation)
+			}
+			break
+		}
+		got += len(f.payload)
+	}
+	if got != 0 {
+		t.Fatalf("echoed %d bytes of a frame over the quota", got)
+	}
+}
+
+func TestEchoRateLimit(t *testing.T) {
+	ws := dialWS(t, startHandler(t, NewEchoHandler(WithPerConnRateLimit(10000, 1000))), nil)
+	start := time.Now()
+	go func() {
+		for i := 0; i < 5; i++ {
+			_ = websocket.Message.Send(ws, make([]byte, 1000))
+		}
+	}()
+	var got int
+	for got < 5000 {
+		got += len(readFrame(t, ws).payload)
+	}
+	// The first 1000 bytes are the burst; the rest come at 10000 per second.
+	if d := time.Since(start); d < 350*time.Millisecond {
+		t.Fatalf("echoed 5000 bytes in %v, faster than the rate limit", d)
+	}
+}
+
+func TestServerWithHandle(t *testing.T) {
+	addr := make(chan net.Addr, 1)
+	srv := NewServer("127.0.0.1:0", "/ws", NewHandler(echoTarget(t)),
+		WithHandle("/echo", NewEchoHandler()),
+		WithOnListen(func(a net.Addr) { addr <- a }),
+	)
+	go func() { _ = srv.Serve() }()
+	// Registered first so that it runs after the websockets are closed.
+	t.Cleanup(func() { _ = srv.Close() })
+	base := "ws://" + (<-addr).String()
+
+	for _, path := range []string{"/ws", "/echo"} {
+		ws := dialWS(t, base+path, nil)
+		sendBinary(t, ws, []byte("hi"))
+		if f := readFrame(t, ws); string(f.payload) != "hi" {
+			t.Fatalf("%s: got %q", path, f.payload)
+		}
+		if path == "/echo" {
+			sendBinary(t, ws, EchoProbe)
+			if f := readFrame(t, ws); !bytes.HasPrefix(f.payload, EchoProbe) || len(f.payload) == len(EchoProbe) {
+				t.Fatalf("/echo did not answer the probe: %q", f.payload)
+			}
+		}
+	}
+}
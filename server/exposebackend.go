@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/websocket"
+)
+
+// backendInfoPrefix starts the payload of the unsolicited pong frame that
+// tells the client which backend it was connected to.
+const backendInfoPrefix = "wst-backend "
+
+var pongCodec = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		payload, _ := v.([]byte)
+		return payload, websocket.PongFrame, nil
+	},
+}
+
+// WithHandlerExposeBackend tells clients which backend serves their session,
+// for diagnostics in multi-backend setups. Once the target is connected, the
+// server sends an unsolicited pong frame carrying its remote and local
+// address and, if it fits, the target as configured. Clients that do not
+// look for it, browsers included, ignore it. It is off by default because it
+// reveals the network topology.
+func WithHandlerExposeBackend() HandlerOption {
+	return func(h *Handler) {
+		h.exposeBackend = true
+	}
+}
+
+func (s *session) sendBackendInfo(conn net.Conn) error {
+	info := backendInfoPrefix + conn.RemoteAddr().String() + " " + conn.LocalAddr().String()
+	// Control frame payloads are limited to 125 bytes.
+	if len(info)+1+len(s.target) <= 125 {
+		info += " " + s.target
+	}
+	if len(info) > 125 {
+		return nil
+	}
+	return pongCodec.Send(s.ws, []byte(info))
+}
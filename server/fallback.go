@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// WithFallbackHandler passes requests that are not valid websocket upgrades
+// to fallback, such as a static page or a 404, instead of answering with the
+// websocket error that would reveal the tunnel. The check runs before any
+// limit, auth or upgrade handling.
+func WithFallbackHandler(fallback http.Handler) HandlerOption {
+	return func(h *Handler) {
+		h.fallback = fallback
+	}
+}
+
+// WithFallbackOnAuthFailure serves the fallback handler instead of 401 when
+// authentication fails, so probing with bad credentials looks the same as a
+// plain request.
+func WithFallbackOnAuthFailure() HandlerOption {
+	return func(h *Handler) {
+		h.fallbackOnAuth = true
+	}
+}
+
+// isUpgradeRequest reports whether req meets the websocket upgrade
+// preconditions checked by x/net/websocket.
+func isUpgradeRequest(req *http.Request) bool {
+	return req.Method == http.MethodGet &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket") &&
+		headerHasToken(req.Header, "Connection", "upgrade") &&
+		req.Header.Get("Sec-WebSocket-Key") != "" &&
+		req.Header.Get("Sec-WebSocket-Version") == "13"
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
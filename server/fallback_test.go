@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var welcomePage = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Server", "nginx")
+	_, _ = io.WriteString(w, "Welcome to nginx!")
+})
+
+// fetch sends a request with method and header to the http URL of url.
+func fetch(t *testing.T, method, url string, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, "http"+strings.TrimPrefix(url, "ws"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestFallbackHandler(t *testing.T) {
+	target, dials := countingTarget(t)
+	url := startHandler(t, NewHandler(target, WithFallbackHandler(welcomePage)))
+	for _, tc := range []struct {
+		name   string
+		method string
+		header http.Header
+	}{
+		{"GET", http.MethodGet, nil},
+		{"HEAD", http.MethodHead, nil},
+		{"POST upgrade", http.MethodPost, http.Header{
+			"Connection": {"Upgrade"}, "Upgrade": {"websocket"},
+			"Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="}, "Sec-Websocket-Version": {"13"},
+		}},
+		{"no key", http.MethodGet, http.Header{
+			"Connection": {"Upgrade"}, "Upgrade": {"websocket"}, "Sec-Websocket-Version": {"13"},
+		}},
+		{"old version", http.MethodGet, http.Header{
+			"Connection": {"Upgrade"}, "Upgrade": {"websocket"},
+			"Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="}, "Sec-Websocket-Version": {"8"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := fetch(t, tc.method, url, tc.header)
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Server") != "nginx" {
+				t.Fatalf("status %d, Server %q; want the fallback", resp.StatusCode, resp.Header.Get("Server"))
+			}
+		})
+	}
+	if dials.Load() != 0 {
+		t.Fatal("target dialed for a fallback request")
+	}
+	echoOnce(t, url)
+}
+
+func TestFallbackOnAuthFailure(t *testing.T) {
+	h := NewHandler(echoTarget(t),
+		WithAuthToken("secret"),
+		WithFallbackHandler(welcomePage),
+		WithFallbackOnAuthFailure(),
+	)
+	resp := upgradeResponse(t, startHandler(t, h), nil)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "Welcome to nginx!" {
+		t.Fatalf("status %d, body %q; want the fallback instead of 401", resp.StatusCode, body)
+	}
+}
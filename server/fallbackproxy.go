@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+type FallbackProxyOption func(*fallbackProxy)
+
+type fallbackProxy struct {
+	tlsConfig      *tls.Config
+	rewrite        func(*httputil.ProxyRequest)
+	errorHandler   func(http.ResponseWriter, *http.Request, error)
+	rejectUpgrades bool
+}
+
+// WithFallbackProxyTLS sets the TLS config used for https origins.
+func WithFallbackProxyTLS(cfg *tls.Config) FallbackProxyOption {
+	return func(p *fallbackProxy) {
+		p.tlsConfig = cfg
+	}
+}
+
+// WithFallbackProxyRewrite runs fn on each outbound request after it has been
+// pointed at the origin, for example to adjust headers or call SetXForwarded.
+func WithFallbackProxyRewrite(fn func(*httputil.ProxyRequest)) FallbackProxyOption {
+	return func(p *fallbackProxy) {
+		p.rewrite = fn
+	}
+}
+
+// WithFallbackProxyErrorHandler replaces the plain 502 response written when
+// the origin cannot be reached.
+func WithFallbackProxyErrorHandler(fn func(http.ResponseWriter, *http.Request, error)) FallbackProxyOption {
+	return func(p *fallbackProxy) {
+		p.errorHandler = fn
+	}
+}
+
+// WithFallbackProxyRejectUpgrades answers upgrade requests with 400 instead of
+// passing them through to the origin.
+func WithFallbackProxyRejectUpgrades() FallbackProxyOption {
+	return func(p *fallbackProxy) {
+		p.rejectUpgrades = true
+	}
+}
+
+// NewFallbackProxy returns a reverse proxy to the origin at target, with the
+// Host header rewritten to the origin's. It can be mounted on the paths next
+// to the tunnel so that the whole host mirrors the origin site.
+func NewFallbackProxy(target *url.URL, opts ...FallbackProxyOption) http.Handler {
+	if target == nil || target.Scheme == "" || target.Host == "" {
+		panic("wst: fallback proxy target must be an absolute url")
+	}
+	p := &fallbackProxy{}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if p.tlsConfig != nil {
+		transport.TLSClientConfig = p.tlsConfig
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			if p.rewrite != nil {
+				p.rewrite(pr)
+			}
+		},
+		Transport:    transport,
+		ErrorHandler: p.errorHandler,
+	}
+	if rp.ErrorHandler == nil {
+		rp.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, _ error) {
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		}
+	}
+	if !p.rejectUpgrades {
+		return rp
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if headerHasToken(req.Header, "Connection", "upgrade") {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		rp.ServeHTTP(w, req)
+	})
+}
+
+// WithFallbackProxy serves requests that are not websocket upgrades by
+// reverse proxying them to target, as with WithFallbackHandler.
+func WithFallbackProxy(target *url.URL, opts ...FallbackProxyOption) HandlerOption {
+	return WithFallbackHandler(NewFallbackProxy(target, opts...))
+}
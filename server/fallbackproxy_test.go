@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// originHandler answers with the Host and path it received.
+var originHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-Origin-Header", req.Header.Get("X-Added"))
+	fmt.Fprintf(w, "%s %s", req.Host, req.URL.Path)
+})
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestFallbackProxy(t *testing.T) {
+	origin := httptest.NewServer(originHandler)
+	t.Cleanup(origin.Close)
+	originURL := mustParseURL(t, origin.URL)
+
+	h := NewHandler(echoTarget(t), WithFallbackProxy(originURL,
+		WithFallbackProxyRewrite(func(pr *httputil.ProxyRequest) {
+			pr.Out.Header.Set("X-Added", "rewritten")
+		}),
+	))
+	url := startHandler(t, h)
+	resp := fetch(t, http.MethodGet, url+"/index.html", nil)
+	if body := readBody(t, resp); body != originURL.Host+" /index.html" {
+		t.Fatalf("origin saw %q, want its own host and the path", body)
+	}
+	if got := resp.Header.Get("X-Origin-Header"); got != "rewritten" {
+		t.Fatalf("rewrite not applied: %q", got)
+	}
+	echoOnce(t, url)
+}
+
+func TestFallbackProxyTLSOrigin(t *testing.T) {
+	origin := httptest.NewTLSServer(originHandler)
+	t.Cleanup(origin.Close)
+	cfg := origin.Client().Transport.(*http.Transport).TLSClientConfig
+	url := startHandler(t, NewHandler(echoTarget(t),
+		WithFallbackProxy(mustParseURL(t, origin.URL), WithFallbackProxyTLS(cfg)),
+	))
+	resp := fetch(t, http.MethodGet, url+"/tls", nil)
+	if body := readBody(t, resp); !strings.HasSuffix(body, "/tls") {
+		t.Fatalf("status %d, body %q", resp.StatusCode, body)
+	}
+}
+
+func TestFallbackProxyOriginDown(t *testing.T) {
+	origin := httptest.NewServer(originHandler)
+	originURL := mustParseURL(t, origin.URL)
+	origin.Close()
+
+	url := startHandler(t, NewHandler(echoTarget(t), WithFallbackProxy(originURL)))
+	if resp := fetch(t, http.MethodGet, url, nil); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502", resp.StatusCode)
+	}
+
+	url = startHandler(t, NewHandler(echoTarget(t), WithFallbackProxy(originURL,
+		WithFallbackProxyErrorHandler(func(w http.ResponseWriter, _ *http.Request, _ error) {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+		}),
+	)))
+	resp := fetch(t, http.MethodGet, url, nil)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "maintenance") {
+		t.Fatalf("status %d, body %q; want the custom error page", resp.StatusCode, body)
+	}
+}
+
+func TestFallbackProxyUpgrades(t *testing.T) {
+	// The origin serves its own websocket, which the proxy passes through
+	// unless upgrades are rejected.
+	origin := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) { _, _ = io.Copy(ws, ws) }))
+	t.Cleanup(origin.Close)
+	proxy := httptest.NewServer(NewFallbackProxy(mustParseURL(t, origin.URL)))
+	t.Cleanup(proxy.Close)
+	echoOnce(t, "ws"+strings.TrimPrefix(proxy.URL, "http")+"/origin-ws")
+
+	rejecting := httptest.NewServer(NewFallbackProxy(mustParseURL(t, origin.URL), WithFallbackProxyRejectUpgrades()))
+	t.Cleanup(rejecting.Close)
+	if resp := upgradeResponse(t, "ws"+strings.TrimPrefix(rejecting.URL, "http"), nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// RemoteForwarder exposes websocket tunnels on a local TCP listener, like
+// ssh -R. Each tunnel accepted from Handler, which must use
+// WithManualAccept, is paired with the next connection accepted on
+// ListenAddr.
+//
+// Paired with the client's LocalForwarder, a process connecting to the
+// client's listen address reaches whichever process connects to ListenAddr
+// on the server side.
+type RemoteForwarder struct {
+	Handler    *Handler
+	ListenAddr string
+
+	mu     sync.Mutex
+	ln     net.Listener
+	closed bool
+}
+
+func (f *RemoteForwarder) Serve() error {
+	ln, err := net.Listen("tcp", f.ListenAddr)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		ln.Close()
+		return net.ErrClosed
+	}
+	f.ln = ln
+	f.mu.Unlock()
+	defer ln.Close()
+
+	// A connection accepted while its tunnel went away is kept for the next
+	// tunnel.
+	var conn net.Conn
+	for {
+		t, err := f.Handler.Accept()
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			if errors.Is(err, ErrHandlerClosed) {
+				return nil
+			}
+			return err
+		}
+		if conn == nil {
+			if conn, err = f.accept(ln); err != nil {
+				t.Close()
+				if f.isClosed() {
+					return nil
+				}
+				return err
+			}
+		}
+		if t.s.ctx.Err() != nil {
+			t.Close()
+			continue
+		}
+		go t.PipeConn(conn)
+		conn = nil
+	}
+}
+
+func (f *RemoteForwarder) accept(ln net.Listener) (net.Conn, error) {
+	for {
+		conn, err := ln.Accept()
+		var ne net.Error
+		if err != nil && errors.As(err, &ne) && ne.Timeout() {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		return conn, err
+	}
+}
+
+// Addr returns the listening address, or nil before Serve has started.
+func (f *RemoteForwarder) Addr() net.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ln == nil {
+		return nil
+	}
+	return f.ln.Addr()
+}
+
+func (f *RemoteForwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.ln == nil {
+		return nil
+	}
+	return f.ln.Close()
+}
+
+func (f *RemoteForwarder) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+type forwardedElement struct {
+	For   string
+	Proto string
+	Host  string
+	By    string
+}
+
+func parseForwarded(values []string) []forwardedElement {
+	var elements []forwardedElement
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			var fe forwardedElement
+			for _, pair := range splitQuoted(element, ';') {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				val = unquote(strings.TrimSpace(val))
+				switch strings.ToLower(strings.TrimSpace(key)) {
+				case "for":
+					fe.For = val
+				case "proto":
+					fe.Proto = strings.ToLower(val)
+				case "host":
+					fe.Host = val
+				case "by":
+					fe.By = val
+				}
+			}
+			elements = append(elements, fe)
+		}
+	}
+	return elements
+}
+
+func splitQuoted(s string, sep byte) []string {
+	var (
+		parts   []string
+		quoted  bool
+		escaped bool
+		start   int
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\' && quoted:
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func parseForwardedNode(node string) (netip.Addr, bool) {
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return netip.Addr{}, false
+		}
+		node = node[1:end]
+	} else if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	addr, err := netip.ParseAddr(node)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,30 @@
+package main
+
+// WithMaxFrameSize caps the payload of each websocket frame written to the
+// client at n bytes, splitting larger writes. x/net/websocket cannot emit
+// continuation frames, so each piece is a complete binary frame; this is
+// transparent to tunnel peers, which treat the frames as one byte stream.
+func WithMaxFrameSize(n int) HandlerOption {
+	return func(h *Handler) {
+		h.maxFrameSize = n
+	}
+}
+
+type frameSplitter struct {
+	deadlineWriter
+	max int
+}
+
+func (w *frameSplitter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b[:min(len(b), w.max)]
+		n, err := w.deadlineWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
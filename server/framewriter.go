@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+type hijackContextKey struct{}
+
+// hijackCapture records the connection taken over by the websocket upgrade,
+// so that data frames can be written to it directly.
+type hijackCapture struct {
+	http.ResponseWriter
+	conn net.Conn
+	// wmu serializes the frames written by frameWriter with the writes of
+	// x/net/websocket.
+	wmu sync.Mutex
+}
+
+func (w *hijackCapture) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	w.conn = conn
+	rw.Writer.Reset(&lockedWriter{w: conn, mu: &w.wmu})
+	return conn, rw, nil
+}
+
+// lockedWriter takes mu for each Write. x/net/websocket flushes every frame
+// it writes, and the control frames it writes while data frames bypass it
+// are small enough for a single flush, so they do not interleave.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+func (w *lockedWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(b)
+}
+
+func (w *hijackCapture) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// upgrade runs the websocket upgrade, capturing the hijacked connection.
+func (h *Handler) upgrade(w http.ResponseWriter, req *http.Request) {
+	hc := &hijackCapture{ResponseWriter: w}
+	h.wsServer.ServeHTTP(hc, req.WithContext(context.WithValue(req.Context(), hijackContextKey{}, hc)))
+}
+
+// frameWriter writes each Write as one unmasked websocket frame straight to
+// the connection: header and payload go out in a single writev on plain
+// sockets, or in a single Write, and so a single TLS record, otherwise.
+// x/net/websocket instead writes them separately through its bufio.Writer,
+// copying the payload. Each frame is written holding the lock that the
+// writes of x/net/websocket take, so control frames cannot interleave.
+type frameWriter struct {
+	ws       *websocket.Conn
+	conn     net.Conn
+	mu       *sync.Mutex
+	vectored bool
+	header   [10]byte
+	bufs     [2][]byte
+}
+
+// wsWriter returns the writer for data frames toward the client.
+func (h *Handler) wsWriter(s *session) deadlineWriter {
+	hc, ok := s.ws.Request().Context().Value(hijackContextKey{}).(*hijackCapture)
+	if !ok || hc.conn == nil {
+		return s.ws
+	}
+	w := &frameWriter{ws: s.ws, conn: hc.conn, mu: &hc.wmu}
+	switch hc.conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		w.vectored = true
+	}
+	return w
+}
+
+func (w *frameWriter) SetWriteDeadline(t time.Time) error {
+	return w.conn.SetWriteDeadline(t)
+}
+
+func (w *frameWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		// An empty frame would signal half-close.
+		return 0, nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	header := appendFrameHeader(w.header[:0], w.ws.PayloadType, len(b))
+	if w.vectored {
+		w.bufs = [2][]byte{header, b}
+		bufs := net.Buffers(w.bufs[:])
+		n, err := bufs.WriteTo(w.conn)
+		w.bufs = [2][]byte{}
+		return max(int(n)-len(header), 0), err
+	}
+	buffer, _ := frameScratch.Get().(*[]byte)
+	if buffer == nil {
+		buffer = new([]byte)
+	}
+	frame := append(append((*buffer)[:0], header...), b...)
+	n, err := w.conn.Write(frame)
+	*buffer = frame
+	frameScratch.Put(buffer)
+	return max(n-len(header), 0), err
+}
+
+// frameScratch holds the buffers frameWriter assembles frames in when it
+// cannot use writev. They are kept apart from the copy buffer pools so as
+// not to skew their stats.
+var frameScratch sync.Pool
+
+func appendFrameHeader(header []byte, opcode byte, length int) []byte {
+	header = append(header, 0x80|opcode)
+	switch {
+	case length <= 125:
+		return append(header, byte(length))
+	case length < 1<<16:
+		return binary.BigEndian.AppendUint16(append(header, 126), uint16(length))
+	default:
+		return binary.BigEndian.AppendUint64(append(header, 127), uint64(length))
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestFrameWriterWithConcurrentPings(t *testing.T) {
+	const size = 4 << 20
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	target := startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		for b := data; len(b) > 0; b = b[min(len(b), 1000):] {
+			if _, err := conn.Write(b[:min(len(b), 1000)]); err != nil {
+				return
+			}
+		}
+		// Stay open so that pings continue while the client reads.
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	url := startHandler(t, NewHandler(target, WithPingInterval(time.Millisecond), WithPongTimeout(time.Minute)))
+	ws := dialWS(t, url, nil)
+
+	var got []byte
+	for len(got) < size {
+		f := readFrame(t, ws)
+		if f.opcode != websocket.BinaryFrame {
+			t.Fatalf("got opcode %d after %d bytes", f.opcode, len(got))
+		}
+		got = append(got, f.payload...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("relayed data corrupted")
+	}
+}
+
+func TestFrameWriterLeavesBufferPools(t *testing.T) {
+	// Frames assembled for a single Write do not come from the copy buffer
+	// pools, whose stats the handler reports.
+	gets := func() (n int64) {
+		bufferPools.Range(func(_, p any) bool {
+			n += p.(*bufferPool).gets.Load()
+			return true
+		})
+		return n
+	}
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+	w := &frameWriter{ws: &websocket.Conn{PayloadType: websocket.BinaryFrame}, conn: conn, mu: new(sync.Mutex)}
+	before := gets()
+	for _, size := range []int{1, 200, 5000, 70000} {
+		if n, err := w.Write(make([]byte, size)); err != nil || n != size {
+			t.Fatalf("wrote %d of %d bytes: %v", n, size, err)
+		}
+	}
+	if after := gets(); after != before {
+		t.Fatalf("copy buffer pools saw %d gets from frame writes", after-before)
+	}
+}
+
+// benchmarkFrameWriter writes 16 KiB frames over a connection from dial,
+// whose peer discards them.
+func benchmarkFrameWriter(b *testing.B, vectored bool, wrap func(net.Conn) net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := <-accepted
+	conn := wrap(server)
+	defer conn.Close()
+	peer := wrapPeer(client, conn)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(io.Discard, peer)
+	}()
+
+	w := &frameWriter{
+		ws:       &websocket.Conn{PayloadType: websocket.BinaryFrame},
+		conn:     conn,
+		mu:       new(sync.Mutex),
+		vectored: vectored,
+	}
+	chunk := make([]byte, 16<<10)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	conn.Close()
+	<-done
+}
+
+// wrapPeer returns the client side matching conn: a TLS client if conn is a
+// TLS server.
+func wrapPeer(client, conn net.Conn) net.Conn {
+	if _, ok := conn.(*tls.Conn); ok {
+		return tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	}
+	return client
+}
+
+func BenchmarkFrameWriter16K(b *testing.B) {
+	plain := func(conn net.Conn) net.Conn { return conn }
+	b.Run("tcp-writev", func(b *testing.B) { benchmarkFrameWriter(b, true, plain) })
+	b.Run("tcp-copy", func(b *testing.B) { benchmarkFrameWriter(b, false, plain) })
+	b.Run("tls", func(b *testing.B) {
+		srvCfg, _ := tlsConfigs(b)
+		benchmarkFrameWriter(b, false, func(conn net.Conn) net.Conn { return tls.Server(conn, srvCfg) })
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// HandshakeFunc validates a websocket handshake before the upgrade and may
+// adjust the config; an error rejects the handshake with 403.
+type HandshakeFunc func(*websocket.Config, *http.Request) error
+
+// WithHandlerHandshake replaces the default handshake validator, CheckOrigin,
+// with fn. Use ChainHandshakes to run several, including CheckOrigin. The
+// origin allowlist, OnHandshake and subprotocol selection still run after fn.
+func WithHandlerHandshake(fn HandshakeFunc) HandlerOption {
+	return func(h *Handler) {
+		h.handshakeFn = fn
+	}
+}
+
+// CheckOrigin is the default handshake validator. It parses the Origin
+// header into config.Origin and rejects handshakes without one.
+func CheckOrigin(config *websocket.Config, req *http.Request) error {
+	return checkOrigin(config, req)
+}
+
+// ChainHandshakes returns a HandshakeFunc running fns in order and stopping at
+// the first error.
+func ChainHandshakes(fns ...HandshakeFunc) HandshakeFunc {
+	return func(config *websocket.Config, req *http.Request) error {
+		for _, fn := range fns {
+			if err := fn(config, req); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
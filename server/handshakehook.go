@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// HandshakeHook inspects an upgrade once its origin has been checked. Headers
+// added to respHeader are sent with the 101 response, and SetHandshakeValue
+// stashes values for GetTargetFunc and Session.Value. An error rejects the
+// handshake with 403, or with the status of a *HandshakeError.
+type HandshakeHook func(cfg *websocket.Config, req *http.Request, respHeader http.Header) error
+
+// HandshakeError rejects a handshake with StatusCode.
+type HandshakeError struct {
+	Err        error
+	StatusCode int
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake rejected (%d): %v", e.StatusCode, e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// WithHandshakeHook runs fn before the upgrade, after the origin checks and
+// OnHandshake and before GetTargetFunc and subprotocol selection.
+func WithHandshakeHook(fn HandshakeHook) HandlerOption {
+	return func(h *Handler) {
+		h.handshakeHook = fn
+	}
+}
+
+// SetHandshakeValue stores value under key in the context of req, which a
+// HandshakeHook uses to pass data to GetTargetFunc and the session.
+func SetHandshakeValue(req *http.Request, key, value any) {
+	*req = *req.WithContext(context.WithValue(req.Context(), key, value))
+}
+
+// Value returns the value stored under key in the handshake request context.
+func (s Session) Value(key any) any {
+	if s.ctx == nil {
+		return nil
+	}
+	return s.ctx.Value(key)
+}
+
+type checkedHandshakeKey struct{}
+
+// checkHandshake runs the handshake checks and the HandshakeHook before the
+// upgrade, so that a rejection can be answered with any status. The upgrade
+// then takes the subprotocols and response headers from the checked config.
+func (h *Handler) checkHandshake(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	config := &websocket.Config{
+		Version:  websocket.ProtocolVersionHybi13,
+		Protocol: offeredProtocols(req),
+		Header:   make(http.Header),
+	}
+	if err := h.validateHandshake(config, req); err != nil {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return req, false
+	}
+	if err := h.runOnHandshake(req); err != nil {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return req, false
+	}
+	if err := h.handshakeHook(config, req, config.Header); err != nil {
+		status := http.StatusForbidden
+		var he *HandshakeError
+		if errors.As(err, &he) && he.StatusCode != 0 {
+			status = he.StatusCode
+		}
+		h.logRejected(req, status, err.Error())
+		h.metrics.Handshake(HandshakeRejectedHook)
+		http.Error(w, http.StatusText(status), status)
+		return req, false
+	}
+	return req.WithContext(context.WithValue(req.Context(), checkedHandshakeKey{}, config)), true
+}
+
+func checkedHandshake(req *http.Request) *websocket.Config {
+	config, _ := req.Context().Value(checkedHandshakeKey{}).(*websocket.Config)
+	return config
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestHandshakeHookRejects(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{errors.New("denied"), http.StatusForbidden},
+		{&HandshakeError{Err: errors.New("slow down"), StatusCode: http.StatusTooManyRequests}, http.StatusTooManyRequests},
+		{&HandshakeError{Err: errors.New("gone"), StatusCode: http.StatusNotFound}, http.StatusNotFound},
+	} {
+		target, dials := countingTarget(t)
+		h := NewHandler(target,
+			WithPreflightDial(true),
+			WithHandshakeHook(func(*websocket.Config, *http.Request, http.Header) error { return tc.err }),
+		)
+		resp := upgradeResponse(t, startHandler(t, h), nil)
+		if resp.StatusCode != tc.want {
+			t.Errorf("%v: status = %d, want %d", tc.err, resp.StatusCode, tc.want)
+		}
+		if n := dials.Load(); n != 0 {
+			t.Errorf("%v: target dialed %d times", tc.err, n)
+		}
+	}
+}
+
+func TestHandshakeHookResponseHeader(t *testing.T) {
+	h := NewHandler(echoTarget(t), WithHandshakeHook(func(_ *websocket.Config, _ *http.Request, respHeader http.Header) error {
+		respHeader.Set("X-Geo", "nl")
+		return nil
+	}))
+	resp := upgradeResponse(t, startHandler(t, h), nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("X-Geo") != "nl" {
+		t.Fatalf("status %d, X-Geo %q", resp.StatusCode, resp.Header.Get("X-Geo"))
+	}
+}
+
+func TestHandshakeHookSubprotocol(t *testing.T) {
+	h := NewHandler(echoTarget(t), WithHandshakeHook(func(cfg *websocket.Config, _ *http.Request, _ http.Header) error {
+		cfg.Protocol = []string{"b"}
+		return nil
+	}))
+	resp := upgradeResponse(t, startHandler(t, h), http.Header{"Sec-Websocket-Protocol": {"a, b"}})
+	if got := resp.Header.Get("Sec-Websocket-Protocol"); got != "b" {
+		t.Fatalf("selected protocol %q, want b", got)
+	}
+}
+
+type tenantKey struct{}
+
+func TestHandshakeHookContext(t *testing.T) {
+	target := echoTarget(t)
+	h := NewHandler("",
+		WithHandshakeHook(func(_ *websocket.Config, req *http.Request, _ http.Header) error {
+			SetHandshakeValue(req, tenantKey{}, req.Header.Get("X-Tenant"))
+			return nil
+		}),
+		WithGetTarget(func(req *http.Request) (string, []string, error) {
+			if req.Context().Value(tenantKey{}) != "acme" {
+				return "", nil, errors.New("unknown tenant")
+			}
+			return target, nil, nil
+		}),
+	)
+	url := startHandler(t, h)
+	if resp := upgradeResponse(t, url, http.Header{"X-Tenant": {"other"}}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown tenant: status = %d, want 404", resp.StatusCode)
+	}
+	ws := dialWS(t, url, http.Header{"X-Tenant": {"acme"}})
+	sendBinary(t, ws, []byte("hi"))
+	if f := readFrame(t, ws); string(f.payload) != "hi" {
+		t.Fatalf("echo = %q", f.payload)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type handshakeSlotKey struct{}
+
+// WithHandlerMaxConcurrentHandshakes bounds how many handshakes may be in
+// flight at once, separately from WithMaxConnections. A handshake holds its
+// slot from authentication until the session starts relaying, which includes
+// the target dial. Excess handshakes wait for up to the queue timeout set by
+// WithHandshakeQueueTimeout and are then rejected with 503.
+func WithHandlerMaxConcurrentHandshakes(n int) HandlerOption {
+	if n <= 0 {
+		panic("wst: max concurrent handshakes must be positive")
+	}
+	return func(h *Handler) {
+		h.handshakeSlots = make(chan struct{}, n)
+	}
+}
+
+// WithHandshakeQueueTimeout makes handshakes over the concurrency limit wait
+// up to d for a slot instead of being rejected immediately.
+func WithHandshakeQueueTimeout(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.handshakeQueueTimeout = d
+	}
+}
+
+// HandshakesInFlight returns the number of handshakes holding a slot.
+func (h *Handler) HandshakesInFlight() int {
+	return len(h.handshakeSlots)
+}
+
+type handshakeSlot struct {
+	h    *Handler
+	once sync.Once
+}
+
+func (s *handshakeSlot) release() {
+	s.once.Do(func() {
+		<-s.h.handshakeSlots
+	})
+}
+
+func (h *Handler) acquireHandshake(req *http.Request) (*handshakeSlot, bool) {
+	select {
+	case h.handshakeSlots <- struct{}{}:
+		return &handshakeSlot{h: h}, true
+	default:
+	}
+	if h.handshakeQueueTimeout <= 0 {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), h.handshakeQueueTimeout)
+	defer cancel()
+	select {
+	case h.handshakeSlots <- struct{}{}:
+		return &handshakeSlot{h: h}, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// endHandshake frees the handshake slot of the session's request, if any.
+func (s *session) endHandshake() {
+	if slot, ok := s.req.Context().Value(handshakeSlotKey{}).(*handshakeSlot); ok {
+		slot.release()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+var errUnexpectedProbeResponse = errors.New("unexpected health check response")
+
+// WithHealthCheck probes every backend each interval, failing a probe that
+// does not complete within timeout. A backend is removed from selection after
+// the consecutive failures set by WithHandlerHealthPolicy and returns once a
+// probe succeeds. The checker stops when the Handler shuts down.
+func WithHealthCheck(interval, timeout time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.healthInterval = interval
+		h.healthTimeout = timeout
+	}
+}
+
+// WithHealthCheckProbe makes health checks write send after connecting and
+// require the response to start with expect, instead of a plain TCP dial.
+func WithHealthCheckProbe(send, expect []byte) HandlerOption {
+	return func(h *Handler) {
+		h.healthSend = send
+		h.healthExpect = expect
+	}
+}
+
+func (h *Handler) startHealthCheck() {
+	if h.balancer == nil || h.healthInterval <= 0 {
+		return
+	}
+	if h.healthTimeout <= 0 {
+		h.healthTimeout = h.targetDialTimeout
+	}
+	// Ejected backends wait for the checker rather than a passive probe.
+	h.balancer.probe = nil
+	go func() {
+		ticker := time.NewTicker(h.healthInterval)
+		defer ticker.Stop()
+		for {
+			for _, b := range h.balancer.backends {
+				if b.probing.CompareAndSwap(false, true) {
+					go h.checkBackend(b)
+				}
+			}
+			select {
+			case <-h.shutdownCh:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (h *Handler) checkBackend(b *backend) {
+	defer b.probing.Store(false)
+	wasHealthy := !b.ejected()
+	err := h.probeBackend(b.addr)
+	b.lastCheck.Store(time.Now().UnixNano())
+	if err != nil {
+		h.balancer.markFailed(b)
+		if wasHealthy && b.ejected() {
+			h.logger.Warn("backend unhealthy",
+				slog.String("backend", b.addr),
+				slog.Int("failures", int(b.failures.Load())),
+				slog.Any("error", err),
+			)
+		}
+		return
+	}
+	h.balancer.markSuccess(b)
+	if !wasHealthy {
+		h.logger.Info("backend recovered", slog.String("backend", b.addr))
+	}
+}
+
+// dialProbe connects to target for a probe, including the TLS handshake that
+// sessions would do, so that a backend only passes if they can use it.
+func (h *Handler) dialProbe(ctx context.Context, target string) (net.Conn, error) {
+	addr, useTLS := parseTarget(target)
+	conn, err := h.dialer.DialContext(ctx, "tcp", addr)
+	cfg := h.targetTLS(addr, useTLS, true)
+	if err != nil || cfg == nil {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %w", ErrTargetTLSHandshake, err)
+	}
+	return tlsConn, nil
+}
+
+func (h *Handler) probeBackend(target string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.healthTimeout)
+	defer cancel()
+	conn, err := h.dialProbe(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if len(h.healthSend) == 0 && len(h.healthExpect) == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if len(h.healthSend) > 0 {
+		if _, err := conn.Write(h.healthSend); err != nil {
+			return err
+		}
+	}
+	resp := make([]byte, len(h.healthExpect))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if !bytes.Equal(resp, h.healthExpect) {
+		return errUnexpectedProbeResponse
+	}
+	return nil
+}
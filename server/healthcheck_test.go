@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProbeBackendTLS(t *testing.T) {
+	addr, cfg := tlsTarget(t)
+	h := NewHandler("",
+		WithHandlerBackends([]string{"tls://" + addr}),
+		WithTargetTLS(cfg),
+		WithHealthCheck(time.Hour, 5*time.Second),
+	)
+	if err := h.probeBackend("tls://" + addr); err != nil {
+		t.Fatalf("probe of a TLS backend: %v", err)
+	}
+
+	plain := startTarget(t, func(conn net.Conn) { conn.Close() })
+	if err := h.probeBackend("tls://" + plain); !errors.Is(err, ErrTargetTLSHandshake) {
+		t.Fatalf("probe of a backend without TLS: %v, want ErrTargetTLSHandshake", err)
+	}
+}
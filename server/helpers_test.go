@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// startTarget runs serve for every connection accepted on a local listener
+// and returns its address.
+func startTarget(t testing.TB, serve func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echoTarget starts a target that echoes until the peer finishes, then closes.
+func echoTarget(t testing.TB) string {
+	return startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	})
+}
+
+// startHandler serves h and returns its websocket URL.
+func startHandler(t testing.TB, h http.Handler) string {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// startServer serves h at /ws on a local Server and returns its websocket
+// URL.
+func startServer(t testing.TB, h *Handler, opts ...ServerOption) string {
+	t.Helper()
+	addr := make(chan net.Addr, 1)
+	srv := NewServer("127.0.0.1:0", "/ws", h, append(opts, WithOnListen(func(a net.Addr) { addr <- a }))...)
+	go func() { _ = srv.Serve() }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return "ws://" + (<-addr).String() + "/ws"
+}
+
+// dialWS connects to url, adding header to the handshake request.
+func dialWS(t testing.TB, url string, header http.Header) *websocket.Conn {
+	t.Helper()
+	ws, err := dialWSErr(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func dialWSErr(url string, header http.Header) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(url, "http://"+strings.TrimPrefix(strings.TrimPrefix(url, "ws://"), "wss://"))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		config.Header[k] = v
+	}
+	return websocket.DialConfig(config)
+}
+
+type wsFrame struct {
+	opcode  byte
+	payload []byte
+}
+
+// readFrame returns the next frame from ws, answering pings on the way.
+func readFrame(t testing.TB, ws *websocket.Conn) wsFrame {
+	t.Helper()
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer ws.SetReadDeadline(time.Time{})
+	for {
+		fr, err := ws.NewFrameReader()
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		opcode := fr.PayloadType()
+		if opcode == websocket.PingFrame || opcode == websocket.PongFrame {
+			if _, err := ws.HandleFrame(fr); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		payload, err := io.ReadAll(fr)
+		if err != nil {
+			t.Fatalf("read frame payload: %v", err)
+		}
+		return wsFrame{opcode: opcode, payload: payload}
+	}
+}
+
+// readClose reads frames until a close frame and returns its code.
+func readClose(t testing.TB, ws *websocket.Conn) int {
+	t.Helper()
+	return readCloseError(t, ws).Code
+}
+
+// readCloseError reads frames until a close frame and returns its status.
+func readCloseError(t testing.TB, ws *websocket.Conn) *CloseError {
+	t.Helper()
+	for {
+		f := readFrame(t, ws)
+		if f.opcode == websocket.CloseFrame {
+			return parseClosePayload(f.payload)
+		}
+	}
+}
+
+func sendBinary(t testing.TB, ws *websocket.Conn, b []byte) {
+	t.Helper()
+	if err := websocket.Message.Send(ws, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// halfCloseHeader negotiates half-close as the wst client does.
+func halfCloseHeader() http.Header {
+	return http.Header{HalfCloseHeader: {"1"}}
+}
+
+// upgradeResponse sends a websocket upgrade request to url and returns the
+// response, closing its connection when the test ends.
+func upgradeResponse(t testing.TB, url string, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, "http"+strings.TrimPrefix(url, "ws"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if req.Header.Get("Origin") == "" {
+		req.Header.Set("Origin", "http://"+req.URL.Host)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// tlsTarget starts a TLS server and returns its address and a client config
+// trusting it.
+func tlsTarget(t testing.TB) (string, *tls.Config) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	// Probes close the connection right after the TLS handshake.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	cfg := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	return srv.Listener.Addr().String(), cfg.Clone()
+}
+
+// tlsConfigs returns a server config with a test certificate and a client
+// config trusting it.
+func tlsConfigs(t testing.TB) (server, client *tls.Config) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+	return srv.TLS.Clone(), srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+}
+
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
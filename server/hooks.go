@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var ErrDialVetoed = errors.New("target dial vetoed")
+
+// Lifecycle hooks run synchronously on the session goroutine in this order:
+//
+//  1. OnHandshake, before the upgrade; an error rejects it with 403. The
+//     WithHandshakeHook hook follows and may reject with another status.
+//  2. The onConnect callback of WithConnectionCallbacks, once upgraded.
+//  3. OnBackendDial, before each target dial attempt; an error closes the
+//     session with 1008 without dialing.
+//  4. OnConnected, once the target is connected.
+//  5. WithHandlerOnClose and onDisconnect, when the session ends.
+//
+// With WithPreflightDial steps 3 and 4 happen before the upgrade, and a vetoed
+// dial is answered with 403. If the dial fails, steps 2 and 5 run before the
+// error response. Only OnHandshake and OnBackendDial can veto the
+// connection.
+
+func WithOnHandshake(fn func(*http.Request) error) HandlerOption {
+	return func(h *Handler) {
+		h.onHandshake = fn
+	}
+}
+
+func WithOnBackendDial(fn func(target string) error) HandlerOption {
+	return func(h *Handler) {
+		h.onBackendDial = fn
+	}
+}
+
+func WithOnConnected(fn func(Session)) HandlerOption {
+	return func(h *Handler) {
+		h.onConnected = fn
+	}
+}
+
+func (h *Handler) vetoDial(target string) error {
+	if h.onBackendDial == nil {
+		return nil
+	}
+	if err := h.onBackendDial(target); err != nil {
+		return fmt.Errorf("%w: %w", ErrDialVetoed, err)
+	}
+	return nil
+}
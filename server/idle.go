@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+func WithIdleTimeout(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.idleTimeout = d
+	}
+}
+
+func (s *session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// startIdleTimer aborts the session once it has been idle for d. The timer is
+// re-armed from its own callback, so mu guards timer against the callback
+// running before AfterFunc returns, and stopped keeps it from re-arming after
+// stop.
+func (s *session) startIdleTimer(d time.Duration) (stop func() bool) {
+	s.touch()
+	var (
+		mu      sync.Mutex
+		timer   *time.Timer
+		stopped bool
+	)
+	mu.Lock()
+	defer mu.Unlock()
+	timer = time.AfterFunc(d, func() {
+		mu.Lock()
+		if stopped {
+			mu.Unlock()
+			return
+		}
+		idle := time.Since(time.Unix(0, s.lastActive.Load()))
+		if idle < d {
+			timer.Reset(d - idle)
+			mu.Unlock()
+			return
+		}
+		mu.Unlock()
+		s.abort(CloseGoingAway, "idle timeout")
+	})
+	return func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		return timer.Stop()
+	}
+}
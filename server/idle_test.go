@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	ws := dialWS(t, startHandler(t, NewHandler(echoTarget(t), WithIdleTimeout(100*time.Millisecond))), nil)
+	start := time.Now()
+	if code := readClose(t, ws); code != CloseGoingAway {
+		t.Fatalf("close code %d, want %d", code, CloseGoingAway)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("closed after %v, before the idle timeout", elapsed)
+	}
+}
+
+func TestIdleTimeoutActivity(t *testing.T) {
+	ws := dialWS(t, startHandler(t, NewHandler(echoTarget(t), WithIdleTimeout(200*time.Millisecond))), nil)
+	for i := 0; i < 6; i++ {
+		sendBinary(t, ws, []byte("ping"))
+		if f := readFrame(t, ws); f.opcode != websocket.BinaryFrame || string(f.payload) != "ping" {
+			t.Fatalf("got frame %d %q, want the echo", f.opcode, f.payload)
+		}
+		time.Sleep(80 * time.Millisecond)
+	}
+	if code := readClose(t, ws); code != CloseGoingAway {
+		t.Fatalf("close code %d, want %d", code, CloseGoingAway)
+	}
+}
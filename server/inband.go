@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/zijiren233/gwst/internal/wire"
+)
+
+// With WithInbandTarget the client names its target in the tunnel rather
+// than in the handshake. Its first message is a big-endian uint16 length
+// followed by that many bytes of UTF-8 "network:address", for example
+// "tcp:db.internal:5432". The server answers with a one-byte InbandStatus
+// message and, if it is InbandOK, relays to the target.
+
+type InbandStatus = wire.InbandStatus
+
+const (
+	InbandOK                 = wire.InbandOK
+	InbandMalformed          = wire.InbandMalformed
+	InbandUnsupportedNetwork = wire.InbandUnsupportedNetwork
+	InbandNotAllowed         = wire.InbandNotAllowed
+	InbandDialFailed         = wire.InbandDialFailed
+	InbandTimeout            = wire.InbandTimeout
+)
+
+const DefaultInbandTargetTimeout = 10 * time.Second
+
+var (
+	errInbandMalformed = errors.New("malformed in-band target")
+	errInbandNetwork   = errors.New("unsupported in-band target network")
+)
+
+// TargetPolicy decides whether a client may connect to address over network
+// with WithInbandTarget; an error rejects it with InbandNotAllowed.
+type TargetPolicy func(network, address string) error
+
+// WithInbandTarget makes each session read its target from the first client
+// message, checked against policy, instead of using the Handler's target,
+// WithGetTarget or the backends. It disables WithPreflightDial, as the target
+// is only known after the upgrade, and does not apply to resumed sessions.
+func WithInbandTarget(policy TargetPolicy) HandlerOption {
+	if policy == nil {
+		panic("wst: nil target policy")
+	}
+	return func(h *Handler) {
+		h.inbandPolicy = policy
+	}
+}
+
+// WithInbandTargetTimeout bounds how long a session waits for the in-band
+// target; it defaults to DefaultInbandTargetTimeout.
+func WithInbandTargetTimeout(d time.Duration) HandlerOption {
+	if d <= 0 {
+		panic("wst: in-band target timeout must be positive")
+	}
+	return func(h *Handler) {
+		h.inbandTimeout = d
+	}
+}
+
+// readInbandTarget sets the session target from the preamble. On failure it
+// answers with the status and aborts the session.
+func (h *Handler) readInbandTarget(s *session, fr *frameReader, text bool) bool {
+	network, address, err := h.readInbandPreamble(s, fr)
+	status := InbandOK
+	var ne net.Error
+	switch {
+	case errors.As(err, &ne) && ne.Timeout():
+		status = InbandTimeout
+	case errors.Is(err, errInbandNetwork):
+		status = InbandUnsupportedNetwork
+	case errors.Is(err, errInbandMalformed):
+		status = InbandMalformed
+	case err != nil:
+		s.setErr(peerClient, err)
+		s.abort(CloseInternalError, "in-band target read failed")
+		return false
+	default:
+		if err = h.inbandPolicy(network, address); err != nil {
+			status = InbandNotAllowed
+		}
+	}
+	if status != InbandOK {
+		s.logger.Warn("in-band target rejected",
+			slog.String("target", address),
+			slog.Any("error", err),
+		)
+		_ = s.writeInbandStatus(status, text)
+		s.abort(ClosePolicyViolation, "in-band target: "+status.String())
+		return false
+	}
+	s.network = network
+	s.setTarget(address)
+	s.fallbackTargets = nil
+	return true
+}
+
+func (h *Handler) readInbandPreamble(s *session, fr *frameReader) (network, address string, err error) {
+	timeout := h.inbandTimeout
+	if timeout == 0 {
+		timeout = DefaultInbandTargetTimeout
+	}
+	_ = s.ws.SetReadDeadline(time.Now().Add(timeout))
+	defer s.ws.SetReadDeadline(time.Time{})
+
+	var size [2]byte
+	if _, err := io.ReadFull(fr, size[:]); err != nil {
+		return "", "", err
+	}
+	n := binary.BigEndian.Uint16(size[:])
+	if n == 0 || n > wire.MaxInbandTarget {
+		return "", "", errInbandMalformed
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(fr, b); err != nil {
+		return "", "", err
+	}
+	// The preamble is a message of its own; data for the target follows in
+	// later messages.
+	if fr.frameHasMore() {
+		return "", "", errInbandMalformed
+	}
+	network, address, ok := strings.Cut(string(b), ":")
+	if !ok || !utf8.Valid(b) {
+		return "", "", errInbandMalformed
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil || strings.Contains(address, "/") {
+		return "", "", errInbandMalformed
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return "", "", errInbandNetwork
+	}
+	return network, address, nil
+}
+
+func (s *session) writeInbandStatus(status InbandStatus, text bool) error {
+	var w deadlineWriter = &countingWriter{deadlineWriter: s.ws, n: &s.wireDown}
+	if text {
+		w = &base64Writer{deadlineWriter: w}
+	}
+	_, err := w.Write([]byte{byte(status)})
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/gwst/client"
+)
+
+func inbandPreamble(target string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(target)))
+	return append(b, target...)
+}
+
+func TestInbandTargetTrailingData(t *testing.T) {
+	h := NewHandler("", WithInbandTarget(func(network, addr string) error { return nil }))
+	ws := dialWS(t, startHandler(t, h), nil)
+	sendBinary(t, ws, append(inbandPreamble("tcp:"+echoTarget(t)), "data"...))
+	if f := readFrame(t, ws); len(f.payload) != 1 || InbandStatus(f.payload[0]) != InbandMalformed {
+		t.Fatalf("status %v, want %v", f.payload, InbandMalformed)
+	}
+	if code := readClose(t, ws); code != ClosePolicyViolation {
+		t.Fatalf("close code %d, want %d", code, ClosePolicyViolation)
+	}
+}
+
+func TestInbandTargetSeparateMessages(t *testing.T) {
+	h := NewHandler("", WithInbandTarget(func(network, addr string) error { return nil }))
+	ws := dialWS(t, startHandler(t, h), nil)
+	sendBinary(t, ws, inbandPreamble("tcp:"+echoTarget(t)))
+	sendBinary(t, ws, []byte("data"))
+	if f := readFrame(t, ws); len(f.payload) != 1 || InbandStatus(f.payload[0]) != InbandOK {
+		t.Fatalf("status %v, want %v", f.payload, InbandOK)
+	}
+	if f := readFrame(t, ws); string(f.payload) != "data" {
+		t.Fatalf("got %q", f.payload)
+	}
+}
+
+func TestConnectOverConnInbandTarget(t *testing.T) {
+	h := NewHandler("", WithInbandTarget(func(network, addr string) error { return nil }))
+	addr := strings.TrimPrefix(startHandler(t, h), "ws://")
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.ConnectOverConn(context.Background(), raw,
+		client.WithAddr(addr),
+		client.WithInbandTarget(echoTarget(t)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("over conn")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("over conn"))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "over conn" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+)
+
+// WithAllowCIDRs only accepts clients whose IP falls within one of cidrs.
+// Bare addresses are treated as single-host prefixes.
+func WithAllowCIDRs(cidrs ...string) HandlerOption {
+	set := newPrefixSet(mustParsePrefixes(cidrs))
+	return func(h *Handler) {
+		h.allowCIDRs = set
+	}
+}
+
+// WithDenyCIDRs rejects clients whose IP falls within one of cidrs. Deny
+// entries take precedence over WithAllowCIDRs.
+func WithDenyCIDRs(cidrs ...string) HandlerOption {
+	set := newPrefixSet(mustParsePrefixes(cidrs))
+	return func(h *Handler) {
+		h.denyCIDRs = set
+	}
+}
+
+// WithIPFilterForwarded evaluates the allow and deny lists against the client
+// IP reported by WithTrustedProxies rather than the peer address.
+func WithIPFilterForwarded() HandlerOption {
+	return func(h *Handler) {
+		h.ipFilterForwarded = true
+	}
+}
+
+// addrRange is an inclusive range of addresses of a single family.
+type addrRange struct {
+	first, last netip.Addr
+}
+
+// prefixSet holds prefixes as sorted, non-overlapping ranges so that lookups
+// are a binary search. IPv4 ranges sort before IPv6 ones.
+type prefixSet []addrRange
+
+func newPrefixSet(prefixes []netip.Prefix) prefixSet {
+	ranges := make([]addrRange, 0, len(prefixes))
+	for _, p := range prefixes {
+		ranges = append(ranges, addrRange{first: p.Addr(), last: lastAddr(p)})
+	}
+	slices.SortFunc(ranges, func(a, b addrRange) int {
+		return a.first.Compare(b.first)
+	})
+
+	var set prefixSet
+	for _, r := range ranges {
+		if n := len(set); n > 0 && set[n-1].first.BitLen() == r.first.BitLen() &&
+			(r.first.Compare(set[n-1].last) <= 0 || set[n-1].last.Next() == r.first) {
+			if r.last.Compare(set[n-1].last) > 0 {
+				set[n-1].last = r.last
+			}
+			continue
+		}
+		set = append(set, r)
+	}
+	return set
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+func (s prefixSet) contains(addr netip.Addr) bool {
+	i, found := slices.BinarySearchFunc(s, addr, func(r addrRange, addr netip.Addr) int {
+		return r.first.Compare(addr)
+	})
+	if found {
+		return true
+	}
+	return i > 0 && s[i-1].first.BitLen() == addr.BitLen() && addr.Compare(s[i-1].last) <= 0
+}
+
+func (h *Handler) allowIP(req *http.Request) bool {
+	if h.allowCIDRs == nil && h.denyCIDRs == nil {
+		return true
+	}
+	addr := remoteAddr(req)
+	if h.ipFilterForwarded {
+		addr = h.clientIP(req)
+	}
+	if !addr.IsValid() || h.denyCIDRs.contains(addr) {
+		return false
+	}
+	return h.allowCIDRs == nil || h.allowCIDRs.contains(addr)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestPrefixSet(t *testing.T) {
+	set := newPrefixSet(mustParsePrefixes([]string{
+		"10.0.0.0/8",
+		"10.1.0.0/16", // inside the /8
+		"192.168.0.0/24",
+		"192.168.1.0/24", // adjacent, merged with the one above
+		"203.0.113.7",
+		"2001:db8::/32",
+		"::1",
+	}))
+	if len(set) != 5 {
+		t.Fatalf("%d ranges, want 5 after merging: %v", len(set), set)
+	}
+	for addr, want := range map[string]bool{
+		"10.0.0.0":        true,
+		"10.255.255.255":  true,
+		"11.0.0.0":        false,
+		"192.168.1.200":   true,
+		"192.168.2.0":     false,
+		"203.0.113.7":     true,
+		"203.0.113.8":     false,
+		"2001:db8:ffff::": true,
+		"2001:db9::":      false,
+		"::1":             true,
+		"::2":             false,
+		// IPv4 ranges do not match IPv6 addresses of the same bits.
+		"::a00:1": false,
+	} {
+		if got := set.contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestAllowIP(t *testing.T) {
+	h := NewHandler("127.0.0.1:1",
+		WithAllowCIDRs("10.0.0.0/8", "2001:db8::/32"),
+		WithDenyCIDRs("10.9.0.0/16"),
+	)
+	for remote, want := range map[string]bool{
+		"10.1.2.3:1234":          true,
+		"[::ffff:10.1.2.3]:1234": true, // v4-mapped
+		"10.9.1.1:1234":          false,
+		"[::ffff:10.9.1.1]:1234": false,
+		"[2001:db8::5]:1234":     true,
+		"[2001:db9::5]:1234":     false,
+		"192.0.2.1:1234":         false,
+		"garbage":                false,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remote
+		if got := h.allowIP(req); got != want {
+			t.Errorf("allowIP(%s) = %v, want %v", remote, got, want)
+		}
+	}
+}
+
+func TestIPFilterHandshake(t *testing.T) {
+	target := echoTarget(t)
+	allowed := startHandler(t, NewHandler(target, WithAllowCIDRs("127.0.0.0/8")))
+	echoOnce(t, allowed)
+
+	denied := startHandler(t, NewHandler(target, WithDenyCIDRs("127.0.0.1")))
+	if resp := upgradeResponse(t, denied, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status %d, want 403", resp.StatusCode)
+	}
+
+	forwarded := startHandler(t, NewHandler(target,
+		WithAllowCIDRs("198.51.100.0/24"),
+		WithTrustedProxies("127.0.0.0/8"),
+		WithIPFilterForwarded(),
+	))
+	if resp := upgradeResponse(t, forwarded, http.Header{"X-Forwarded-For": {"198.51.100.4"}}); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d for an allowed forwarded client, want 101", resp.StatusCode)
+	}
+	if resp := upgradeResponse(t, forwarded, http.Header{"X-Forwarded-For": {"192.0.2.4"}}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status %d for a forwarded client outside the list, want 403", resp.StatusCode)
+	}
+}
+
+func TestAllowCIDRsInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic for an invalid CIDR")
+		}
+	}()
+	WithAllowCIDRs("10.0.0.0/33")
+}
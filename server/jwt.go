@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTokenMalformed   = errors.New("token malformed")
+	ErrTokenSignature   = errors.New("token signature invalid")
+	ErrTokenExpired     = errors.New("token expired")
+	ErrTokenNotYetValid = errors.New("token not yet valid")
+	ErrTokenClaims      = errors.New("token claims rejected")
+)
+
+// JWTKeyfunc returns the verification key for a token's alg and kid header:
+// a []byte secret for HS256, an *rsa.PublicKey for RS256 or an
+// *ecdsa.PublicKey for ES256. A key of the wrong type for alg is rejected,
+// which prevents algorithm confusion.
+type JWTKeyfunc func(alg, kid string) (any, error)
+
+type jwtClaimsContextKey struct{}
+
+// WithJWTAuth requires a JWT signed with HS256, RS256 or ES256, read from the
+// Authorization header or the token query parameter (see WithAuthQueryParam).
+// exp and nbf are enforced when present. Each entry of requiredClaims must
+// match the token's claim; for "aud" it may match any listed audience. The
+// verified claims are available from JWTClaimsFromContext.
+func WithJWTAuth(keyfunc JWTKeyfunc, requiredClaims map[string]any) HandlerOption {
+	required := normalizeClaims(requiredClaims)
+	return func(h *Handler) {
+		h.auth = append(h.auth, authenticator{
+			check: func(req *http.Request) (*http.Request, error) {
+				token := h.bearerToken(req)
+				if token == "" && h.authQueryParam == "" {
+					token = req.URL.Query().Get("token")
+				}
+				if token == "" {
+					return req, ErrMissingCredentials
+				}
+				claims, err := verifyJWT(token, keyfunc, required, time.Now())
+				if err != nil {
+					return req, err
+				}
+				return req.WithContext(context.WithValue(req.Context(), jwtClaimsContextKey{}, claims)), nil
+			},
+			challenge: `Bearer realm="wst"`,
+			describe:  true,
+		})
+	}
+}
+
+func JWTClaimsFromContext(ctx context.Context) map[string]any {
+	claims, _ := ctx.Value(jwtClaimsContextKey{}).(map[string]any)
+	return claims
+}
+
+// normalizeClaims round-trips claims through JSON so they compare equal to
+// decoded token claims.
+func normalizeClaims(claims map[string]any) map[string]any {
+	if len(claims) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(claims)
+	if err != nil {
+		panic(fmt.Sprintf("wst: invalid required claims: %v", err))
+	}
+	var normalized map[string]any
+	_ = json.Unmarshal(b, &normalized)
+	return normalized
+}
+
+func verifyJWT(token string, keyfunc JWTKeyfunc, required map[string]any, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenMalformed
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+	key, err := keyfunc(header.Alg, header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTokenSignature, err)
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if exp, ok := claims["exp"].(float64); ok && !now.Before(time.Unix(int64(exp), 0)) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return nil, ErrTokenNotYetValid
+	}
+	for name, want := range required {
+		if !claimMatches(name, claims[name], want) {
+			return nil, fmt.Errorf("%w: %s", ErrTokenClaims, name)
+		}
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrTokenMalformed
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrTokenMalformed
+	}
+	return nil
+}
+
+func claimMatches(name string, got, want any) bool {
+	if name == "aud" {
+		if list, ok := got.([]any); ok {
+			for _, aud := range list {
+				if reflect.DeepEqual(aud, want) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return got != nil && reflect.DeepEqual(got, want)
+}
+
+func verifyJWTSignature(alg string, key any, signed string, sig []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("%w: HS256 requires a []byte key", ErrTokenSignature)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ErrTokenSignature
+		}
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: RS256 requires an RSA key", ErrTokenSignature)
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return ErrTokenSignature
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() {
+			return fmt.Errorf("%w: ES256 requires a P-256 key", ErrTokenSignature)
+		}
+		if len(sig) != 64 {
+			return ErrTokenSignature
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return ErrTokenSignature
+		}
+	default:
+		return fmt.Errorf("%w: unsupported alg %q", ErrTokenSignature, alg)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT signs claims with alg using key: a []byte secret for HS256, an
+// *rsa.PrivateKey for RS256 or an *ecdsa.PrivateKey for ES256.
+func signJWT(t *testing.T, alg string, key any, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": alg, "typ": "JWT"}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	default:
+		t.Fatalf("unsupported key %T", key)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+type jwtKeys struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+}
+
+func newJWTKeys(t *testing.T) jwtKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwtKeys{secret: []byte("hmac-secret"), rsa: rsaKey, ec: ecKey}
+}
+
+// keyfunc returns the verification key for alg.
+func (k jwtKeys) keyfunc(alg, _ string) (any, error) {
+	switch alg {
+	case "HS256":
+		return k.secret, nil
+	case "RS256":
+		return &k.rsa.PublicKey, nil
+	case "ES256":
+		return &k.ec.PublicKey, nil
+	}
+	return nil, errors.New("unknown alg")
+}
+
+func TestVerifyJWT(t *testing.T) {
+	keys := newJWTKeys(t)
+	now := time.Now()
+	valid := map[string]any{"sub": "alice", "aud": "wst", "exp": now.Add(time.Hour).Unix()}
+	with := func(k string, v any) map[string]any {
+		c := map[string]any{}
+		for key, val := range valid {
+			c[key] = val
+		}
+		c[k] = v
+		return c
+	}
+	required := normalizeClaims(map[string]any{"aud": "wst"})
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"HS256", signJWT(t, "HS256", keys.secret, valid), nil},
+		{"RS256", signJWT(t, "RS256", keys.rsa, valid), nil},
+		{"ES256", signJWT(t, "ES256", keys.ec, valid), nil},
+		{"audience list", signJWT(t, "ES256", keys.ec, with("aud", []string{"other", "wst"})), nil},
+		{"expired", signJWT(t, "RS256", keys.rsa, with("exp", now.Add(-time.Minute).Unix())), ErrTokenExpired},
+		{"not yet valid", signJWT(t, "RS256", keys.rsa, with("nbf", now.Add(time.Hour).Unix())), ErrTokenNotYetValid},
+		{"wrong audience", signJWT(t, "HS256", keys.secret, with("aud", "other")), ErrTokenClaims},
+		{"wrong key", signJWT(t, "HS256", []byte("other secret"), valid), ErrTokenSignature},
+		{"malformed", "not.a-token", ErrTokenMalformed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := verifyJWT(tc.token, keys.keyfunc, required, now)
+			if !errors.Is(err, tc.want) || (tc.want == nil) != (err == nil) {
+				t.Fatalf("got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyJWTAlgorithmConfusion(t *testing.T) {
+	keys := newJWTKeys(t)
+	claims := map[string]any{"sub": "mallory"}
+	// A verifier keyed only by the RSA public key must not accept an HS256
+	// token whose secret is that public key.
+	pub, err := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaOnly := func(string, string) (any, error) { return &keys.rsa.PublicKey, nil }
+	if _, err := verifyJWT(signJWT(t, "HS256", pub, claims), rsaOnly, nil, time.Now()); !errors.Is(err, ErrTokenSignature) {
+		t.Fatalf("HS256 token with the RSA key as secret: %v, want ErrTokenSignature", err)
+	}
+
+	unsigned := strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)),
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory"}`)),
+		"",
+	}, ".")
+	if _, err := verifyJWT(unsigned, rsaOnly, nil, time.Now()); !errors.Is(err, ErrTokenSignature) {
+		t.Fatalf("alg none: %v, want ErrTokenSignature", err)
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	keys := newJWTKeys(t)
+	target := echoTarget(t)
+	subjects := make(chan any, 1)
+	h := NewHandler("",
+		WithJWTAuth(keys.keyfunc, map[string]any{"aud": "wst"}),
+		WithGetTarget(func(req *http.Request) (string, []string, error) {
+			subjects <- JWTClaimsFromContext(req.Context())["sub"]
+			return target, nil, nil
+		}),
+	)
+	url := startHandler(t, h)
+
+	expired := signJWT(t, "ES256", keys.ec, map[string]any{"aud": "wst", "exp": time.Now().Add(-time.Minute).Unix()})
+	resp := upgradeResponse(t, url, http.Header{"Authorization": {"Bearer " + expired}})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status %d for an expired token, want 401", resp.StatusCode)
+	}
+	if got := resp.Header.Get("WWW-Authenticate"); !strings.Contains(got, ErrTokenExpired.Error()) {
+		t.Fatalf("WWW-Authenticate %q does not give the reason", got)
+	}
+
+	token := signJWT(t, "ES256", keys.ec, map[string]any{"aud": "wst", "sub": "alice"})
+	if resp := upgradeResponse(t, url+"?token="+token, nil); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d with the query token, want 101", resp.StatusCode)
+	}
+	if sub := <-subjects; sub != "alice" {
+		t.Fatalf("GetTarget saw subject %v, want alice", sub)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/zijiren233/gwst/internal/wire"
+)
+
+const DefaultPingInterval = 30 * time.Second
+
+func WithPingInterval(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.pingInterval = d
+	}
+}
+
+func WithPongTimeout(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.pongTimeout = d
+	}
+}
+
+func (h *Handler) keepalive(s *session) {
+	defer s.recoverPanic()
+	if h.pingInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.pingInterval)
+	defer ticker.Stop()
+
+	var (
+		pongTimer *time.Timer
+		pongWait  <-chan time.Time
+		pingSent  int64
+	)
+	defer func() {
+		if pongTimer != nil {
+			pongTimer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			if err := wire.PingCodec.Send(s.ws, nil); err != nil {
+				s.logger.Debug("ping failed", slog.Any("error", err))
+				s.cancel()
+				_ = s.ws.Close()
+				return
+			}
+			if h.pongTimeout > 0 && pongWait == nil {
+				pingSent = now.UnixNano()
+				pongTimer = time.NewTimer(h.pongTimeout)
+				pongWait = pongTimer.C
+			}
+		case <-pongWait:
+			if s.lastFrame.Load() >= pingSent {
+				pongWait = nil
+				continue
+			}
+			// Pongs are only seen by the frame reader, which does not run
+			// while the target is dialed or a tunnel awaits Accept. Only the
+			// time it spent waiting for a frame counts toward the timeout.
+			var waited time.Duration
+			if since := s.readWait.Load(); since != 0 {
+				waited = time.Since(time.Unix(0, max(since, pingSent)))
+			}
+			if waited >= h.pongTimeout {
+				s.abort(CloseGoingAway, "pong timeout")
+				return
+			}
+			pongTimer.Reset(h.pongTimeout - waited)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
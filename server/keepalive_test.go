@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// readRawFrame returns the next frame from ws without answering pings.
+func readRawFrame(t *testing.T, ws *websocket.Conn, timeout time.Duration) (wsFrame, error) {
+	t.Helper()
+	_ = ws.SetReadDeadline(time.Now().Add(timeout))
+	defer ws.SetReadDeadline(time.Time{})
+	fr, err := ws.NewFrameReader()
+	if err != nil {
+		return wsFrame{}, err
+	}
+	payload, err := io.ReadAll(fr)
+	return wsFrame{opcode: fr.PayloadType(), payload: payload}, err
+}
+
+func TestPingInterval(t *testing.T) {
+	h := NewHandler(echoTarget(t), WithPingInterval(50*time.Millisecond))
+	ws := dialWS(t, startHandler(t, h), nil)
+	f, err := readRawFrame(t, ws, 5*time.Second)
+	if err != nil || f.opcode != websocket.PingFrame {
+		t.Fatalf("got frame %d, %v, want a ping", f.opcode, err)
+	}
+}
+
+func TestPingDisabled(t *testing.T) {
+	h := NewHandler(echoTarget(t), WithPingInterval(0))
+	ws := dialWS(t, startHandler(t, h), nil)
+	if f, err := readRawFrame(t, ws, 300*time.Millisecond); err == nil {
+		t.Fatalf("got frame %d with pings disabled", f.opcode)
+	}
+}
+
+func TestPongTimeout(t *testing.T) {
+	h := NewHandler(echoTarget(t), WithPingInterval(50*time.Millisecond), WithPongTimeout(100*time.Millisecond))
+	ws := dialWS(t, startHandler(t, h), nil)
+	// The client reads but never answers the pings.
+	for {
+		f, err := readRawFrame(t, ws, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.opcode == websocket.CloseFrame {
+			ce := parseClosePayload(f.payload)
+			if ce.Code != CloseGoingAway || ce.Reason != "pong timeout" {
+				t.Fatalf("closed with %d %q", ce.Code, ce.Reason)
+			}
+			return
+		}
+	}
+}
+
+func TestPongTimeoutResponsiveClient(t *testing.T) {
+	h := NewHandler(echoTarget(t), WithPingInterval(50*time.Millisecond), WithPongTimeout(100*time.Millisecond))
+	ws := dialWS(t, startHandler(t, h), nil)
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		sendBinary(t, ws, []byte("alive"))
+		if f := readFrame(t, ws); f.opcode != websocket.BinaryFrame || string(f.payload) != "alive" {
+			t.Fatalf("got frame %d %q", f.opcode, f.payload)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPongTimeoutWhileDialing(t *testing.T) {
+	// Nothing reads the client's pongs until the slow dial completes.
+	target := echoTarget(t)
+	h := NewHandler(target,
+		WithHandlerDialer(dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			time.Sleep(400 * time.Millisecond)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		})),
+		WithPingInterval(50*time.Millisecond), WithPongTimeout(100*time.Millisecond),
+	)
+	ws := dialWS(t, startHandler(t, h), nil)
+	sendBinary(t, ws, []byte("slow"))
+	if f := readFrame(t, ws); f.opcode != websocket.BinaryFrame || string(f.payload) != "slow" {
+		t.Fatalf("got frame %d %q, want the echo", f.opcode, f.payload)
+	}
+}
+
+func TestPongTimeoutAwaitingAccept(t *testing.T) {
+	h := NewHandler(echoTarget(t), WithManualAccept(),
+		WithPingInterval(50*time.Millisecond), WithPongTimeout(100*time.Millisecond),
+	)
+	go func() {
+		time.Sleep(400 * time.Millisecond)
+		if tun, err := h.Accept(); err == nil {
+			_ = tun.Pipe()
+		}
+	}()
+	ws := dialWS(t, startHandler(t, h), nil)
+	sendBinary(t, ws, []byte("queued"))
+	if f := readFrame(t, ws); f.opcode != websocket.BinaryFrame || string(f.payload) != "queued" {
+		t.Fatalf("got frame %d %q, want the echo", f.opcode, f.payload)
+	}
+}
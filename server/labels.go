@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+type sessionLabelsKey struct{}
+
+// WithSessionLabeler attaches the labels fn returns for each upgrade request,
+// such as a tenant from a header, to its session. GetTargetFunc and handshake
+// hooks read them with SessionLabelsFromContext, Session.Labels carries them
+// to callbacks, and session log lines include them under "labels". fn runs
+// after authentication, so UserFromContext is set.
+func WithSessionLabeler(fn func(*http.Request) map[string]string) HandlerOption {
+	return func(h *Handler) {
+		h.labeler = fn
+	}
+}
+
+// WithMetricLabelKeys exports the session labels named by keys to the
+// MetricsCollector in Session.MetricLabels, bounding the cardinality of the
+// metrics that use them. Without it MetricLabels is nil.
+func WithMetricLabelKeys(keys ...string) HandlerOption {
+	return func(h *Handler) {
+		h.metricLabelKeys = keys
+	}
+}
+
+func SessionLabelsFromContext(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(sessionLabelsKey{}).(map[string]string)
+	return labels
+}
+
+func (h *Handler) withLabels(req *http.Request) *http.Request {
+	labels := h.labeler(req)
+	if len(labels) == 0 {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), sessionLabelsKey{}, maps.Clone(labels)))
+}
+
+func (h *Handler) metricLabels(labels map[string]string) map[string]string {
+	var m map[string]string
+	for _, k := range h.metricLabelKeys {
+		if v, ok := labels[k]; ok {
+			if m == nil {
+				m = make(map[string]string, len(h.metricLabelKeys))
+			}
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func labelsAttr(labels map[string]string) slog.Attr {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	attrs := make([]any, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, slog.String(k, labels[k]))
+	}
+	return slog.Group("labels", attrs...)
+}
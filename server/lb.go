@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultHealthFailures = 1
+	DefaultHealthCooldown = 5 * time.Second
+)
+
+type BackendStatus struct {
+	LastCheck time.Time
+	Addr      string
+	Active    int64
+	Failures  int32
+	Healthy   bool
+}
+
+type backend struct {
+	addr         string
+	active       atomic.Int64
+	failures     atomic.Int32
+	ejectedUntil atomic.Int64
+	lastCheck    atomic.Int64
+	probing      atomic.Bool
+}
+
+func (b *backend) ejected() bool {
+	return b.ejectedUntil.Load() != 0
+}
+
+func (b *backend) status() BackendStatus {
+	status := BackendStatus{
+		Addr:     b.addr,
+		Active:   b.active.Load(),
+		Failures: b.failures.Load(),
+		Healthy:  !b.ejected(),
+	}
+	if t := b.lastCheck.Load(); t != 0 {
+		status.LastCheck = time.Unix(0, t)
+	}
+	return status
+}
+
+type Strategy int
+
+const (
+	StrategyRoundRobin Strategy = iota
+	StrategyLeastConnections
+)
+
+type balancer struct {
+	probe       func(addr string) error
+	backends    []*backend
+	next        atomic.Uint64
+	cooldown    time.Duration
+	maxFailures int32
+	strategy    Strategy
+}
+
+func newBalancer(addrs []string) *balancer {
+	lb := &balancer{
+		backends:    make([]*backend, len(addrs)),
+		maxFailures: DefaultHealthFailures,
+		cooldown:    DefaultHealthCooldown,
+	}
+	for i, addr := range addrs {
+		lb.backends[i] = &backend{addr: addr}
+	}
+	return lb
+}
+
+func (lb *balancer) markFailed(b *backend) {
+	if b.failures.Add(1) >= lb.maxFailures {
+		b.ejectedUntil.Store(time.Now().Add(lb.cooldown).UnixNano())
+	}
+}
+
+func (lb *balancer) markSuccess(b *backend) {
+	b.failures.Store(0)
+	b.ejectedUntil.Store(0)
+}
+
+func (lb *balancer) maybeProbe(b *backend, now time.Time) {
+	if now.UnixNano() < b.ejectedUntil.Load() || lb.probe == nil {
+		return
+	}
+	if !b.probing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer b.probing.Store(false)
+		if err := lb.probe(b.addr); err != nil {
+			b.ejectedUntil.Store(time.Now().Add(lb.cooldown).UnixNano())
+			return
+		}
+		lb.markSuccess(b)
+	}()
+}
+
+// pick returns the next backend with its active count already incremented;
+// the caller must decrement it if the dial fails.
+func (lb *balancer) pick() *backend {
+	now := time.Now()
+	n := uint64(len(lb.backends))
+	start := lb.next.Add(1) - 1
+	var picked *backend
+	for i := uint64(0); i < n; i++ {
+		b := lb.backends[(start+i)%n]
+		if b.ejected() {
+			lb.maybeProbe(b, now)
+			continue
+		}
+		if lb.strategy != StrategyLeastConnections {
+			picked = b
+			break
+		}
+		if picked == nil || b.active.Load() < picked.active.Load() {
+			picked = b
+		}
+	}
+	if picked == nil {
+		picked = lb.backends[start%n]
+	}
+	picked.active.Add(1)
+	return picked
+}
+
+func WithHandlerBackends(addrs []string) HandlerOption {
+	return func(h *Handler) {
+		if len(addrs) == 0 {
+			h.balancer = nil
+			return
+		}
+		h.balancer = newBalancer(addrs)
+	}
+}
+
+// WithBalanceStrategy sets how sessions are spread across the backends of
+// WithHandlerBackends or of a comma-separated target. The default is
+// StrategyRoundRobin.
+func WithBalanceStrategy(strategy Strategy) HandlerOption {
+	return func(h *Handler) {
+		h.balanceStrategy = strategy
+	}
+}
+
+// WithTargetFailover controls whether a failed dial is retried on the next
+// backend before the session is given up. It is enabled by default.
+func WithTargetFailover(enabled bool) HandlerOption {
+	return func(h *Handler) {
+		h.noFailover = !enabled
+	}
+}
+
+func WithHandlerHealthPolicy(failures int, cooldown time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.healthFailures = failures
+		h.healthCooldown = cooldown
+	}
+}
+
+func (h *Handler) initBalancer() {
+	if h.balancer == nil && strings.Contains(h.defaultTargetAddr, ",") {
+		var addrs []string
+		for _, addr := range strings.Split(h.defaultTargetAddr, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+		h.balancer = newBalancer(addrs)
+	}
+	if h.balancer == nil {
+		return
+	}
+	h.balancer.strategy = h.balanceStrategy
+	if h.healthFailures > 0 {
+		h.balancer.maxFailures = int32(h.healthFailures)
+	}
+	if h.healthCooldown > 0 {
+		h.balancer.cooldown = h.healthCooldown
+	}
+	h.balancer.probe = func(target string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), h.targetDialTimeout)
+		defer cancel()
+		conn, err := h.dialProbe(ctx, target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+func (h *Handler) BackendHealth() []BackendStatus {
+	if h.balancer == nil {
+		return nil
+	}
+	statuses := make([]BackendStatus, len(h.balancer.backends))
+	for i, b := range h.balancer.backends {
+		statuses[i] = b.status()
+	}
+	return statuses
+}
+
+func (h *Handler) dialBackend(ctx context.Context, s *session) (net.Conn, error) {
+	var lastErr error
+	for range h.balancer.backends {
+		b := h.balancer.pick()
+		conn, err := h.dialTarget(ctx, s, b.addr, true)
+		if err != nil {
+			b.active.Add(-1)
+			if errors.Is(err, ErrDialVetoed) {
+				return nil, err
+			}
+			h.balancer.markFailed(b)
+			lastErr = err
+			if ctx.Err() != nil || h.noFailover {
+				break
+			}
+			continue
+		}
+		h.balancer.markSuccess(b)
+		s.backend = b
+		s.setTarget(b.addr)
+		return conn, nil
+	}
+	return nil, lastErr
+}
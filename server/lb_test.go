@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBalancerProbeTLSBackend(t *testing.T) {
+	addr, cfg := tlsTarget(t)
+	h := NewHandler("",
+		WithHandlerBackends([]string{"tls://" + addr}),
+		WithHandlerHealthPolicy(1, time.Millisecond),
+		WithTargetTLS(cfg),
+	)
+	b := h.balancer.backends[0]
+	h.balancer.markFailed(b)
+	if !b.ejected() {
+		t.Fatal("backend not ejected")
+	}
+	time.Sleep(2 * time.Millisecond)
+	h.balancer.pick()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.ejected() {
+		if time.Now().After(deadline) {
+			t.Fatal("probe of a tls:// backend never succeeded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBalancerFailoverAfterDialTimeout(t *testing.T) {
+	good := echoTarget(t)
+	const dead = "192.0.2.1:9"
+	dialer := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == dead {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	})
+	h := NewHandler("",
+		WithHandlerBackends([]string{dead, good}),
+		WithHandlerHealthPolicy(100, time.Minute),
+		WithHandlerDialer(dialer),
+		WithTargetDialTimeout(100*time.Millisecond),
+	)
+	url := startHandler(t, h)
+
+	// Round robin starts one of the two sessions on the dead backend.
+	for i := 0; i < 2; i++ {
+		ws := dialWS(t, url, nil)
+		sendBinary(t, ws, []byte("ping"))
+		if f := readFrame(t, ws); string(f.payload) != "ping" {
+			t.Fatalf("session %d: got %q, want echo", i, f.payload)
+		}
+		ws.Close()
+	}
+}
+
+func TestBalancerRoundRobinDistribution(t *testing.T) {
+	h := NewHandler("a:1, b:1 ,c:1")
+	counts := map[string]int{}
+	for i := 0; i < 99; i++ {
+		b := h.balancer.pick()
+		counts[b.addr]++
+		b.active.Add(-1)
+	}
+	for _, addr := range []string{"a:1", "b:1", "c:1"} {
+		if counts[addr] != 33 {
+			t.Fatalf("distribution %v, want 33 each", counts)
+		}
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	h := NewHandler("", WithHandlerBackends([]string{"a:1", "b:1"}), WithBalanceStrategy(StrategyLeastConnections))
+	busy := h.balancer.backends[0]
+	busy.active.Store(10)
+	for i := 0; i < 10; i++ {
+		if b := h.balancer.pick(); b == busy {
+			t.Fatalf("pick %d chose the busier backend", i)
+		}
+	}
+	// Both are now at 10 and share the next picks.
+	counts := map[string]int{}
+	for i := 0; i < 100; i++ {
+		counts[h.balancer.pick().addr]++
+	}
+	if counts["a:1"] != 50 || counts["b:1"] != 50 {
+		t.Fatalf("distribution %v, want 50 each", counts)
+	}
+}
+
+func TestBalancerFailoverToLiveBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+	h := NewHandler("", WithHandlerBackends([]string{down, echoTarget(t)}))
+	url := startHandler(t, h)
+	for i := 0; i < 4; i++ {
+		ws := dialWS(t, url, nil)
+		sendBinary(t, ws, []byte("ping"))
+		if f := readFrame(t, ws); string(f.payload) != "ping" {
+			t.Fatalf("session %d: got %q, want echo", i, f.payload)
+		}
+		ws.Close()
+	}
+	if status := h.BackendHealth()[0]; status.Failures == 0 {
+		t.Fatalf("down backend has no recorded failures: %+v", status)
+	}
+}
+
+func TestBalancerNoFailover(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+	h := NewHandler("", WithHandlerBackends([]string{down, echoTarget(t)}), WithTargetFailover(false))
+	// Round robin starts at the down backend.
+	ws := dialWS(t, startHandler(t, h), nil)
+	if code := readClose(t, ws); code == CloseNormalClosure {
+		t.Fatalf("close code %d, want a dial failure", code)
+	}
+}
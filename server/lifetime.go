@@ -0,0 +1,32 @@
+package main
+
+import "time"
+
+const sessionDrainTimeout = 2 * time.Second
+
+func WithMaxSessionDuration(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.maxSessionDuration = d
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func (s *session) closeGracefully(code int, reason string) {
+	s.setReason(reason)
+	s.sendClose(code, reason)
+	if cw, ok := s.getConn().(closeWriter); ok {
+		_ = cw.CloseWrite()
+	}
+	time.AfterFunc(sessionDrainTimeout, func() {
+		s.abort(code, reason)
+	})
+}
+
+func (s *session) startLifetimeTimer(d time.Duration) (stop func() bool) {
+	return time.AfterFunc(d, func() {
+		s.closeGracefully(CloseGoingAway, "session limit")
+	}).Stop
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const DefaultRetryAfter = 5 * time.Second
+
+func WithMaxConnections(n int) HandlerOption {
+	return func(h *Handler) {
+		h.maxConns = int64(n)
+	}
+}
+
+func (h *Handler) acquireConn() bool {
+	if h.active.Add(1) > h.maxConns && h.maxConns > 0 {
+		h.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (h *Handler) releaseConn() {
+	h.active.Add(-1)
+}
+
+func (h *Handler) ActiveConnections() int64 {
+	return h.active.Load()
+}
+
+func rejectUnavailable(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
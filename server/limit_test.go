@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestMaxConnections(t *testing.T) {
+	const n = 5
+	h := NewHandler(echoTarget(t), WithMaxConnections(n))
+	url := startHandler(t, h)
+
+	var (
+		mu   sync.Mutex
+		wss  []*websocket.Conn
+		wg   sync.WaitGroup
+		fail int
+	)
+	for i := 0; i < n+10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws, err := dialWSErr(url, nil)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fail++
+				return
+			}
+			wss = append(wss, ws)
+		}()
+	}
+	wg.Wait()
+	if len(wss) != n || fail != 10 {
+		t.Fatalf("%d connections succeeded and %d failed, want %d and 10", len(wss), fail, n)
+	}
+	stats := h.Stats()
+	if got := stats.Handshakes[HandshakeRejectedMaxConns]; got != 10 {
+		t.Fatalf("%d handshakes rejected, want 10", got)
+	}
+	if stats.ActiveConnections != n || stats.MaxConnections != n {
+		t.Fatalf("stats report %d of %d connections, want %d of %d", stats.ActiveConnections, stats.MaxConnections, n, n)
+	}
+
+	resp := upgradeResponse(t, url, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("status %d, Retry-After %q; want 503 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	for _, ws := range wss {
+		ws.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Stats().ActiveConnections != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections still counted after all closed", h.ActiveConnections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The released slots take new connections.
+	echoOnce(t, url)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ErrLocalAddrUnsupported is returned by a dial bound to a local address when
+// the dialer is not a *net.Dialer.
+var ErrLocalAddrUnsupported = errors.New("dialer does not support a local address")
+
+// WithUpstreamLocalAddr binds target dials to the local address addr, given
+// as an IP or IP:port. It takes precedence over the LocalAddr of a *net.Dialer
+// passed to WithHandlerDialer, and TargetSpec.LocalAddr takes precedence over
+// it. Dials fail with ErrLocalAddrUnsupported if the dialer is not a
+// *net.Dialer.
+func WithUpstreamLocalAddr(addr string) HandlerOption {
+	local, err := parseLocalAddr(addr)
+	if err != nil {
+		panic("wst: " + err.Error())
+	}
+	return func(h *Handler) {
+		h.upstreamLocalAddr = local
+	}
+}
+
+func parseLocalAddr(addr string) (*net.TCPAddr, error) {
+	if ip, err := netip.ParseAddr(addr); err == nil {
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)), nil
+	}
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream local address %q", addr)
+	}
+	return net.TCPAddrFromAddrPort(ap), nil
+}
+
+type localAddrContextKey struct{}
+
+func withLocalAddr(ctx context.Context, local *net.TCPAddr) context.Context {
+	return context.WithValue(ctx, localAddrContextKey{}, local)
+}
+
+// localAddrDialer binds dials to the local address of the session's target,
+// or else to that of WithUpstreamLocalAddr.
+type localAddrDialer struct {
+	dialer ContextDialer
+	local  *net.TCPAddr
+}
+
+func (d *localAddrDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	local := d.local
+	if l, ok := ctx.Value(localAddrContextKey{}).(*net.TCPAddr); ok {
+		local = l
+	}
+	if local == nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	nd, ok := d.dialer.(*net.Dialer)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrLocalAddrUnsupported, d.dialer)
+	}
+	bound := *nd
+	bound.LocalAddr = local
+	return bound.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+)
+
+// sourceTarget answers every connection with the IP it came from.
+func sourceTarget(t *testing.T) string {
+	return startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		_, _ = conn.Write([]byte(host))
+	})
+}
+
+func requireLoopbackAliases(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("127.0.0.0/8 is only all routed to loopback on Linux")
+	}
+}
+
+func TestUpstreamLocalAddr(t *testing.T) {
+	requireLoopbackAliases(t)
+	url := startHandler(t, NewHandler(sourceTarget(t), WithUpstreamLocalAddr("127.0.0.2")))
+	ws := dialWS(t, url, nil)
+	if f := readFrame(t, ws); string(f.payload) != "127.0.0.2" {
+		t.Fatalf("target saw %q, want 127.0.0.2", f.payload)
+	}
+}
+
+func TestTargetSpecLocalAddr(t *testing.T) {
+	requireLoopbackAliases(t)
+	target := sourceTarget(t)
+	h := NewHandler("",
+		WithUpstreamLocalAddr("127.0.0.2"),
+		WithGetTargetSpec(func(req *http.Request) (TargetSpec, error) {
+			return TargetSpec{Addr: target, LocalAddr: req.URL.Query().Get("src")}, nil
+		}),
+	)
+	url := startHandler(t, h)
+	for _, tc := range []struct{ src, want string }{
+		{"", "127.0.0.2"},
+		{"127.0.0.3", "127.0.0.3"},
+	} {
+		ws := dialWS(t, url+"?src="+tc.src, nil)
+		if f := readFrame(t, ws); string(f.payload) != tc.want {
+			t.Errorf("src %q: target saw %q, want %q", tc.src, f.payload, tc.want)
+		}
+	}
+}
+
+func TestTargetSpecLocalAddrInvalid(t *testing.T) {
+	h := NewHandler("", WithGetTargetSpec(func(*http.Request) (TargetSpec, error) {
+		return TargetSpec{Addr: "127.0.0.1:1", LocalAddr: "not-an-ip"}, nil
+	}))
+	resp := upgradeResponse(t, startHandler(t, h), nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestUpstreamLocalAddrUnsupportedDialer(t *testing.T) {
+	dialed := make(chan struct{}, 1)
+	dialer := dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- struct{}{}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	})
+	h := NewHandler(echoTarget(t), WithHandlerDialer(dialer), WithUpstreamLocalAddr("127.0.0.1"))
+	if _, err := h.dialer.DialContext(context.Background(), "tcp", "127.0.0.1:1"); !errors.Is(err, ErrLocalAddrUnsupported) {
+		t.Fatalf("dial error = %v, want ErrLocalAddrUnsupported", err)
+	}
+	select {
+	case <-dialed:
+		t.Fatal("dialer ran without the local address")
+	default:
+	}
+}
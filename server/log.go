@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
+
+var discardLogger = slog.New(discardHandler{})
+
+func WithLogger(logger *slog.Logger) HandlerOption {
+	return func(h *Handler) {
+		h.logger = logger
+	}
+}
+
+func WithServerLogger(logger *slog.Logger) ServerOption {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+func (h *Handler) initLogger() {
+	if h.logger == nil {
+		h.logger = discardLogger
+	}
+	h.rejectLogLimit = newTokenBucket(1, 5)
+}
+
+func (h *Handler) logRejected(req *http.Request, status int, reason string) {
+	if !h.rejectLogLimit.allow() {
+		return
+	}
+	h.logger.Warn("handshake rejected",
+		slog.String("remote_addr", req.RemoteAddr),
+		slog.String("path", req.URL.Path),
+		slog.Int("status", status),
+		slog.String("reason", reason),
+	)
+}
@@ -3,11 +3,16 @@ package main
 import "os"
 
 var (
-	listen = os.Getenv("LISTEN")
-	target = os.Getenv("TARGET")
+	listen        = os.Getenv("LISTEN")
+	target        = os.Getenv("TARGET")
+	forwardListen = os.Getenv("FORWARD_LISTEN")
 )
 
 func main() {
+	if forwardListen != "" {
+		serveRemoteForwarder()
+		return
+	}
 	if listen == "" || target == "" {
 		panic("LISTEN or TARGET is not set")
 	}
@@ -17,3 +22,22 @@ func main() {
 		NewHandler(target),
 	).Serve()
 }
+
+// serveRemoteForwarder exposes incoming tunnels on FORWARD_LISTEN instead of
+// dialing a target.
+func serveRemoteForwarder() {
+	if listen == "" {
+		panic("LISTEN is not set")
+	}
+	h := NewHandler("", WithManualAccept())
+	f := &RemoteForwarder{
+		Handler:    h,
+		ListenAddr: forwardListen,
+	}
+	go func() {
+		if err := f.Serve(); err != nil {
+			panic(err)
+		}
+	}()
+	_ = NewServer(listen, "/", h).Serve()
+}
@@ -0,0 +1,51 @@
+package main
+
+import "time"
+
+const (
+	HandshakeAccepted               = "accepted"
+	HandshakeRejectedOrigin         = "rejected_origin"
+	HandshakeRejectedMaxConns       = "rejected_max_conns"
+	HandshakeRejectedPerIPLimit     = "rejected_per_ip_limit"
+	HandshakeRejectedRateLimit      = "rejected_rate_limit"
+	HandshakeRejectedAuth           = "rejected_auth"
+	HandshakeRejectedHook           = "rejected_hook"
+	HandshakeRejectedIP             = "rejected_ip"
+	HandshakeRejectedSubprotocol    = "rejected_subprotocol"
+	HandshakeRejectedTarget         = "rejected_target"
+	HandshakeRejectedResume         = "rejected_resume"
+	HandshakeRejectedHandshakeLimit = "rejected_handshake_limit"
+	HandshakeRejectedObfuscation    = "rejected_obfuscation"
+	HandshakeRedirected             = "redirected"
+)
+
+// MetricsCollector receives Handler instrumentation events. Implementations
+// must be safe for concurrent use; they are called on the session hot path.
+// Session.MetricLabels holds the labels a collector may attach to session
+// metrics; see WithMetricLabelKeys.
+type MetricsCollector interface {
+	Handshake(outcome string)
+	TargetDialed(target string, duration time.Duration, err error)
+	SessionStarted(session Session)
+	SessionEnded(session Session, stats ConnStats)
+}
+
+// DialRetryCollector is implemented by a MetricsCollector that also wants an
+// event for each target dial retried under WithTargetDialRetry. attempt is
+// the number of the attempt that failed with err, starting at 1.
+type DialRetryCollector interface {
+	TargetDialRetried(target string, attempt int, err error)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Handshake(string)                          {}
+func (nopMetrics) TargetDialed(string, time.Duration, error) {}
+func (nopMetrics) SessionStarted(Session)                    {}
+func (nopMetrics) SessionEnded(Session, ConnStats)           {}
+
+func WithMetrics(m MetricsCollector) HandlerOption {
+	return func(h *Handler) {
+		h.metrics = m
+	}
+}
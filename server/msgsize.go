@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// DefaultMaxMessageSize bounds inbound frames by default. The relay streams
+// frames through a copy buffer, so legitimate clients need not send larger
+// ones; WithMaxFrameSize on the client splits its writes accordingly.
+const DefaultMaxMessageSize = 1 << 20
+
+var errMessageTooBig = errors.New("websocket frame exceeds max message size")
+
+// WithMaxMessageSize closes sessions with status 1009 when the client sends a
+// message whose payload, summed over its continuation frames, exceeds n bytes.
+// The limit is checked from each frame header before its payload is read.
+func WithMaxMessageSize(n int) HandlerOption {
+	if n <= 0 {
+		panic("wst: max message size must be positive")
+	}
+	return func(h *Handler) {
+		h.maxMessageSize = n
+	}
+}
+
+// payloadLen returns the payload length of a frame from NewFrameReader, whose
+// Len includes the header.
+func payloadLen(frame interface {
+	Len() int
+	HeaderReader() io.Reader
+}) int {
+	n := frame.Len()
+	if header, ok := frame.HeaderReader().(interface{ Len() int }); ok {
+		n -= header.Len()
+	}
+	return n
+}
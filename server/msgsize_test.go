@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialRaw completes a websocket handshake with url and returns the
+// connection, on which the test writes its own frames, and the websocket for
+// reading.
+func dialRaw(t testing.TB, url string) (net.Conn, *websocket.Conn) {
+	t.Helper()
+	host := strings.TrimPrefix(url, "ws://")
+	config, err := websocket.NewConfig(url, "http://"+host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return conn, ws
+}
+
+// writeRawFrame writes a client frame with a zero mask, so the payload goes
+// out as is.
+func writeRawFrame(t testing.TB, conn net.Conn, fin bool, opcode byte, payload []byte) {
+	t.Helper()
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	header := []byte{b0}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, 0x80|byte(n))
+	case n <= 0xffff:
+		header = binary.BigEndian.AppendUint16(append(header, 0x80|126), uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 0x80|127), uint64(n))
+	}
+	header = append(header, 0, 0, 0, 0)
+	if _, err := conn.Write(append(header, payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	h := NewHandler(echoTarget(t), WithMaxMessageSize(1024))
+	url := startHandler(t, h)
+
+	ws := dialWS(t, url, nil)
+	sendBinary(t, ws, make([]byte, 1024))
+	if f := readFrame(t, ws); len(f.payload) != 1024 {
+		t.Fatalf("echoed %d bytes of a frame at the limit", len(f.payload))
+	}
+
+	ws = dialWS(t, url, nil)
+	sendBinary(t, ws, make([]byte, 1025))
+	if code := readClose(t, ws); code != CloseMessageTooBig {
+		t.Fatalf("close code %d, want %d", code, CloseMessageTooBig)
+	}
+}
+
+func TestMaxMessageSizeContinuation(t *testing.T) {
+	received := make(chan int, 1)
+	target := startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, conn)
+		received <- int(n)
+	})
+	h := NewHandler(target, WithMaxMessageSize(1024))
+	conn, ws := dialRaw(t, startHandler(t, h))
+	// Each frame is under the limit, but the message is not.
+	writeRawFrame(t, conn, false, websocket.BinaryFrame, make([]byte, 600))
+	writeRawFrame(t, conn, true, websocket.ContinuationFrame, make([]byte, 600))
+	if code := readClose(t, ws); code != CloseMessageTooBig {
+		t.Fatalf("close code %d, want %d", code, CloseMessageTooBig)
+	}
+	if n := <-received; n > 1024 {
+		t.Fatalf("target received %d bytes of an oversized message", n)
+	}
+}
+
+func TestMaxMessageSizeHugeFrameHeader(t *testing.T) {
+	// The frame announces 4 GiB; the session ends without waiting for it.
+	h := NewHandler(echoTarget(t))
+	conn, ws := dialRaw(t, startHandler(t, h))
+	header := binary.BigEndian.AppendUint64([]byte{0x80 | websocket.BinaryFrame, 0x80 | 127}, 4<<30)
+	if _, err := conn.Write(append(header, 0, 0, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if code := readClose(t, ws); code != CloseMessageTooBig {
+		t.Fatalf("close code %d, want %d", code, CloseMessageTooBig)
+	}
+}
+
+func TestLargeFrameStreamsToTarget(t *testing.T) {
+	// A 64 MiB frame is relayed as it arrives instead of being buffered in
+	// full: the process allocates a few copy buffers, not the frame.
+	const size = 64 << 20
+	received := make(chan int64, 1)
+	target := startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	})
+	h := NewHandler(target, WithMaxMessageSize(size))
+	conn, ws := dialRaw(t, startHandler(t, h))
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	header := binary.BigEndian.AppendUint64([]byte{0x80 | websocket.BinaryFrame, 0x80 | 127}, size)
+	if _, err := conn.Write(append(header, 0, 0, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	chunk := make([]byte, 64<<10)
+	for sent := 0; sent < size; sent += len(chunk) {
+		if _, err := conn.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws.Close()
+	if n := <-received; n != size {
+		t.Fatalf("target received %d bytes, want %d", n, size)
+	}
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 4<<20 {
+		t.Fatalf("allocated %d bytes relaying a %d byte frame", alloc, size)
+	}
+}
+
+// BenchmarkUploadMaxMessageSize relays 32 KiB messages to the target under
+// the default message size limit.
+func BenchmarkUploadMaxMessageSize(b *testing.B) {
+	target := startTarget(b, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	ws := dialWS(b, startHandler(b, NewHandler(target)), nil)
+	msg := bytes.Repeat([]byte("x"), 32<<10)
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sendBinary(b, ws, msg)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+type NullBackendMode int
+
+const (
+	// NullBackendSink discards everything the client sends and never sends
+	// anything back.
+	NullBackendSink NullBackendMode = iota + 1
+	// NullBackendEcho sends back everything the client sends.
+	NullBackendEcho
+	// NullBackendStream discards what the client sends and streams zero
+	// bytes to it, at the rate set by WithHandlerNullBackendRate or as fast
+	// as the client reads.
+	NullBackendStream
+)
+
+// WithHandlerNullBackend replaces the target dial with an in-memory conn
+// behaving as mode, so that the websocket and copy path can be load tested
+// in isolation. It is a testing and benchmarking aid, not a routing option:
+// no target is ever contacted.
+func WithHandlerNullBackend(mode NullBackendMode) HandlerOption {
+	if mode < NullBackendSink || mode > NullBackendStream {
+		panic("wst: invalid null backend mode")
+	}
+	return func(h *Handler) {
+		h.nullBackend = mode
+	}
+}
+
+// WithHandlerNullBackendRate limits NullBackendStream to bytesPerSecond.
+func WithHandlerNullBackendRate(bytesPerSecond int64) HandlerOption {
+	if bytesPerSecond <= 0 {
+		panic("wst: null backend rate must be positive")
+	}
+	return func(h *Handler) {
+		h.nullBackendRate = bytesPerSecond
+	}
+}
+
+type nullAddr struct{}
+
+func (nullAddr) Network() string { return "null" }
+func (nullAddr) String() string  { return "null" }
+
+type nullConn struct {
+	net.Conn
+}
+
+func (nullConn) LocalAddr() net.Addr  { return nullAddr{} }
+func (nullConn) RemoteAddr() net.Addr { return nullAddr{} }
+
+// dialNullBackend returns one end of a pipe whose other end is served by
+// goroutines implementing the mode. They exit once the session closes it.
+func (h *Handler) dialNullBackend() net.Conn {
+	conn, backend := net.Pipe()
+	switch h.nullBackend {
+	case NullBackendEcho:
+		go func() {
+			_, _ = io.Copy(backend, backend)
+			_ = backend.Close()
+		}()
+	case NullBackendStream:
+		go func() {
+			_, _ = io.Copy(io.Discard, backend)
+			_ = backend.Close()
+		}()
+		go streamZeros(backend, h.nullBackendRate)
+	default:
+		go func() {
+			_, _ = io.Copy(io.Discard, backend)
+			_ = backend.Close()
+		}()
+	}
+	return nullConn{conn}
+}
+
+func streamZeros(w io.Writer, rate int64) {
+	chunk := make([]byte, DefaultBufferSize)
+	start := time.Now()
+	var sent int64
+	for {
+		n, err := w.Write(chunk)
+		if err != nil {
+			return
+		}
+		sent += int64(n)
+		if rate > 0 {
+			due := start.Add(time.Duration(float64(sent) / float64(rate) * float64(time.Second)))
+			time.Sleep(time.Until(due))
+		}
+	}
+}
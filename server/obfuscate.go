@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/zijiren233/gwst/internal/wire"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	ObfuscationHeader = wire.ObfuscationHeader
+	ObfuscationScheme = wire.ObfuscationScheme
+)
+
+var errObfuscationRequired = errors.New("obfuscation required")
+
+// WithObfuscation scrambles the tunneled byte stream in both directions with
+// psk, so that the traffic inside the websocket does not look like the
+// protocol it carries. It is obfuscation against naive DPI, not security:
+// there is no authentication or integrity, and anyone holding psk can read
+// the stream. Confidentiality still depends on TLS. Clients must use
+// WithObfuscation with the same psk; others are rejected with 403. The
+// in-band target preamble and backend info are not obfuscated.
+func WithObfuscation(psk []byte) HandlerOption {
+	if len(psk) == 0 {
+		panic("wst: obfuscation key must not be empty")
+	}
+	block := wire.NewObfuscationCipher(psk)
+	return func(h *Handler) {
+		h.obfuscation = block
+	}
+}
+
+func (h *Handler) negotiateObfuscation(config *websocket.Config, req *http.Request) error {
+	if req.Header.Get(ObfuscationHeader) != ObfuscationScheme {
+		h.logRejected(req, http.StatusForbidden, errObfuscationRequired.Error())
+		h.metrics.Handshake(HandshakeRejectedObfuscation)
+		return errObfuscationRequired
+	}
+	if config.Header == nil {
+		config.Header = make(http.Header)
+	}
+	config.Header.Set(ObfuscationHeader, ObfuscationScheme)
+	return nil
+}
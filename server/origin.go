@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var errOriginNotAllowed = errors.New("origin not allowed")
+
+type originPattern struct {
+	scheme string
+	host   string
+	// wildcard matches any subdomain of host, but not host itself.
+	wildcard bool
+}
+
+// WithAllowedOrigins restricts handshakes to the given origins, each either
+// exact ("https://app.example.com") or a wildcard subdomain pattern
+// ("https://*.example.com"). Other origins are rejected with 403.
+func WithAllowedOrigins(patterns ...string) HandlerOption {
+	parsed := make([]originPattern, len(patterns))
+	for i, p := range patterns {
+		parsed[i] = mustParseOriginPattern(p)
+	}
+	return func(h *Handler) {
+		h.allowedOrigins = parsed
+	}
+}
+
+// WithOriginCheck runs fn during the handshake after the built-in origin
+// checks; a non-nil error rejects the handshake with 403.
+func WithOriginCheck(fn func(*http.Request) error) HandlerOption {
+	return func(h *Handler) {
+		h.originCheck = fn
+	}
+}
+
+func mustParseOriginPattern(pattern string) originPattern {
+	scheme, host, ok := strings.Cut(strings.ToLower(pattern), "://")
+	if !ok || scheme == "" || host == "" {
+		panic(fmt.Sprintf("wst: invalid origin pattern %q", pattern))
+	}
+	if rest, ok := strings.CutPrefix(host, "*."); ok {
+		return originPattern{scheme: scheme, host: rest, wildcard: true}
+	}
+	return originPattern{scheme: scheme, host: host}
+}
+
+func (p originPattern) match(origin *url.URL) bool {
+	if !strings.EqualFold(origin.Scheme, p.scheme) {
+		return false
+	}
+	host := strings.ToLower(origin.Host)
+	if p.wildcard {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+	return host == p.host
+}
+
+func (h *Handler) checkAllowedOrigin(origin *url.URL, req *http.Request) error {
+	if len(h.allowedOrigins) > 0 {
+		allowed := false
+		for _, p := range h.allowedOrigins {
+			if origin != nil && p.match(origin) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: %s", errOriginNotAllowed, origin)
+		}
+	}
+	if h.originCheck != nil {
+		return h.originCheck(req)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+)
+
+// WithHandlerPanicHandler registers fn to be called with the value of any
+// panic recovered from a session goroutine. The panic is always logged and
+// the affected session closed with status 1011; other sessions keep running.
+func WithHandlerPanicHandler(fn func(any)) HandlerOption {
+	return func(h *Handler) {
+		h.panicHandler = fn
+	}
+}
+
+// recoverPanic must be deferred directly by every goroutine that serves a
+// session.
+func (s *session) recoverPanic() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	s.logger.Error("session panic",
+		slog.Any("panic", v),
+		slog.String("stack", string(debug.Stack())),
+	)
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = fmt.Errorf("panic: %v", v)
+	}
+	s.mu.Unlock()
+	s.abort(CloseInternalError, "internal error")
+	if s.h.panicHandler != nil {
+		s.h.panicHandler(v)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type pathSuffixContextKey struct{}
+
+// WithPathPrefix only serves requests whose path is prefix or lies below it,
+// answering others with the fallback handler or 404. The rest of the path is
+// available to GetTargetFunc and hooks via PathSuffixFromContext, so that for
+// example "/tunnel/redis" under "/tunnel/" selects the "redis" backend.
+func WithPathPrefix(prefix string) HandlerOption {
+	if !strings.HasPrefix(prefix, "/") {
+		panic("wst: path prefix must start with /")
+	}
+	escaped := strings.TrimSuffix((&url.URL{Path: prefix}).EscapedPath(), "/")
+	return func(h *Handler) {
+		h.pathPrefix = escaped
+	}
+}
+
+// PathSuffixFromContext returns the unescaped path below the WithPathPrefix
+// prefix, without leading or trailing slashes. An escaped slash ("%2F") in the
+// request path is returned as "/" but never splits the prefix match.
+func PathSuffixFromContext(ctx context.Context) string {
+	suffix, _ := ctx.Value(pathSuffixContextKey{}).(string)
+	return suffix
+}
+
+func (h *Handler) matchPath(req *http.Request) (*http.Request, bool) {
+	rest, ok := strings.CutPrefix(req.URL.EscapedPath(), h.pathPrefix)
+	if !ok || rest != "" && rest[0] != '/' {
+		return req, false
+	}
+	rest = strings.TrimSuffix(strings.TrimPrefix(rest, "/"), "/")
+	suffix, err := url.PathUnescape(rest)
+	if err != nil {
+		return req, false
+	}
+	return req.WithContext(context.WithValue(req.Context(), pathSuffixContextKey{}, suffix)), true
+}
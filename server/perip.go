@@ -0,0 +1,124 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	perIPTableSize = 64 * 1024
+	perIPExpiry    = 10 * time.Minute
+)
+
+func WithPerIPLimit(maxConcurrent, handshakesPerMinute int) HandlerOption {
+	return func(h *Handler) {
+		h.perIP = newPerIPLimiter(maxConcurrent, handshakesPerMinute)
+	}
+}
+
+type ipEntry struct {
+	lastSeen time.Time
+	bucket   *tokenBucket
+	elem     *list.Element
+	key      netip.Prefix
+	active   int
+}
+
+type perIPLimiter struct {
+	entries       map[netip.Prefix]*ipEntry
+	lru           *list.List
+	newBucket     func() *tokenBucket
+	rejected      atomic.Int64
+	maxConcurrent int
+	mu            sync.Mutex
+}
+
+func newPerIPLimiter(maxConcurrent, perMinute int) *perIPLimiter {
+	l := &perIPLimiter{
+		entries:       make(map[netip.Prefix]*ipEntry),
+		lru:           list.New(),
+		maxConcurrent: maxConcurrent,
+	}
+	if perMinute > 0 {
+		l.newBucket = func() *tokenBucket {
+			tb := newTokenBucket(1, perMinute)
+			tb.rate = float64(perMinute) / 60
+			return tb
+		}
+	}
+	return l
+}
+
+func ipBucketKey(addr netip.Addr) netip.Prefix {
+	if addr.Is4() {
+		return netip.PrefixFrom(addr, 32)
+	}
+	prefix, _ := addr.Prefix(64)
+	return prefix
+}
+
+func (l *perIPLimiter) entry(key netip.Prefix, now time.Time) *ipEntry {
+	if e, ok := l.entries[key]; ok {
+		l.lru.MoveToFront(e.elem)
+		return e
+	}
+
+	for l.lru.Len() >= perIPTableSize {
+		oldest := l.lru.Back()
+		old := oldest.Value.(*ipEntry)
+		l.lru.Remove(oldest)
+		delete(l.entries, old.key)
+	}
+	for back := l.lru.Back(); back != nil; back = l.lru.Back() {
+		old := back.Value.(*ipEntry)
+		if old.active > 0 || now.Sub(old.lastSeen) < perIPExpiry {
+			break
+		}
+		l.lru.Remove(back)
+		delete(l.entries, old.key)
+	}
+
+	e := &ipEntry{key: key}
+	if l.newBucket != nil {
+		e.bucket = l.newBucket()
+	}
+	e.elem = l.lru.PushFront(e)
+	l.entries[key] = e
+	return e
+}
+
+func (l *perIPLimiter) acquire(addr netip.Addr) (release func(), ok bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := l.entry(ipBucketKey(addr), now)
+	e.lastSeen = now
+	if l.maxConcurrent > 0 && e.active >= l.maxConcurrent {
+		l.rejected.Add(1)
+		return nil, false
+	}
+	if e.bucket != nil && !e.bucket.allow() {
+		l.rejected.Add(1)
+		return nil, false
+	}
+	e.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			e.active--
+			e.lastSeen = time.Now()
+		})
+	}, true
+}
+
+func rejectTooManyRequests(w http.ResponseWriter) {
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+type sessionContextKey struct{}
+
+func WithPreflightDial(enabled bool) HandlerOption {
+	return func(h *Handler) {
+		h.preflightDial = enabled
+	}
+}
+
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Detail string `json:"detail,omitempty"`
+	Status int    `json:"status"`
+}
+
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+}
+
+func (h *Handler) servePreflight(w http.ResponseWriter, req *http.Request) {
+	// Dial only for requests the upgrade would accept, so that plain GETs
+	// and foreign origins cannot open target connections.
+	if !isUpgradeRequest(req) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if checkedHandshake(req) == nil {
+		if err := h.validateHandshake(&websocket.Config{Version: websocket.ProtocolVersionHybi13}, req); err != nil {
+			writeProblem(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+	target, ok := h.sessionTarget(req)
+	if !ok {
+		h.logRejected(req, http.StatusForbidden, errNoSubprotocolRoute.Error())
+		h.metrics.Handshake(HandshakeRejectedSubprotocol)
+		writeProblem(w, http.StatusForbidden, errNoSubprotocolRoute.Error())
+		return
+	}
+	s := newSession(h, req, target)
+	// Until the upgrade, the client going away should also stop the dial.
+	stop := context.AfterFunc(req.Context(), s.cancel)
+	start := time.Now()
+	conn, err := h.dialWithRetry(s)
+	if !stop() && err == nil {
+		_ = conn.Close()
+		err = req.Context().Err()
+	}
+	h.metrics.TargetDialed(s.target, time.Since(start), err)
+	if err != nil {
+		s.setErr(peerTarget, err)
+		s.setReason(dialErrorReason(err))
+		s.endUnupgraded()
+		status := http.StatusBadGateway
+		if errors.Is(err, ErrDialVetoed) {
+			status = http.StatusForbidden
+		}
+		writeProblem(w, status, dialErrorReason(err))
+		return
+	}
+	s.setConn(h.resumable(s, conn))
+
+	h.upgrade(w, req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, s)))
+
+	if s.ws == nil {
+		_ = conn.Close()
+		s.setReason("upgrade failed")
+		s.endUnupgraded()
+	}
+}
+
+// endUnupgraded ends a preflight session that never reached the websocket,
+// still pairing the connection callbacks.
+func (s *session) endUnupgraded() {
+	if s.h.onConnect != nil {
+		s.h.onConnect(s.info())
+	}
+	s.finish()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingTarget echoes like echoTarget and counts accepted connections.
+func countingTarget(t *testing.T) (string, *atomic.Int32) {
+	var n atomic.Int32
+	addr := startTarget(t, func(conn net.Conn) {
+		n.Add(1)
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		for {
+			m, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write(buf[:m])
+		}
+	})
+	return addr, &n
+}
+
+func TestPreflightDialUpgrades(t *testing.T) {
+	target, dials := countingTarget(t)
+	ws := dialWS(t, startHandler(t, NewHandler(target, WithPreflightDial(true))), nil)
+	sendBinary(t, ws, []byte("ping"))
+	if f := readFrame(t, ws); string(f.payload) != "ping" {
+		t.Fatalf("got %q", f.payload)
+	}
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("%d target dials, want 1", n)
+	}
+}
+
+func TestPreflightDialFailure(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+	url := startHandler(t, NewHandler(addr, WithPreflightDial(true)))
+	resp := upgradeResponse(t, url, nil)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502", resp.StatusCode)
+	}
+	var p problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil || p.Status != http.StatusBadGateway {
+		t.Fatalf("problem %+v, %v", p, err)
+	}
+}
+
+func TestPreflightDialNotForInvalidUpgrades(t *testing.T) {
+	target, dials := countingTarget(t)
+	url := startHandler(t, NewHandler(target, WithPreflightDial(true), WithAllowedOrigins("https://app.example.com")))
+	httpURL := "http" + strings.TrimPrefix(url, "ws")
+
+	resp, err := http.Get(httpURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain GET: status %d, want 400", resp.StatusCode)
+	}
+	resp = upgradeResponse(t, url, http.Header{"Origin": {"https://evil.example.com"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bad origin: status %d, want 403", resp.StatusCode)
+	}
+	if n := dials.Load(); n != 0 {
+		t.Fatalf("%d target dials for rejected requests, want 0", n)
+	}
+	resp = upgradeResponse(t, url, http.Header{"Origin": {"https://app.example.com"}})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("allowed origin: status %d, want 101", resp.StatusCode)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// WithProxyProtocol writes a PROXY protocol header of the given version (1 or
+// 2) on every target connection before any relayed bytes, carrying the
+// websocket client's address as the source.
+func WithProxyProtocol(version int) HandlerOption {
+	if version != 1 && version != 2 {
+		panic(fmt.Sprintf("wst: unsupported PROXY protocol version %d", version))
+	}
+	return func(h *Handler) {
+		h.proxyProtocol = version
+	}
+}
+
+func (s *session) clientAddrPort() netip.AddrPort {
+	ip := s.h.clientIP(s.req)
+	if ap, err := netip.ParseAddrPort(s.req.RemoteAddr); err == nil && ap.Addr().Unmap() == ip {
+		return netip.AddrPortFrom(ip, ap.Port())
+	}
+	return netip.AddrPortFrom(ip, 0)
+}
+
+func (s *session) writeProxyHeader(conn net.Conn) error {
+	dst, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	header := proxyHeader(s.h.proxyProtocol, s.clientAddrPort(), dst)
+	if deadline, ok := s.ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(deadline)
+	} else {
+		_ = conn.SetWriteDeadline(time.Now().Add(s.h.targetDialTimeout))
+	}
+	_, err := conn.Write(header)
+	_ = conn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// proxyAddrs normalizes src and dst to a common address family, mapping IPv4
+// into IPv6 when they differ. ok is false if either address is unknown.
+func proxyAddrs(src, dst netip.AddrPort) (netip.AddrPort, netip.AddrPort, bool) {
+	if !src.IsValid() || !dst.IsValid() {
+		return src, dst, false
+	}
+	sa, da := src.Addr().Unmap(), dst.Addr().Unmap()
+	if sa.Is4() != da.Is4() {
+		sa, da = netip.AddrFrom16(sa.As16()), netip.AddrFrom16(da.As16())
+	}
+	return netip.AddrPortFrom(sa, src.Port()), netip.AddrPortFrom(da, dst.Port()), true
+}
+
+func proxyHeader(version int, src, dst netip.AddrPort) []byte {
+	src, dst, ok := proxyAddrs(src, dst)
+	if version == 1 {
+		if !ok {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto := "TCP4"
+		if !src.Addr().Is4() {
+			proto = "TCP6"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n",
+			proto, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21)
+	if !ok {
+		return append(header, 0x00, 0x00, 0x00)
+	}
+	var addrs []byte
+	if src.Addr().Is4() {
+		header = append(header, 0x11)
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		addrs = append(s[:], d[:]...)
+	} else {
+		header = append(header, 0x21)
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		addrs = append(s[:], d[:]...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
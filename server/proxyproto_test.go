@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// proxyInfo is a parsed PROXY protocol header; src and dst are invalid for
+// UNKNOWN (v1) or LOCAL/UNSPEC (v2) headers.
+type proxyInfo struct {
+	family   string
+	src, dst netip.AddrPort
+}
+
+func readProxyHeader(r *bufio.Reader) (proxyInfo, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return proxyInfo{}, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	return readProxyV1(r)
+}
+
+func readProxyV1(r *bufio.Reader) (proxyInfo, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return proxyInfo{}, err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return proxyInfo{}, fmt.Errorf("v1 header %q not ended by CRLF", line)
+	}
+	f := strings.Fields(strings.TrimSuffix(line, "\r\n"))
+	if len(f) < 2 || f[0] != "PROXY" {
+		return proxyInfo{}, fmt.Errorf("bad v1 header %q", line)
+	}
+	if f[1] == "UNKNOWN" {
+		return proxyInfo{family: "UNKNOWN"}, nil
+	}
+	if len(f) != 6 {
+		return proxyInfo{}, fmt.Errorf("bad v1 header %q", line)
+	}
+	addr := func(ip, port string) (netip.AddrPort, error) {
+		a, err := netip.ParseAddr(ip)
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		if (f[1] == "TCP4") != a.Is4() {
+			return netip.AddrPort{}, fmt.Errorf("address %s in a %s header", a, f[1])
+		}
+		return netip.AddrPortFrom(a, uint16(p)), nil
+	}
+	src, err := addr(f[2], f[4])
+	if err != nil {
+		return proxyInfo{}, err
+	}
+	dst, err := addr(f[3], f[5])
+	if err != nil {
+		return proxyInfo{}, err
+	}
+	return proxyInfo{family: f[1], src: src, dst: dst}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (proxyInfo, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return proxyInfo{}, err
+	}
+	if head[12] != 0x21 {
+		return proxyInfo{}, fmt.Errorf("version/command %#x, want PROXY v2", head[12])
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return proxyInfo{}, err
+	}
+	var size int
+	var family string
+	switch head[13] {
+	case 0x00:
+		return proxyInfo{family: "UNSPEC"}, nil
+	case 0x11:
+		size, family = 4, "TCP4"
+	case 0x21:
+		size, family = 16, "TCP6"
+	default:
+		return proxyInfo{}, fmt.Errorf("family/protocol %#x", head[13])
+	}
+	if len(body) < 2*size+4 {
+		return proxyInfo{}, fmt.Errorf("address block of %d bytes", len(body))
+	}
+	src, _ := netip.AddrFromSlice(body[:size])
+	dst, _ := netip.AddrFromSlice(body[size : 2*size])
+	ports := body[2*size:]
+	return proxyInfo{
+		family: family,
+		src:    netip.AddrPortFrom(src, binary.BigEndian.Uint16(ports)),
+		dst:    netip.AddrPortFrom(dst, binary.BigEndian.Uint16(ports[2:])),
+	}, nil
+}
+
+func TestProxyHeader(t *testing.T) {
+	v4a := netip.MustParseAddrPort("192.0.2.1:1234")
+	v4b := netip.MustParseAddrPort("198.51.100.2:443")
+	v6a := netip.MustParseAddrPort("[2001:db8::1]:1234")
+	mapped := netip.MustParseAddrPort("[::ffff:192.0.2.1]:1234")
+	for _, tc := range []struct {
+		name     string
+		src, dst netip.AddrPort
+		v1       proxyInfo
+		v2       proxyInfo
+	}{
+		{"ipv4", v4a, v4b, proxyInfo{"TCP4", v4a, v4b}, proxyInfo{"TCP4", v4a, v4b}},
+		{"ipv6", v6a, v6a, proxyInfo{"TCP6", v6a, v6a}, proxyInfo{"TCP6", v6a, v6a}},
+		{"v4-mapped source", mapped, v4b, proxyInfo{"TCP4", v4a, v4b}, proxyInfo{"TCP4", v4a, v4b}},
+		{
+			"mixed families", v4a, v6a,
+			proxyInfo{"TCP6", mapped, v6a},
+			proxyInfo{"TCP6", mapped, v6a},
+		},
+		{"unknown", netip.AddrPort{}, v4b, proxyInfo{family: "UNKNOWN"}, proxyInfo{family: "UNSPEC"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for version, want := range map[int]proxyInfo{1: tc.v1, 2: tc.v2} {
+				header := proxyHeader(version, tc.src, tc.dst)
+				r := bufio.NewReader(io.MultiReader(bytes.NewReader(header), strings.NewReader("payload")))
+				got, err := readProxyHeader(r)
+				if err != nil {
+					t.Fatalf("v%d: %v", version, err)
+				}
+				if got != want {
+					t.Fatalf("v%d: got %+v, want %+v", version, got, want)
+				}
+				if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+					t.Fatalf("v%d: header length off, data after it is %q", version, rest)
+				}
+			}
+		})
+	}
+}
+
+// proxyTarget starts a target that reads a PROXY header, sends the parsed
+// header on headers and then echoes.
+func proxyTarget(t *testing.T) (string, <-chan proxyInfo) {
+	headers := make(chan proxyInfo, 1)
+	addr := startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		info, err := readProxyHeader(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		headers <- info
+		_, _ = io.Copy(conn, r)
+	})
+	return addr, headers
+}
+
+func TestProxyProtocolToTarget(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			target, headers := proxyTarget(t)
+			h := NewHandler(target, WithProxyProtocol(version))
+			echoOnce(t, startHandler(t, h))
+			info := <-headers
+			if info.family != "TCP4" || info.src.Addr() != netip.MustParseAddr("127.0.0.1") || info.src.Port() == 0 {
+				t.Fatalf("header %+v, want the client's loopback address", info)
+			}
+			if info.dst.String() != target {
+				t.Fatalf("destination %s, want %s", info.dst, target)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolForwardedClient(t *testing.T) {
+	target, headers := proxyTarget(t)
+	h := NewHandler(target, WithProxyProtocol(2), WithTrustedProxies("127.0.0.0/8"))
+	ws := dialWS(t, startHandler(t, h), http.Header{"X-Forwarded-For": {"203.0.113.9"}})
+	sendBinary(t, ws, []byte("ping"))
+	readFrame(t, ws)
+	// Only the address is forwarded, so the source port is unknown.
+	if info := <-headers; info.src != netip.MustParseAddrPort("203.0.113.9:0") {
+		t.Fatalf("source %s, want the forwarded client", info.src)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	last   time.Time
+	rate   float64
+	burst  float64
+	tokens float64
+	mu     sync.Mutex
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+func (tb *tokenBucket) allow() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(time.Now())
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+func (tb *tokenBucket) wait(ctx context.Context, n int) error {
+	tb.mu.Lock()
+	tb.refill(time.Now())
+	tb.tokens -= float64(n)
+	deficit := -tb.tokens
+	tb.mu.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / tb.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func WithPerConnRateLimit(bytesPerSec, burst int) HandlerOption {
+	return func(h *Handler) {
+		h.connRate = bytesPerSec
+		h.connBurst = burst
+	}
+}
+
+func WithPerConnRateLimitShared(shared bool) HandlerOption {
+	return func(h *Handler) {
+		h.connRateShared = shared
+	}
+}
+
+type rateLimitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	tb  *tokenBucket
+	max int
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	if len(b) > r.max {
+		b = b[:r.max]
+	}
+	n, err := r.r.Read(b)
+	if n > 0 {
+		if werr := r.tb.wait(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (s *session) rateLimiters() (up, down *tokenBucket) {
+	h := s.h
+	if h.connRate <= 0 {
+		return nil, nil
+	}
+	up = newTokenBucket(h.connRate, h.connBurst)
+	if h.connRateShared {
+		return up, up
+	}
+	return up, newTokenBucket(h.connRate, h.connBurst)
+}
+
+func (s *session) limit(r io.Reader, tb *tokenBucket) io.Reader {
+	if tb == nil {
+		return r
+	}
+	return &rateLimitedReader{
+		ctx: s.ctx,
+		r:   r,
+		tb:  tb,
+		max: int(tb.burst),
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// bulkTarget starts a target that sends n bytes and closes.
+func bulkTarget(t *testing.T, n int) string {
+	return startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = conn.Write(make([]byte, n))
+	})
+}
+
+// timeDownload reads frames until the close and returns the bytes received
+// and the time taken.
+func timeDownload(t *testing.T, ws *websocket.Conn) (int, time.Duration) {
+	start := time.Now()
+	var got int
+	for {
+		f := readFrame(t, ws)
+		if f.opcode == websocket.CloseFrame {
+			return got, time.Since(start)
+		}
+		got += len(f.payload)
+	}
+}
+
+func TestPerConnRateLimit(t *testing.T) {
+	// A scaled-down version of 1 MB at 100 KB/s: the burst goes at once and
+	// the rest at the rate, so 500 KB at 500 KB/s takes about 0.9s.
+	const size, rate, burst = 500 << 10, 500 << 10, 50 << 10
+	h := NewHandler(bulkTarget(t, size), WithPerConnRateLimit(rate, burst))
+	ws := dialWS(t, startHandler(t, h), nil)
+	got, d := timeDownload(t, ws)
+	if got != size {
+		t.Fatalf("received %d bytes, want %d", got, size)
+	}
+	want := time.Duration(float64(size-burst) / rate * float64(time.Second))
+	if d < want*8/10 || d > want*3 {
+		t.Fatalf("transfer took %v, want about %v", d, want)
+	}
+}
+
+func TestPerConnRateLimitWriteTimeout(t *testing.T) {
+	// Waiting for tokens takes longer than the write timeout but does not
+	// count as a stalled write.
+	const size = 64 << 10
+	h := NewHandler(bulkTarget(t, size), WithPerConnRateLimit(128<<10, 8<<10), WithWriteTimeout(50*time.Millisecond))
+	ws := dialWS(t, startHandler(t, h), nil)
+	if got, _ := timeDownload(t, ws); got != size {
+		t.Fatalf("received %d bytes, want %d", got, size)
+	}
+}
+
+func TestPerConnRateLimitUp(t *testing.T) {
+	const size, rate = 64 << 10, 128 << 10
+	received := make(chan int, 1)
+	target := startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, io.LimitReader(conn, size))
+		received <- int(n)
+	})
+	h := NewHandler(target, WithPerConnRateLimit(rate, 8<<10))
+	ws := dialWS(t, startHandler(t, h), nil)
+	start := time.Now()
+	sendBinary(t, ws, bytes.Repeat([]byte("u"), size))
+	if n := <-received; n != size {
+		t.Fatalf("target received %d bytes, want %d", n, size)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("uploaded %d bytes in %v, faster than the rate limit", size, d)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import "syscall"
+
+func readable(syscall.Conn) (readable, ok bool) {
+	return false, false
+}
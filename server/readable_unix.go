@@ -0,0 +1,27 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// readable reports whether a read from c would return without blocking; ok is
+// false if that cannot be determined.
+func readable(c syscall.Conn) (readable, ok bool) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+	var b [1]byte
+	var rerr error
+	err = raw.Control(func(fd uintptr) {
+		_, _, rerr = syscall.Recvfrom(int(fd), b[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+	})
+	if err != nil {
+		return false, false
+	}
+	// Data, EOF and errors all return immediately.
+	return !errors.Is(rerr, syscall.EAGAIN), true
+}
@@ -0,0 +1,12 @@
+package main
+
+import "net/http"
+
+// WithHandlerRedirect lets fn send clients to another tunnel server. When fn
+// returns true the upgrade is answered with a 307 redirect to the returned
+// URL instead of being accepted.
+func WithHandlerRedirect(fn func(r *http.Request) (string, bool)) HandlerOption {
+	return func(h *Handler) {
+		h.redirect = fn
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitDrained waits for every session of h to have ended.
+func waitDrained(t *testing.T, h *Handler) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Stats().ActiveSessions != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions still active", h.Stats().ActiveSessions)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// floodTarget writes to each connection until it fails, discarding what it
+// reads, and reports on done when the connection has ended.
+func floodTarget(t *testing.T, done chan<- struct{}) string {
+	return startTarget(t, func(conn net.Conn) {
+		defer func() { done <- struct{}{} }()
+		defer conn.Close()
+		go func() { _, _ = io.Copy(io.Discard, conn) }()
+		chunk := make([]byte, 16<<10)
+		for {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestRelayTargetClosesFirst(t *testing.T) {
+	target := startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err == nil {
+			_, _ = conn.Write(buf)
+		}
+	})
+	l := newCallbackLog()
+	h := NewHandler(target, l.option())
+	ws := dialWS(t, startHandler(t, h), nil)
+	sendBinary(t, ws, []byte("hello"))
+	if f := readFrame(t, ws); string(f.payload) != "hello" {
+		t.Fatalf("read %q", f.payload)
+	}
+	// Keep uploading while the target goes away.
+	go func() {
+		for {
+			if _, err := ws.Write([]byte("more")); err != nil {
+				return
+			}
+		}
+	}()
+	readClose(t, ws)
+	l.wait(t)
+	waitDrained(t, h)
+}
+
+func TestRelayClientClosesFirst(t *testing.T) {
+	done := make(chan struct{}, 1)
+	l := newCallbackLog()
+	h := NewHandler(floodTarget(t, done), l.option())
+	ws := dialWS(t, startHandler(t, h), nil)
+	sendBinary(t, ws, []byte("go"))
+	readFrame(t, ws)
+	ws.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("target still writing after the client went away")
+	}
+	l.wait(t)
+	waitDrained(t, h)
+}
+
+func TestRelayTargetEOFWhileUploadStalls(t *testing.T) {
+	// The target stops reading, so the upload blocks, and then ends its side.
+	// Write timeouts are off: only the download ending can unblock the upload.
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	t.Cleanup(func() { close(finished) })
+	target := startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		<-release
+		_ = conn.(*net.TCPConn).CloseWrite()
+		<-finished
+	})
+	l := newCallbackLog()
+	h := NewHandler(target, WithWriteTimeout(0), l.option())
+	ws := dialWS(t, startHandler(t, h), nil)
+	go func() {
+		chunk := make([]byte, 64<<10)
+		for {
+			if _, err := ws.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	close(release)
+	readClose(t, ws)
+	l.wait(t)
+	waitDrained(t, h)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("session ended %v after the target's EOF", elapsed)
+	}
+}
+
+func TestRelaySimultaneousClose(t *testing.T) {
+	// The target closes as soon as it reads, while the client closes right
+	// after writing, in a loop so both orderings come up.
+	target := startTarget(t, func(conn net.Conn) {
+		_, _ = conn.Read(make([]byte, 1))
+		conn.Close()
+	})
+	h := NewHandler(target)
+	url := startHandler(t, h)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws, err := dialWSErr(url, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			_, _ = ws.Write([]byte("x"))
+			ws.Close()
+		}()
+	}
+	wg.Wait()
+	waitDrained(t, h)
+	if s := h.Stats(); s.TotalSessions != 50 || s.BytesUp > 50 {
+		t.Fatalf("%d sessions relayed %d bytes up", s.TotalSessions, s.BytesUp)
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ResumeHeader carries "new" or a resume token in the request, and the
+	// token for the session in the response.
+	ResumeHeader = "X-WST-Resume"
+	// ResumeOffsetHeader carries the number of stream bytes the sender has
+	// received so far when a session is resumed.
+	ResumeOffsetHeader = "X-WST-Resume-Offset"
+
+	// DefaultResumeBuffer is how much target data is kept for replay after
+	// it has been sent to the client. It has to cover what may be in flight
+	// on a dropped websocket, socket buffers included.
+	DefaultResumeBuffer = 4 << 20
+	// DefaultResumeBufferLimit caps the replay buffers of all resumable
+	// sessions together.
+	DefaultResumeBufferLimit = 256 << 20
+
+	// resumeReadAhead bounds the target data read but not yet sent.
+	resumeReadAhead = 256 * 1024
+)
+
+var (
+	errUnknownResume = errors.New("unknown or expired resume token")
+	errResumeOffset  = errors.New("resume offset outside replay buffer")
+)
+
+// WithResumableSessions keeps the target connection of sessions whose client
+// asked for resumption open for grace after the websocket drops without a
+// close frame. A client reconnecting with the session's resume token and the
+// number of bytes it received re-attaches to the same target: both sides
+// replay what the other did not receive, so the stream continues intact.
+// Each websocket is still reported as its own session.
+//
+// Only requests allowed by WithResumePolicy get a resumable session; others
+// are served as usual. A session can only be resumed by a request with the
+// same authenticated principal as the one that started it.
+func WithResumableSessions(grace time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.resumeGrace = grace
+	}
+}
+
+// WithResumeBuffer sets the replay buffer of each resumable session, which
+// defaults to DefaultResumeBuffer, and limit, the total for all of them. A
+// session that would exceed limit is not made resumable.
+func WithResumeBuffer(size int, limit int64) HandlerOption {
+	if size <= 0 || limit < int64(size) {
+		panic(fmt.Sprintf("wst: invalid resume buffer %d with limit %d", size, limit))
+	}
+	return func(h *Handler) {
+		h.resumeBuffer = size
+		h.resumeBufferLimit = limit
+	}
+}
+
+// WithResumePolicy makes resumable sessions available to the requests for
+// which allow reports true. Without a policy they are available to requests
+// with an authenticated principal: a WithBasicAuth user, the subject of a
+// JWT or a verified client certificate.
+func WithResumePolicy(allow func(req *http.Request) bool) HandlerOption {
+	return func(h *Handler) {
+		h.resumePolicy = allow
+	}
+}
+
+// resumePrincipal identifies who authenticated req, or returns "".
+func resumePrincipal(req *http.Request) string {
+	if user := UserFromContext(req.Context()); user != "" {
+		return "user:" + user
+	}
+	if sub, _ := JWTClaimsFromContext(req.Context())["sub"].(string); sub != "" {
+		return "jwt:" + sub
+	}
+	if cert := ClientCertificate(req); cert != nil {
+		sum := sha256.Sum256(cert.Raw)
+		return "cert:" + hex.EncodeToString(sum[:])
+	}
+	return ""
+}
+
+func (h *Handler) allowResume(req *http.Request) bool {
+	if h.resumePolicy != nil {
+		return h.resumePolicy(req)
+	}
+	return resumePrincipal(req) != ""
+}
+
+// reserveResumeBuffer accounts a replay buffer against the limit, reporting
+// false if it does not fit.
+func (h *Handler) reserveResumeBuffer() bool {
+	if h.resumeBuffered.Add(int64(h.resumeBuffer)) > h.resumeBufferLimit {
+		h.resumeBuffered.Add(-int64(h.resumeBuffer))
+		return false
+	}
+	return true
+}
+
+type resumeContextKey struct{}
+
+// resumeRequest is attached to the request context of handshakes that start
+// or resume a resumable session.
+type resumeRequest struct {
+	token     string
+	principal string
+	// reserved is set while a replay buffer is accounted to a new session
+	// that has not created its resumable conn.
+	reserved atomic.Bool
+	// handle and offset are set when resuming.
+	handle *resumeHandle
+	offset int64
+}
+
+func resumeFromContext(req *http.Request) *resumeRequest {
+	rr, _ := req.Context().Value(resumeContextKey{}).(*resumeRequest)
+	return rr
+}
+
+func newResumeToken() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// prepareResume handles the resume headers before the upgrade, claiming the
+// parked target connection when resuming.
+func (h *Handler) prepareResume(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	token := req.Header.Get(ResumeHeader)
+	if token == "" {
+		return req, true
+	}
+	rr := &resumeRequest{token: token, principal: resumePrincipal(req)}
+	if token == "new" {
+		if !h.allowResume(req) {
+			h.logger.Debug("resumable session not allowed", slog.String("remote_addr", req.RemoteAddr))
+			return req, true
+		}
+		if !h.reserveResumeBuffer() {
+			h.logger.Info("resume buffer limit reached, session is not resumable", slog.String("remote_addr", req.RemoteAddr))
+			return req, true
+		}
+		rr.token = newResumeToken()
+		rr.reserved.Store(true)
+	} else {
+		offset, err := strconv.ParseInt(req.Header.Get(ResumeOffsetHeader), 10, 64)
+		if err == nil {
+			rr.handle, rr.offset, err = h.claimResumable(token, rr.principal, offset)
+		}
+		if err != nil {
+			h.logRejected(req, http.StatusNotFound, err.Error())
+			h.metrics.Handshake(HandshakeRejectedResume)
+			http.NotFound(w, req)
+			return req, false
+		}
+	}
+	return req.WithContext(context.WithValue(req.Context(), resumeContextKey{}, rr)), true
+}
+
+func (h *Handler) claimResumable(token, principal string, offset int64) (*resumeHandle, int64, error) {
+	h.resumablesMu.Lock()
+	rc, ok := h.resumables[token]
+	h.resumablesMu.Unlock()
+	// A token presented by someone else is treated as unknown.
+	if !ok || subtle.ConstantTimeCompare([]byte(rc.principal), []byte(principal)) != 1 {
+		return nil, 0, errUnknownResume
+	}
+	return rc.claim(offset)
+}
+
+// releaseResume returns the replay buffer reserved for rr if the session
+// ended without creating its resumable conn.
+func (h *Handler) releaseResume(rr *resumeRequest) {
+	if rr.reserved.Swap(false) {
+		h.resumeBuffered.Add(-int64(h.resumeBuffer))
+	}
+}
+
+func (h *Handler) newResumable(rr *resumeRequest, target string, conn net.Conn) *resumeHandle {
+	rr.reserved.Store(false)
+	rc := &resumableConn{
+		Conn:      conn,
+		h:         h,
+		token:     rr.token,
+		principal: rr.principal,
+		target:    target,
+		size:      h.resumeBuffer,
+	}
+	rc.cond = sync.NewCond(&rc.mu)
+	h.resumablesMu.Lock()
+	if h.resumables == nil {
+		h.resumables = make(map[string]*resumableConn)
+	}
+	h.resumables[rc.token] = rc
+	h.resumablesMu.Unlock()
+	go rc.pump()
+	return &resumeHandle{rc: rc}
+}
+
+func (h *Handler) closeResumables() {
+	h.resumablesMu.Lock()
+	resumables := make([]*resumableConn, 0, len(h.resumables))
+	for _, rc := range h.resumables {
+		resumables = append(resumables, rc)
+	}
+	h.resumablesMu.Unlock()
+	for _, rc := range resumables {
+		rc.close()
+	}
+}
+
+// resumableConn owns a target connection across the websockets of a
+// resumable session. A single pump reads the target into a buffer that keeps
+// the last size bytes delivered to the client for replay. Each attached
+// websocket gets a resumeHandle; attaching a new one invalidates the old.
+type resumableConn struct {
+	net.Conn
+	h         *Handler
+	token     string
+	principal string
+	target    string
+	size      int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// data holds the target stream from offset start to end; read is the
+	// offset of the next byte to deliver.
+	data    []byte
+	start   int64
+	read    int64
+	end     int64
+	readErr error
+	gen     int
+	timer   *time.Timer
+	closed  bool
+
+	wmu     sync.Mutex
+	written int64
+}
+
+func (rc *resumableConn) pump() {
+	buf := make([]byte, 32*1024)
+	for {
+		rc.mu.Lock()
+		for rc.end-rc.read >= resumeReadAhead && !rc.closed {
+			rc.cond.Wait()
+		}
+		closed := rc.closed
+		rc.mu.Unlock()
+		if closed {
+			return
+		}
+
+		n, err := rc.Conn.Read(buf)
+		rc.mu.Lock()
+		rc.data = append(rc.data, buf[:n]...)
+		rc.end += int64(n)
+		if err != nil {
+			rc.readErr = err
+		}
+		rc.cond.Broadcast()
+		rc.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (rc *resumableConn) readAt(gen int, b []byte) (int, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for {
+		if rc.gen != gen || rc.closed {
+			return 0, net.ErrClosed
+		}
+		if rc.read < rc.end {
+			n := copy(b, rc.data[rc.read-rc.start:])
+			rc.read += int64(n)
+			rc.trim()
+			rc.cond.Broadcast()
+			return n, nil
+		}
+		if rc.readErr != nil {
+			return 0, rc.readErr
+		}
+		rc.cond.Wait()
+	}
+}
+
+// trim drops data older than the replay window, in batches to amortize the
+// copy.
+func (rc *resumableConn) trim() {
+	drop := rc.read - int64(rc.size) - rc.start
+	if drop < int64(rc.size)/2 {
+		return
+	}
+	n := copy(rc.data, rc.data[drop:])
+	rc.data = rc.data[:n]
+	rc.start += drop
+}
+
+func (rc *resumableConn) writeAt(gen int, b []byte) (int, error) {
+	rc.wmu.Lock()
+	defer rc.wmu.Unlock()
+	rc.mu.Lock()
+	stale := rc.gen != gen || rc.closed
+	rc.mu.Unlock()
+	if stale {
+		return 0, net.ErrClosed
+	}
+	n, err := rc.Conn.Write(b)
+	rc.written += int64(n)
+	return n, err
+}
+
+// claim attaches a new websocket that has received offset bytes, rewinding
+// delivery to that point. It returns the number of bytes written to the
+// target, which the client resends from.
+func (rc *resumableConn) claim(offset int64) (*resumeHandle, int64, error) {
+	rc.mu.Lock()
+	if rc.closed {
+		rc.mu.Unlock()
+		return nil, 0, errUnknownResume
+	}
+	if offset < rc.start || offset > rc.read {
+		rc.mu.Unlock()
+		return nil, 0, errResumeOffset
+	}
+	if rc.timer != nil {
+		rc.timer.Stop()
+		rc.timer = nil
+	}
+	rc.gen++
+	rc.read = offset
+	gen := rc.gen
+	rc.cond.Broadcast()
+	rc.mu.Unlock()
+
+	// Wait for a write from the previous websocket to finish so that the
+	// reported offset covers it.
+	rc.wmu.Lock()
+	written := rc.written
+	_ = rc.Conn.SetWriteDeadline(time.Time{})
+	rc.wmu.Unlock()
+	return &resumeHandle{rc: rc, gen: gen}, written, nil
+}
+
+// park detaches the websocket of generation gen and closes the target if no
+// new one attaches within the grace period.
+func (rc *resumableConn) park(gen int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.gen != gen || rc.closed {
+		return
+	}
+	rc.gen++
+	rc.cond.Broadcast()
+	// Unblock a write of the detached websocket; claim clears the deadline.
+	_ = rc.Conn.SetWriteDeadline(time.Unix(1, 0))
+	parked := rc.gen
+	rc.timer = time.AfterFunc(rc.h.resumeGrace, func() {
+		rc.mu.Lock()
+		expired := rc.gen == parked
+		rc.mu.Unlock()
+		if expired {
+			rc.h.logger.Debug("resumable session expired", slog.String("target", rc.target))
+			rc.close()
+		}
+	})
+}
+
+func (rc *resumableConn) close() {
+	rc.mu.Lock()
+	if rc.closed {
+		rc.mu.Unlock()
+		return
+	}
+	rc.closed = true
+	if rc.timer != nil {
+		rc.timer.Stop()
+	}
+	rc.cond.Broadcast()
+	rc.mu.Unlock()
+
+	rc.h.resumablesMu.Lock()
+	delete(rc.h.resumables, rc.token)
+	rc.h.resumablesMu.Unlock()
+	rc.h.resumeBuffered.Add(-int64(rc.size))
+	_ = rc.Conn.Close()
+}
+
+// resumeHandle is the target conn as seen by the session of one websocket.
+// Closing it parks the target if the session lost its transport and closes
+// the target otherwise.
+type resumeHandle struct {
+	rc   *resumableConn
+	gen  int
+	lost atomic.Bool
+	once sync.Once
+}
+
+func (c *resumeHandle) Read(b []byte) (int, error) {
+	return c.rc.readAt(c.gen, b)
+}
+
+func (c *resumeHandle) Write(b []byte) (int, error) {
+	return c.rc.writeAt(c.gen, b)
+}
+
+func (c *resumeHandle) CloseWrite() error {
+	if cw, ok := c.rc.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *resumeHandle) Close() error {
+	c.once.Do(func() {
+		if c.lost.Load() && !c.rc.h.isClosed() {
+			c.rc.park(c.gen)
+			return
+		}
+		c.rc.mu.Lock()
+		current := c.rc.gen == c.gen
+		c.rc.mu.Unlock()
+		if current {
+			c.rc.close()
+		}
+	})
+	return nil
+}
+
+// detach parks the target unless a session already closed the handle.
+func (c *resumeHandle) detach() {
+	c.lost.Store(true)
+	_ = c.Close()
+}
+
+func (c *resumeHandle) LocalAddr() net.Addr                { return c.rc.LocalAddr() }
+func (c *resumeHandle) RemoteAddr() net.Addr               { return c.rc.RemoteAddr() }
+func (c *resumeHandle) SetDeadline(t time.Time) error      { return c.rc.SetWriteDeadline(t) }
+func (c *resumeHandle) SetReadDeadline(time.Time) error    { return nil }
+func (c *resumeHandle) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
+
+// markTransportLost records that the websocket failed without a close frame,
+// so that closing the target conn parks it for resumption instead.
+func (s *session) markTransportLost() {
+	// Errors after an abort come from closing the conns, not the transport.
+	if s.ctx.Err() != nil {
+		return
+	}
+	if hd, ok := s.getConn().(*resumeHandle); ok {
+		hd.lost.Store(true)
+	}
+}
+
+// resumable wraps a freshly dialed target conn when the client asked for a
+// resumable session.
+func (h *Handler) resumable(s *session, conn net.Conn) net.Conn {
+	if rr := resumeFromContext(s.req); rr != nil && rr.handle == nil {
+		return h.newResumable(rr, s.target, conn)
+	}
+	return conn
+}
+
+// attachResume hands a resumed session the claimed target conn.
+func (s *session) attachResume() {
+	if rr := resumeFromContext(s.req); rr != nil && rr.handle != nil {
+		s.target = rr.handle.rc.target
+		s.targetAddr = rr.handle.RemoteAddr().String()
+		s.setConn(rr.handle)
+	}
+}
+
+func setResumeHeaders(header http.Header, req *http.Request) {
+	rr := resumeFromContext(req)
+	if rr == nil {
+		return
+	}
+	header.Set(ResumeHeader, rr.token)
+	if rr.handle != nil {
+		header.Set(ResumeOffsetHeader, strconv.FormatInt(rr.offset, 10))
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func basicAuthUsers(t *testing.T, users ...string) map[string]string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]string, len(users))
+	for _, u := range users {
+		m[u] = string(hash)
+	}
+	return m
+}
+
+func resumeHeader(user, token, offset string) http.Header {
+	header := http.Header{ResumeHeader: {token}}
+	if offset != "" {
+		header.Set(ResumeOffsetHeader, offset)
+	}
+	if user != "" {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(user, "secret")
+		header.Set("Authorization", req.Header.Get("Authorization"))
+	}
+	return header
+}
+
+func TestResumeRequiresPrincipal(t *testing.T) {
+	url := startHandler(t, NewHandler(echoTarget(t), WithResumableSessions(time.Minute)))
+	resp := upgradeResponse(t, url, resumeHeader("", "new", ""))
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	if token := resp.Header.Get(ResumeHeader); token != "" {
+		t.Fatalf("anonymous session got resume token %q", token)
+	}
+}
+
+func TestResumeBoundToPrincipal(t *testing.T) {
+	h := NewHandler(echoTarget(t),
+		WithResumableSessions(time.Minute),
+		WithBasicAuth(basicAuthUsers(t, "alice", "bob")),
+	)
+	url := startHandler(t, h)
+	resp := upgradeResponse(t, url, resumeHeader("alice", "new", ""))
+	token := resp.Header.Get(ResumeHeader)
+	if token == "" {
+		t.Fatal("authenticated session got no resume token")
+	}
+	// Drop the websocket without a close frame.
+	resp.Body.Close()
+
+	if resp := upgradeResponse(t, url, resumeHeader("bob", token, "0")); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("resume by another user: status = %d, want 404", resp.StatusCode)
+	}
+	if resp := upgradeResponse(t, url, resumeHeader("alice", token, "0")); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("resume by the same user: status = %d, want 101", resp.StatusCode)
+	}
+}
+
+func TestResumeBufferLimit(t *testing.T) {
+	h := NewHandler(echoTarget(t),
+		WithResumableSessions(time.Millisecond),
+		WithResumePolicy(func(*http.Request) bool { return true }),
+		WithResumeBuffer(1024, 1024),
+	)
+	url := startHandler(t, h)
+	first := upgradeResponse(t, url, resumeHeader("", "new", ""))
+	if first.Header.Get(ResumeHeader) == "" {
+		t.Fatal("first session got no resume token")
+	}
+	if second := upgradeResponse(t, url, resumeHeader("", "new", "")); second.Header.Get(ResumeHeader) != "" {
+		t.Fatal("session over the buffer limit got a resume token")
+	}
+
+	// The buffer is returned once the first session expires.
+	first.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for upgradeResponse(t, url, resumeHeader("", "new", "")).Header.Get(ResumeHeader) == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("resume buffer never released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWithResumeBufferInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("WithResumeBuffer accepted a limit below the buffer size")
+		}
+	}()
+	WithResumeBuffer(1024, 512)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+)
+
+// WithTargetDialRetry dials the target up to attempts times, waiting backoff,
+// doubled after each retry, between attempts. Only connection refused and
+// timeout errors are retried. Each retry is logged, counted in
+// HandlerStats.DialRetries and reported to a DialRetryCollector.
+func WithTargetDialRetry(attempts int, backoff time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.dialRetryAttempts = attempts
+		h.dialRetryBackoff = backoff
+	}
+}
+
+func isRetryableDialError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (h *Handler) dialWithRetry(s *session) (net.Conn, error) {
+	backoff := h.dialRetryBackoff
+	for attempt := 1; ; attempt++ {
+		conn, err := h.dialSession(s.ctx, s)
+		if err == nil ||
+			attempt >= h.dialRetryAttempts ||
+			s.ctx.Err() != nil ||
+			!isRetryableDialError(err) {
+			return conn, err
+		}
+
+		if rc, ok := h.metrics.(DialRetryCollector); ok {
+			rc.TargetDialRetried(s.target, attempt, err)
+		}
+		s.logger.Warn("retrying target dial",
+			slog.String("target", s.target),
+			slog.Int("attempt", attempt),
+			slog.Duration("backoff", backoff),
+			slog.Any("error", err),
+		)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
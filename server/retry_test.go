@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type retryMetrics struct {
+	nopMetrics
+	mu       sync.Mutex
+	attempts []int
+}
+
+func (m *retryMetrics) TargetDialRetried(_ string, attempt int, _ error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attempts = append(m.attempts, attempt)
+}
+
+// flakyDialer refuses the first fails dials and then dials for real.
+func flakyDialer(fails int, err error) ContextDialer {
+	var mu sync.Mutex
+	return dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		fails--
+		refuse := fails >= 0
+		mu.Unlock()
+		if refuse {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", err)}
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	})
+}
+
+func TestTargetDialRetry(t *testing.T) {
+	m := &retryMetrics{}
+	h := NewHandler(echoTarget(t),
+		WithHandlerDialer(flakyDialer(2, syscall.ECONNREFUSED)),
+		WithTargetDialRetry(3, 10*time.Millisecond),
+		WithMetrics(m),
+	)
+	ws := dialWS(t, startHandler(t, h), nil)
+	sendBinary(t, ws, []byte("hi"))
+	if f := readFrame(t, ws); string(f.payload) != "hi" {
+		t.Fatalf("got %q", f.payload)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.attempts) != 2 || m.attempts[0] != 1 || m.attempts[1] != 2 {
+		t.Fatalf("retried attempts %v, want [1 2]", m.attempts)
+	}
+	if n := h.Stats().DialRetries; n != 2 {
+		t.Fatalf("Stats().DialRetries = %d, want 2", n)
+	}
+}
+
+func TestTargetDialRetryGivesUp(t *testing.T) {
+	h := NewHandler(echoTarget(t),
+		WithHandlerDialer(flakyDialer(5, syscall.ECONNREFUSED)),
+		WithTargetDialRetry(3, time.Millisecond),
+	)
+	ws := dialWS(t, startHandler(t, h), nil)
+	if code := readClose(t, ws); code != CloseInternalError {
+		t.Fatalf("close code %d, want %d", code, CloseInternalError)
+	}
+	if n := h.Stats().DialRetries; n != 2 {
+		t.Fatalf("Stats().DialRetries = %d, want 2", n)
+	}
+}
+
+func TestTargetDialRetryNotRetryable(t *testing.T) {
+	h := NewHandler(echoTarget(t),
+		WithHandlerDialer(flakyDialer(1, syscall.EACCES)),
+		WithTargetDialRetry(3, time.Millisecond),
+	)
+	ws := dialWS(t, startHandler(t, h), nil)
+	readClose(t, ws)
+	if n := h.Stats().DialRetries; n != 0 {
+		t.Fatalf("Stats().DialRetries = %d, want 0", n)
+	}
+}
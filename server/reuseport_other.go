@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return errReusePortUnsupported
+}
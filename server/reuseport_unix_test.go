@@ -0,0 +1,40 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func serveOn(t *testing.T, addr string, opts ...ServerOption) (*Server, net.Addr, error) {
+	t.Helper()
+	bound := make(chan net.Addr, 1)
+	s := NewServer(addr, "/", NewHandler("127.0.0.1:1"), append(opts, WithOnListen(func(a net.Addr) { bound <- a }))...)
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve() }()
+	select {
+	case a := <-bound:
+		t.Cleanup(func() { s.Close() })
+		return s, a, nil
+	case err := <-errc:
+		return nil, nil, err
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not listen")
+		return nil, nil, nil
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	_, addr, err := serveOn(t, "127.0.0.1:0", WithReusePort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := serveOn(t, addr.String(), WithReusePort()); err != nil {
+		t.Fatalf("second listener with SO_REUSEPORT: %v", err)
+	}
+	if _, _, err := serveOn(t, addr.String()); err == nil {
+		t.Fatal("listener without SO_REUSEPORT shared the port")
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zijiren233/gwst/internal/wire"
+	"golang.org/x/net/websocket"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+type Direction int
+
+const (
+	DirectionBoth Direction = iota
+	DirectionUp
+	DirectionDown
+)
+
+type ConnStats struct {
+	Err               error
+	ClientErr         error
+	TargetErr         error
+	Target            string
+	Reason            string
+	ClientCloseReason string
+	ClientCloseCode   int
+	Start             time.Time
+	Duration          time.Duration
+	BytesUp           int64
+	BytesDown         int64
+	// BytesWireUp and BytesWireDown count the tunnel data as carried in
+	// websocket frame payloads, after compression or text encoding. They
+	// equal BytesUp and BytesDown when neither is in use.
+	BytesWireUp   int64
+	BytesWireDown int64
+}
+
+type peer int
+
+const (
+	peerClient peer = iota
+	peerTarget
+)
+
+func WithHandlerOnClose(fn func(ConnStats)) HandlerOption {
+	return func(h *Handler) {
+		h.onClose = fn
+	}
+}
+
+// WithHandlerMaxBytes closes a session with 1008 "quota exceeded" once it
+// tries to relay more than n bytes in the direction set by
+// WithHandlerMaxBytesDirection. The frame or target write that would exceed n
+// is not relayed at all rather than cut short.
+func WithHandlerMaxBytes(n int64) HandlerOption {
+	return func(h *Handler) {
+		h.maxBytes = n
+	}
+}
+
+// WithByteQuota is WithHandlerMaxBytes(n) counting both directions together.
+// It sets the direction too, so of it and WithHandlerMaxBytesDirection the
+// option given last decides the direction.
+func WithByteQuota(n int64) HandlerOption {
+	return func(h *Handler) {
+		h.maxBytes = n
+		h.maxBytesDirection = DirectionBoth
+	}
+}
+
+func WithHandlerMaxBytesDirection(dir Direction) HandlerOption {
+	return func(h *Handler) {
+		h.maxBytesDirection = dir
+	}
+}
+
+type session struct {
+	ctx             context.Context
+	cancel          context.CancelFunc
+	h               *Handler
+	ws              *websocket.Conn
+	conn            net.Conn
+	req             *http.Request
+	start           time.Time
+	id              string
+	logger          *slog.Logger
+	backend         *backend
+	network         string
+	target          string
+	tcpKeepAlive    time.Duration
+	tcpNoDelay      bool
+	targetAddr      string
+	fallbackTargets []string
+	hinted          bool
+	localAddr       *net.TCPAddr
+	pools           *copyPools
+	labels          map[string]string
+	metricLabels    map[string]string
+	reason          string
+	err             error
+	clientErr       error
+	targetErr       error
+	clientClose     *CloseError
+	bytesUp         atomic.Int64
+	bytesDown       atomic.Int64
+	quotaUsed       atomic.Int64
+	wireUp          atomic.Int64
+	wireDown        atomic.Int64
+	lastFrame       atomic.Int64
+	readWait        atomic.Int64
+	lastActive      atomic.Int64
+	closeSent       atomic.Bool
+	aborted         bool
+	pinger          wire.Pinger
+	mu              sync.Mutex
+	abortOnce       sync.Once
+}
+
+// requestValuesContext carries the values of the handshake request while
+// taking its lifetime from the handler. A hijacked request's own context may
+// be cancelled once ServeHTTP would have returned.
+type requestValuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c requestValuesContext) Value(key any) any {
+	if v := c.values.Value(key); v != nil {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+func newSession(h *Handler, req *http.Request, target string) *session {
+	ctx, cancel := context.WithCancel(requestValuesContext{Context: h.baseCtx, values: req.Context()})
+	id := ConnIDFromContext(ctx)
+	if id == "" {
+		id = newSessionID()
+	}
+	logger := h.logger.With(slog.String("conn_id", id))
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		logger = logger.With(slog.String("request_id", requestID))
+	}
+	labels := SessionLabelsFromContext(ctx)
+	if labels != nil {
+		logger = logger.With(labelsAttr(labels))
+	}
+	var fallbacks []string
+	var hinted bool
+	var localAddr *net.TCPAddr
+	if rt, ok := ctx.Value(targetContextKey{}).(*resolvedTarget); ok {
+		fallbacks = rt.fallbacks
+		hinted = rt.hinted
+		localAddr = rt.localAddr
+	}
+	return &session{
+		ctx:             ctx,
+		cancel:          cancel,
+		h:               h,
+		req:             req,
+		id:              id,
+		start:           time.Now(),
+		target:          target,
+		logger:          logger,
+		fallbackTargets: fallbacks,
+		hinted:          hinted,
+		localAddr:       localAddr,
+		pools:           h.pools.Load(),
+		labels:          labels,
+		metricLabels:    h.metricLabels(labels),
+	}
+}
+
+func (s *session) abort(code int, reason string) {
+	s.abortOnce.Do(func() {
+		s.cancel()
+		s.setReason(reason)
+		s.sendClose(code, reason)
+		_ = s.ws.Close()
+		s.mu.Lock()
+		s.aborted = true
+		conn := s.conn
+		s.mu.Unlock()
+		if conn != nil {
+			_ = conn.Close()
+		}
+	})
+}
+
+// setConn records the target conn. If the session was aborted first, it
+// closes conn instead and reports false.
+func (s *session) setConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aborted {
+		_ = conn.Close()
+		return false
+	}
+	s.conn = conn
+	return true
+}
+
+func (s *session) getConn() net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+func (s *session) sendClose(code int, reason string) {
+	if s.closeSent.CompareAndSwap(false, true) {
+		_ = writeClose(s.ws, code, reason)
+	}
+}
+
+func (s *session) setReason(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+}
+
+func (s *session) setErr(p peer, err error) {
+	if err == nil || err == io.EOF || s.ctx.Err() != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch p {
+	case peerClient:
+		if s.clientErr != nil {
+			return
+		}
+		s.clientErr = err
+	case peerTarget:
+		if s.targetErr != nil {
+			return
+		}
+		s.targetErr = err
+	}
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// closedOnPurpose reports whether err is the expected result of the session
+// being aborted or the handler shutting down, such as a read on a conn that
+// abort closed or interrupted, rather than a failure.
+func (s *session) closedOnPurpose(err error) bool {
+	return s.ctx.Err() != nil && (errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, os.ErrDeadlineExceeded))
+}
+
+// logRelayError logs why the relay in direction ("up" or "down") stopped.
+func (s *session) logRelayError(direction string, err error) {
+	if s.closedOnPurpose(err) {
+		s.logger.Debug("relay stopped by close", slog.String("direction", direction), slog.Any("error", err))
+		return
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		s.logger.Info("byte quota exceeded", slog.String("direction", direction))
+		return
+	}
+	s.logger.Warn("relay failed", slog.String("direction", direction), slog.Any("error", err))
+}
+
+func (s *session) setClientClose(e *CloseError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientClose = e
+}
+
+func closeCode(e *CloseError) int {
+	if e == nil {
+		return 0
+	}
+	return e.Code
+}
+
+func closeReason(e *CloseError) string {
+	if e == nil {
+		return ""
+	}
+	return e.Reason
+}
+
+// setTarget records the target the session relays to. Stats and Sessions
+// read it while the session dials.
+func (s *session) setTarget(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.target = target
+}
+
+func (s *session) setTargetAddr(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targetAddr = addr
+}
+
+func (s *session) currentTarget() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.target
+}
+
+func (s *session) getReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason
+}
+
+// countsQuota reports whether writes to counter count toward the byte quota.
+func (s *session) countsQuota(counter *atomic.Int64) bool {
+	if s.h.maxBytes <= 0 {
+		return false
+	}
+	switch s.h.maxBytesDirection {
+	case DirectionUp:
+		return counter == &s.bytesUp
+	case DirectionDown:
+		return counter == &s.bytesDown
+	default:
+		return true
+	}
+}
+
+func (s *session) stats() ConnStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ConnStats{
+		Err:               s.err,
+		ClientErr:         s.clientErr,
+		TargetErr:         s.targetErr,
+		Target:            s.target,
+		Reason:            s.reason,
+		ClientCloseCode:   closeCode(s.clientClose),
+		ClientCloseReason: closeReason(s.clientClose),
+		BytesUp:           s.bytesUp.Load(),
+		BytesDown:         s.bytesDown.Load(),
+		BytesWireUp:       s.wireUp.Load(),
+		BytesWireDown:     s.wireDown.Load(),
+		Start:             s.start,
+		Duration:          time.Since(s.start),
+	}
+}
+
+func (s *session) release() {
+	s.cancel()
+	if s.backend != nil {
+		s.backend.active.Add(-1)
+	}
+}
+
+func (s *session) finish() {
+	s.release()
+	stats := s.stats()
+	s.logger.Info("session ended",
+		slog.String("target", stats.Target),
+		slog.String("reason", stats.Reason),
+		slog.Int64("bytes_up", stats.BytesUp),
+		slog.Int64("bytes_down", stats.BytesDown),
+		slog.Duration("duration", stats.Duration),
+		slog.Any("error", stats.Err),
+	)
+	if s.ws != nil {
+		s.h.metrics.SessionEnded(s.info(), stats)
+	}
+	if s.h.onClose != nil {
+		s.h.onClose(stats)
+	}
+	if s.h.onDisconnect != nil {
+		s.h.onDisconnect(s.info(), stats, stats.Err)
+	}
+}
+
+type trackedReader struct {
+	io.Reader
+	s    *session
+	peer peer
+}
+
+func (s *session) track(r io.Reader, p peer) io.Reader {
+	return &trackedReader{
+		Reader: r,
+		s:      s,
+		peer:   p,
+	}
+}
+
+func (r *trackedReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.s.setErr(r.peer, err)
+	return n, err
+}
+
+// countingWriter counts the bytes written without the side effects of
+// meteredWriter.
+type countingWriter struct {
+	deadlineWriter
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.deadlineWriter.Write(b)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+// takeQuota takes n bytes from the byte quota, reporting false and taking
+// nothing if they do not all fit.
+func (s *session) takeQuota(n int) bool {
+	for {
+		used := s.quotaUsed.Load()
+		if used+int64(n) > s.h.maxBytes {
+			return false
+		}
+		if s.quotaUsed.CompareAndSwap(used, used+int64(n)) {
+			return true
+		}
+	}
+}
+
+type meteredWriter struct {
+	deadlineWriter
+	s       *session
+	counter *atomic.Int64
+	peer    peer
+	quota   bool
+}
+
+func (s *session) meter(w deadlineWriter, counter *atomic.Int64, p peer) deadlineWriter {
+	return &meteredWriter{
+		deadlineWriter: w,
+		s:              s,
+		counter:        counter,
+		peer:           p,
+		quota:          s.countsQuota(counter),
+	}
+}
+
+func (w *meteredWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	// Take the bytes from the quota before writing, so that both directions
+	// together never relay more than it.
+	if w.quota && !w.s.takeQuota(len(b)) {
+		w.s.abort(ClosePolicyViolation, ErrQuotaExceeded.Error())
+		return 0, ErrQuotaExceeded
+	}
+	n, err := w.deadlineWriter.Write(b)
+	w.counter.Add(int64(n))
+	if n > 0 && w.s.h.idleTimeout > 0 {
+		w.s.touch()
+	}
+	w.s.setErr(w.peer, err)
+	return n, err
+}
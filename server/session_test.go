@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestByteQuota(t *testing.T) {
+	// The target sends three 1500 byte chunks; the third would exceed the
+	// quota, so the session closes before it instead of cutting it short.
+	const quota = 4000
+	target := startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		for i := 0; i < 3; i++ {
+			_, _ = conn.Write(make([]byte, 1500))
+			time.Sleep(50 * time.Millisecond)
+		}
+		time.Sleep(time.Second)
+	})
+	stats := make(chan ConnStats, 1)
+	h := NewHandler(target, WithByteQuota(quota), WithHandlerOnClose(func(cs ConnStats) { stats <- cs }))
+	ws := dialWS(t, startHandler(t, h), nil)
+
+	var frames []int
+	for {
+		f := readFrame(t, ws)
+		if f.opcode == websocket.CloseFrame {
+			if code := closeCode(parseClosePayload(f.payload)); code != ClosePolicyViolation {
+				t.Fatalf("close code %d, want %d", code, ClosePolicyViolation)
+			}
+			break
+		}
+		frames = append(frames, len(f.payload))
+	}
+	if len(frames) != 2 || frames[0] != 1500 || frames[1] != 1500 {
+		t.Fatalf("client received frames of %v bytes, want two whole chunks", frames)
+	}
+	select {
+	case cs := <-stats:
+		if cs.BytesDown != 3000 {
+			t.Fatalf("BytesDown = %d, want 3000", cs.BytesDown)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose not called")
+	}
+}
+
+func TestByteQuotaBothDirections(t *testing.T) {
+	const quota = 1000
+	h := NewHandler(echoTarget(t), WithByteQuota(quota))
+	ws := dialWS(t, startHandler(t, h), nil)
+	// 400 and then 100 bytes each way use the quota up exactly; one more
+	// byte does not fit.
+	for _, n := range []int{400, 100} {
+		sendBinary(t, ws, make([]byte, n))
+		if f := readFrame(t, ws); len(f.payload) != n {
+			t.Fatalf("echoed %d bytes, want %d", len(f.payload), n)
+		}
+	}
+	sendBinary(t, ws, []byte{0})
+	if code := readClose(t, ws); code != ClosePolicyViolation {
+		t.Fatalf("close code %d, want %d", code, ClosePolicyViolation)
+	}
+}
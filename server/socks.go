@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+var ErrUpstreamProxy = errors.New("upstream proxy dial failed")
+
+type socks5Config struct {
+	auth *proxy.Auth
+	addr string
+}
+
+func WithUpstreamSOCKS5(addr string, auth *proxy.Auth) HandlerOption {
+	return func(h *Handler) {
+		h.socks5 = &socks5Config{
+			addr: addr,
+			auth: auth,
+		}
+	}
+}
+
+type forwardDialer struct {
+	ContextDialer
+}
+
+func (d forwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+type socks5Dialer struct {
+	dialer proxy.ContextDialer
+	addr   string
+}
+
+func newSOCKS5Dialer(cfg *socks5Config, forward ContextDialer) *socks5Dialer {
+	d, _ := proxy.SOCKS5("tcp", cfg.addr, cfg.auth, forwardDialer{forward})
+	return &socks5Dialer{
+		dialer: d.(proxy.ContextDialer),
+		addr:   cfg.addr,
+	}
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: socks5 %s: %w", ErrUpstreamProxy, d.addr, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// socks5Server starts a minimal SOCKS5 server that connects every request to
+// target and sends the requested host:port to requests. With auth set it
+// requires those credentials.
+func socks5Server(t *testing.T, target string, auth *proxy.Auth) (string, <-chan string) {
+	requests := make(chan string, 1)
+	addr := startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		host, ok := socks5Handshake(conn, auth)
+		if !ok {
+			return
+		}
+		requests <- host
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+			return
+		}
+		go func() { _, _ = io.Copy(upstream, conn) }()
+		_, _ = io.Copy(conn, upstream)
+	})
+	return addr, requests
+}
+
+func socks5Handshake(conn net.Conn, auth *proxy.Auth) (string, bool) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", false
+	}
+	if _, err := io.ReadFull(conn, make([]byte, head[1])); err != nil {
+		return "", false
+	}
+	if auth == nil {
+		_, _ = conn.Write([]byte{5, 0})
+	} else {
+		_, _ = conn.Write([]byte{5, 2})
+		user, pass, ok := readSOCKS5Credentials(conn)
+		if !ok || user != auth.User || pass != auth.Password {
+			_, _ = conn.Write([]byte{1, 1})
+			return "", false
+		}
+		_, _ = conn.Write([]byte{1, 0})
+	}
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", false
+	}
+	var host string
+	switch req[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if req[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", false
+		}
+		host = ip.String()
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", false
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", false
+		}
+		host = string(name)
+	default:
+		return "", false
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", false
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), true
+}
+
+func readSOCKS5Credentials(conn net.Conn) (user, pass string, ok bool) {
+	var n [2]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return "", "", false
+	}
+	u := make([]byte, n[1])
+	if _, err := io.ReadFull(conn, u); err != nil {
+		return "", "", false
+	}
+	if _, err := io.ReadFull(conn, n[:1]); err != nil {
+		return "", "", false
+	}
+	p := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, p); err != nil {
+		return "", "", false
+	}
+	return string(u), string(p), true
+}
+
+func TestUpstreamSOCKS5RemoteDNS(t *testing.T) {
+	proxyAddr, requests := socks5Server(t, echoTarget(t), nil)
+	// The name only resolves at the gateway.
+	h := NewHandler("backend.internal.invalid:7000", WithUpstreamSOCKS5(proxyAddr, nil))
+	echoOnce(t, startHandler(t, h))
+	if got := <-requests; got != "backend.internal.invalid:7000" {
+		t.Fatalf("gateway asked for %q, want the unresolved name", got)
+	}
+}
+
+func TestUpstreamSOCKS5Auth(t *testing.T) {
+	auth := &proxy.Auth{User: "wst", Password: "secret"}
+	proxyAddr, _ := socks5Server(t, echoTarget(t), auth)
+	h := NewHandler("backend.internal.invalid:7000", WithUpstreamSOCKS5(proxyAddr, auth))
+	echoOnce(t, startHandler(t, h))
+
+	h = NewHandler("backend.internal.invalid:7000", WithUpstreamSOCKS5(proxyAddr, &proxy.Auth{User: "wst", Password: "wrong"}))
+	ws := dialWS(t, startHandler(t, h), nil)
+	if ce := readCloseError(t, ws); ce.Reason != ErrUpstreamProxy.Error() {
+		t.Fatalf("closed with %d %q, want reason %q", ce.Code, ce.Reason, ErrUpstreamProxy)
+	}
+}
+
+func TestUpstreamSOCKS5Unreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := ln.Addr().String()
+	ln.Close()
+	h := NewHandler(echoTarget(t), WithUpstreamSOCKS5(proxyAddr, nil))
+	ws := dialWS(t, startHandler(t, h), nil)
+	if ce := readCloseError(t, ws); ce.Code != CloseInternalError || ce.Reason != ErrUpstreamProxy.Error() {
+		t.Fatalf("closed with %d %q, want %d %q", ce.Code, ce.Reason, CloseInternalError, ErrUpstreamProxy)
+	}
+}
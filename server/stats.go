@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// HandlerStats is a snapshot of a Handler's activity.
+type HandlerStats struct {
+	ActiveSessions int
+	TotalSessions  int64
+	// BytesUp and BytesDown include the sessions still active.
+	BytesUp   int64
+	BytesDown int64
+	// Handshakes counts handshake outcomes, keyed by the Handshake*
+	// constants.
+	Handshakes map[string]int64
+	// Targets counts the active sessions per target.
+	Targets map[string]int
+	// ActiveConnections is the count WithMaxConnections checks against
+	// MaxConnections, which is zero if there is no limit. It includes
+	// handshakes not yet tracked as sessions.
+	ActiveConnections int64
+	MaxConnections    int64
+	// HandshakesInFlight is the number of handshakes holding a slot under
+	// WithHandlerMaxConcurrentHandshakes.
+	HandshakesInFlight int
+	// DialRetries counts the target dials retried under
+	// WithTargetDialRetry.
+	DialRetries int64
+	// BufferPools describes the copy buffer pools the handler uses.
+	BufferPools []BufferPoolStats
+	// UpstreamPool describes the pool of WithUpstreamPool, if enabled.
+	UpstreamPool UpstreamPoolStats
+}
+
+// SessionInfo describes an active session.
+type SessionInfo struct {
+	Session
+	BytesUp   int64
+	BytesDown int64
+}
+
+// handlerCounters accumulates the totals of ended sessions; the live
+// counters of active sessions are added in at snapshot time, so the relay
+// only touches per-session atomics.
+type handlerCounters struct {
+	totalSessions int64
+	bytesUp       int64
+	bytesDown     int64
+	handshakes    sync.Map // outcome -> *atomic.Int64
+	dialRetries   atomic.Int64
+}
+
+// countingMetrics counts handshake outcomes for Stats before passing events
+// on.
+type countingMetrics struct {
+	MetricsCollector
+	counters *handlerCounters
+}
+
+func (m countingMetrics) Handshake(outcome string) {
+	n, ok := m.counters.handshakes.Load(outcome)
+	if !ok {
+		n, _ = m.counters.handshakes.LoadOrStore(outcome, new(atomic.Int64))
+	}
+	n.(*atomic.Int64).Add(1)
+	m.MetricsCollector.Handshake(outcome)
+}
+
+func (m countingMetrics) TargetDialRetried(target string, attempt int, err error) {
+	m.counters.dialRetries.Add(1)
+	if rc, ok := m.MetricsCollector.(DialRetryCollector); ok {
+		rc.TargetDialRetried(target, attempt, err)
+	}
+}
+
+// Stats returns a snapshot of the handler's activity.
+func (h *Handler) Stats() HandlerStats {
+	stats := HandlerStats{
+		Handshakes:         make(map[string]int64),
+		Targets:            make(map[string]int),
+		ActiveConnections:  h.ActiveConnections(),
+		MaxConnections:     max(h.maxConns, 0),
+		HandshakesInFlight: h.HandshakesInFlight(),
+		DialRetries:        h.counters.dialRetries.Load(),
+		BufferPools:        h.bufferPoolStats(),
+	}
+	if h.upstreamPool != nil {
+		stats.UpstreamPool = h.upstreamPool.stats()
+	}
+	h.counters.handshakes.Range(func(k, v any) bool {
+		stats.Handshakes[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+
+	// Sessions move their bytes into the totals under sessionsMu when they
+	// are untracked, so each byte is counted exactly once.
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+	stats.ActiveSessions = len(h.sessions)
+	stats.TotalSessions = h.counters.totalSessions
+	stats.BytesUp = h.counters.bytesUp
+	stats.BytesDown = h.counters.bytesDown
+	for _, s := range h.sessions {
+		stats.BytesUp += s.bytesUp.Load()
+		stats.BytesDown += s.bytesDown.Load()
+		stats.Targets[s.currentTarget()]++
+	}
+	return stats
+}
+
+// Sessions lists the active sessions.
+func (h *Handler) Sessions() []SessionInfo {
+	sessions := h.activeSessions()
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, SessionInfo{
+			Session:   s.info(),
+			BytesUp:   s.bytesUp.Load(),
+			BytesDown: s.bytesDown.Load(),
+		})
+	}
+	return infos
+}
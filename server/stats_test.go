@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsConcurrentSessions(t *testing.T) {
+	target := echoTarget(t)
+	h := NewHandler(target)
+	url := startHandler(t, h)
+
+	const sessions, rounds = 16, 20
+	stop := make(chan struct{})
+	polled := make(chan error, 1)
+	go func() {
+		defer close(polled)
+		var last HandlerStats
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s := h.Stats()
+			if s.ActiveSessions < 0 || s.BytesUp < last.BytesUp || s.BytesDown < last.BytesDown ||
+				s.TotalSessions < last.TotalSessions {
+				t.Errorf("stats went backwards: %+v after %+v", s, last)
+				return
+			}
+			for target, n := range s.Targets {
+				if n < 0 {
+					t.Errorf("target %s has %d sessions", target, n)
+					return
+				}
+			}
+			for _, info := range h.Sessions() {
+				if info.ID == "" || info.Target != target || info.BytesUp < 0 {
+					t.Errorf("session info %+v", info)
+					return
+				}
+			}
+			last = s
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < sessions; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws, err := dialWSErr(url, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer ws.Close()
+			msg := []byte("0123456789")
+			buf := make([]byte, len(msg))
+			for j := 0; j < rounds; j++ {
+				if _, err := ws.Write(msg); err != nil {
+					t.Error(err)
+					return
+				}
+				for n := 0; n < len(msg); {
+					m, err := ws.Read(buf[n:])
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					n += m
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Stats().ActiveSessions != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions still active", h.Stats().ActiveSessions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-polled
+
+	s := h.Stats()
+	want := int64(sessions * rounds * 10)
+	if s.TotalSessions != sessions || s.BytesUp != want || s.BytesDown != want {
+		t.Fatalf("totals %d sessions, %d up, %d down; want %d, %d, %d",
+			s.TotalSessions, s.BytesUp, s.BytesDown, sessions, want, want)
+	}
+	if s.Handshakes[HandshakeAccepted] != sessions {
+		t.Fatalf("%d accepted handshakes, want %d", s.Handshakes[HandshakeAccepted], sessions)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+var errNoSubprotocolRoute = errors.New("no route for requested subprotocol")
+
+// WithHandlerSubprotocolRouting routes each session to the target mapped to
+// the first subprotocol the client offers that has an entry in routes. The
+// chosen subprotocol is echoed in the handshake response; clients offering
+// none that is mapped are rejected with 403. Since only one subprotocol can
+// be selected, a client that also wants a wst mode offers it combined with
+// the route, as "db.prod+wst-gzip" or "db.prod+wst-base64"; a wst-gzip
+// combination is only selected when WithStreamCompression is set.
+func WithHandlerSubprotocolRouting(routes map[string]string) HandlerOption {
+	return func(h *Handler) {
+		h.subprotocolRoutes = routes
+	}
+}
+
+func offeredProtocols(req *http.Request) []string {
+	var protocols []string
+	for _, p := range strings.Split(req.Header.Get("Sec-Websocket-Protocol"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			protocols = append(protocols, p)
+		}
+	}
+	return protocols
+}
+
+// splitRoutedProtocol splits a routed subprotocol into its route and the wst
+// mode combined with it, if any.
+func splitRoutedProtocol(p string) (route, mode string) {
+	if i := strings.LastIndexByte(p, '+'); i >= 0 {
+		switch mode := p[i+1:]; mode {
+		case TextModeProtocol, StreamCompressionProtocol:
+			return p[:i], mode
+		}
+	}
+	return p, ""
+}
+
+func (h *Handler) routeSubprotocol(offered []string) (protocol, target string, ok bool) {
+	for _, p := range offered {
+		route, mode := splitRoutedProtocol(p)
+		if mode == StreamCompressionProtocol && !h.compress {
+			continue
+		}
+		if target, ok := h.subprotocolRoutes[route]; ok {
+			return p, target, true
+		}
+	}
+	return "", "", false
+}
+
+// protocolMode returns the wst mode of the subprotocol selected for config,
+// including one combined with a route, or "" if there is none.
+func (h *Handler) protocolMode(config *websocket.Config) string {
+	if len(config.Protocol) != 1 {
+		return ""
+	}
+	p := config.Protocol[0]
+	if h.subprotocolRoutes != nil {
+		_, mode := splitRoutedProtocol(p)
+		return mode
+	}
+	if p == TextModeProtocol || p == StreamCompressionProtocol {
+		return p
+	}
+	return ""
+}
+
+// sessionTarget returns the target for a session on req, reporting false when
+// subprotocol routing has no route for it.
+func (h *Handler) sessionTarget(req *http.Request) (string, bool) {
+	if rt, ok := req.Context().Value(targetContextKey{}).(*resolvedTarget); ok {
+		return rt.target, true
+	}
+	if h.subprotocolRoutes == nil {
+		return h.defaultTargetAddr, true
+	}
+	_, target, ok := h.routeSubprotocol(offeredProtocols(req))
+	return target, ok
+}
+
+// selectProtocol answers the first offered subprotocol that selects a wst
+// mode, wst-gzip only when compression is enabled. Otherwise wst-gzip is
+// dropped from the offer and any other subprotocols are left as offered.
+func (h *Handler) selectProtocol(config *websocket.Config) {
+	for _, p := range config.Protocol {
+		if p == TextModeProtocol || p == StreamCompressionProtocol && h.compress {
+			config.Protocol = []string{p}
+			return
+		}
+	}
+	config.Protocol = slices.DeleteFunc(config.Protocol, func(p string) bool {
+		return p == StreamCompressionProtocol
+	})
+}
+
+func (h *Handler) selectRoutedProtocol(config *websocket.Config, req *http.Request) error {
+	protocol, _, ok := h.routeSubprotocol(config.Protocol)
+	if !ok {
+		h.logRejected(req, http.StatusForbidden, errNoSubprotocolRoute.Error())
+		h.metrics.Handshake(HandshakeRejectedSubprotocol)
+		return errNoSubprotocolRoute
+	}
+	config.Protocol = []string{protocol}
+	return nil
+}
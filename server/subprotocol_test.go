@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/gwst/client"
+	"golang.org/x/net/websocket"
+)
+
+// prefixTarget answers each read with prefix and the bytes read.
+func prefixTarget(t *testing.T, prefix string) string {
+	return startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(append([]byte(prefix), buf[:n]...)); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestSubprotocolRouting(t *testing.T) {
+	url := startHandler(t, NewHandler("", WithHandlerSubprotocolRouting(map[string]string{
+		"db":    prefixTarget(t, "db:"),
+		"cache": prefixTarget(t, "cache:"),
+	})))
+	resp := upgradeResponse(t, url, http.Header{"Sec-Websocket-Protocol": {"other, cache, db"}})
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-Websocket-Protocol") != "cache" {
+		t.Fatalf("status %d, protocol %q; want 101 cache", resp.StatusCode, resp.Header.Get("Sec-Websocket-Protocol"))
+	}
+	if resp := upgradeResponse(t, url, http.Header{"Sec-Websocket-Protocol": {"other"}}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unmapped subprotocol: status %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestSubprotocolRoutingWithCompression(t *testing.T) {
+	url := startHandler(t, NewHandler("",
+		WithStreamCompression(6),
+		WithHandlerSubprotocolRouting(map[string]string{"db": prefixTarget(t, "db:")}),
+	))
+	conn, err := client.Connect(context.Background(),
+		client.WithAddr(strings.TrimPrefix(url, "ws://")),
+		client.WithSubprotocols("db"),
+		client.WithStreamCompression(6),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := conn.(*client.Conn)
+	if p := c.ResponseHeader().Get("Sec-Websocket-Protocol"); p != "db+"+StreamCompressionProtocol {
+		t.Fatalf("selected %q, want db+%s", p, StreamCompressionProtocol)
+	}
+	if p := c.Subprotocol(); p != "db" {
+		t.Fatalf("Subprotocol() = %q, want db", p)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("db:hello"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "db:hello" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+}
+
+func TestSubprotocolRoutingCompressionDisabled(t *testing.T) {
+	// Without WithStreamCompression the plain route is selected instead.
+	url := startHandler(t, NewHandler("", WithHandlerSubprotocolRouting(map[string]string{"db": echoTarget(t)})))
+	resp := upgradeResponse(t, url, http.Header{"Sec-Websocket-Protocol": {"db+" + StreamCompressionProtocol + ", db"}})
+	if got := resp.Header.Get("Sec-Websocket-Protocol"); got != "db" {
+		t.Fatalf("selected %q, want db", got)
+	}
+}
+
+func TestSubprotocolRoutingTextMode(t *testing.T) {
+	url := startHandler(t, NewHandler("", WithHandlerSubprotocolRouting(map[string]string{"db": prefixTarget(t, "db:")})))
+	config, err := websocket.NewConfig(url, "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Protocol = []string{"db+" + TextModeProtocol}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err := websocket.Message.Send(ws, base64.StdEncoding.EncodeToString([]byte("hi"))); err != nil {
+		t.Fatal(err)
+	}
+	f := readFrame(t, ws)
+	got, err := base64.StdEncoding.DecodeString(string(f.payload))
+	if f.opcode != websocket.TextFrame || err != nil || string(got) != "db:hi" {
+		t.Fatalf("got frame %d %q, want base64 of db:hi", f.opcode, f.payload)
+	}
+}
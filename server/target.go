@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const targetTLSScheme = "tls://"
+
+var ErrTargetTLSHandshake = errors.New("target tls handshake failed")
+
+func WithTargetTLS(cfg *tls.Config) HandlerOption {
+	return func(h *Handler) {
+		h.targetTLSConfig = cfg
+	}
+}
+
+// WithHandlerBackendTLS dials the backends of WithHandlerBackends over TLS
+// with cfg, in place of the WithTargetTLS config. Other targets are not
+// affected.
+func WithHandlerBackendTLS(cfg *tls.Config) HandlerOption {
+	return func(h *Handler) {
+		h.backendTLSConfig = cfg
+	}
+}
+
+func parseTarget(target string) (addr string, useTLS bool) {
+	if strings.HasPrefix(target, targetTLSScheme) {
+		return strings.TrimPrefix(target, targetTLSScheme), true
+	}
+	return target, false
+}
+
+// targetTLS returns the TLS config for dialing addr, or nil to dial it in
+// plain. backend selects the config of WithHandlerBackendTLS.
+func (h *Handler) targetTLS(addr string, useTLS, backend bool) *tls.Config {
+	base := h.targetTLSConfig
+	if backend && h.backendTLSConfig != nil {
+		base = h.backendTLSConfig
+	}
+	if base == nil && !useTLS {
+		return nil
+	}
+	var cfg *tls.Config
+	if base != nil {
+		cfg = base.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cfg.ServerName = host
+	}
+	return cfg
+}
+
+func (h *Handler) dialTarget(ctx context.Context, s *session, target string, backend bool) (net.Conn, error) {
+	if err := h.vetoDial(target); err != nil {
+		return nil, err
+	}
+	// Each target gets the whole dial timeout, so that one that does not
+	// answer leaves time to fail over to the next.
+	ctx, cancel := context.WithTimeout(ctx, h.targetDialTimeout)
+	defer cancel()
+	network := "tcp"
+	if s != nil && s.network != "" {
+		network = s.network
+	}
+	if h.upstreamPool == nil || h.proxyProtocol != 0 {
+		return h.dialNew(ctx, s, network, target, backend)
+	}
+	key := network + " " + target
+	if s != nil && s.localAddr != nil {
+		key += " " + s.localAddr.String()
+	}
+	conn := h.upstreamPool.get(key)
+	if conn == nil {
+		var err error
+		if conn, err = h.dialNew(ctx, s, network, target, backend); err != nil {
+			return nil, err
+		}
+	} else if s != nil {
+		s.setTargetAddr(conn.RemoteAddr().String())
+	}
+	return &pooledConn{Conn: conn, pool: h.upstreamPool, key: key}, nil
+}
+
+func (h *Handler) dialNew(ctx context.Context, s *session, network, target string, backend bool) (net.Conn, error) {
+	addr, useTLS := parseTarget(target)
+	if s != nil && s.localAddr != nil {
+		ctx = withLocalAddr(ctx, s.localAddr)
+	}
+	conn, err := h.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		s.setTargetAddr(conn.RemoteAddr().String())
+	}
+	h.applyTCPOptions(s, conn)
+	if h.proxyProtocol != 0 {
+		if err := s.writeProxyHeader(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	cfg := h.targetTLS(addr, useTLS, backend)
+	if cfg == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %w", ErrTargetTLSHandshake, err)
+	}
+	return tlsConn, nil
+}
+
+type targetContextKey struct{}
+
+type resolvedTarget struct {
+	target    string
+	fallbacks []string
+	// hinted marks a target from TargetHintHeader, which bypasses the
+	// backends.
+	hinted    bool
+	localAddr *net.TCPAddr
+}
+
+// WithGetTarget picks the target per request with fn instead of using the
+// Handler's target address. fn returns the target and further targets tried
+// in order when it cannot be dialed; an error rejects the request with 404
+// before the upgrade.
+func WithGetTarget(fn GetTargetFunc) HandlerOption {
+	return WithGetTargetSpec(func(req *http.Request) (TargetSpec, error) {
+		target, fallbacks, err := fn(req)
+		return TargetSpec{Addr: target, Fallbacks: fallbacks}, err
+	})
+}
+
+// WithGetTargetSpec is like WithGetTarget, with fn also able to pick the local
+// address the target is dialed from.
+func WithGetTargetSpec(fn GetTargetSpecFunc) HandlerOption {
+	return func(h *Handler) {
+		h.getTarget = fn
+	}
+}
+
+func (h *Handler) resolveTarget(w http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	req, err := h.withTarget(req)
+	if err != nil {
+		http.NotFound(w, req)
+		return req, false
+	}
+	return req, true
+}
+
+func (h *Handler) withTarget(req *http.Request) (*http.Request, error) {
+	spec, err := h.getTarget(req)
+	rt := &resolvedTarget{target: spec.Addr, fallbacks: spec.Fallbacks}
+	if err == nil && spec.LocalAddr != "" {
+		rt.localAddr, err = parseLocalAddr(spec.LocalAddr)
+	}
+	if err != nil {
+		h.logRejected(req, http.StatusNotFound, err.Error())
+		h.metrics.Handshake(HandshakeRejectedTarget)
+		return req, err
+	}
+	return req.WithContext(context.WithValue(req.Context(), targetContextKey{}, rt)), nil
+}
+
+// dialTargets dials the session target, then its fallbacks in order until one
+// succeeds. A vetoed dial is not failed over.
+func (h *Handler) dialTargets(ctx context.Context, s *session) (net.Conn, error) {
+	conn, err := h.dialTarget(ctx, s, s.target, false)
+	for _, target := range s.fallbackTargets {
+		if err == nil || errors.Is(err, ErrDialVetoed) || ctx.Err() != nil {
+			break
+		}
+		s.logger.Warn("target dial failed, trying fallback",
+			slog.String("target", target),
+			slog.Any("error", err),
+		)
+		conn, err = h.dialTarget(ctx, s, target, false)
+	}
+	return conn, err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// tlsEchoTarget starts a TLS echo server and returns its address and a client
+// config trusting it.
+func tlsEchoTarget(t *testing.T) (string, *tls.Config) {
+	serverCfg, clientCfg := tlsConfigs(t)
+	return serveTLSEcho(t, serverCfg), clientCfg
+}
+
+func serveTLSEcho(t *testing.T, cfg *tls.Config) string {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func echoOnce(t *testing.T, url string) {
+	t.Helper()
+	ws := dialWS(t, url, nil)
+	sendBinary(t, ws, []byte("ping"))
+	if f := readFrame(t, ws); string(f.payload) != "ping" {
+		t.Fatalf("echo = %q (opcode %d)", f.payload, f.opcode)
+	}
+}
+
+func TestBackendTLS(t *testing.T) {
+	addr, cfg := tlsEchoTarget(t)
+	h := NewHandler("", WithHandlerBackends([]string{addr}), WithHandlerBackendTLS(cfg))
+	echoOnce(t, startHandler(t, h))
+}
+
+func TestBackendTLSLeavesTargetsPlain(t *testing.T) {
+	_, cfg := tlsEchoTarget(t)
+	h := NewHandler(echoTarget(t), WithHandlerBackendTLS(cfg))
+	echoOnce(t, startHandler(t, h))
+}
+
+func TestTargetTLSScheme(t *testing.T) {
+	addr, cfg := tlsEchoTarget(t)
+	h := NewHandler("tls://"+addr, WithTargetTLS(cfg))
+	echoOnce(t, startHandler(t, h))
+}
+
+func TestTargetTLSHandshakeFailure(t *testing.T) {
+	plain := startTarget(t, func(conn net.Conn) { conn.Close() })
+	h := NewHandler("tls://" + plain)
+	ws := dialWS(t, startHandler(t, h), nil)
+	if code := readClose(t, ws); code == CloseNormalClosure {
+		t.Fatalf("close code %d after a failed target handshake", code)
+	}
+}
+
+func TestTargetTLSVerificationFailure(t *testing.T) {
+	// The target's certificate is not trusted without its config.
+	addr, _ := tlsEchoTarget(t)
+	h := NewHandler("tls://" + addr)
+	ws := dialWS(t, startHandler(t, h), nil)
+	ce := readCloseError(t, ws)
+	if ce.Code != CloseInternalError || ce.Reason != ErrTargetTLSHandshake.Error() {
+		t.Fatalf("closed with %d %q, want %d %q", ce.Code, ce.Reason, CloseInternalError, ErrTargetTLSHandshake)
+	}
+}
+
+// sniTarget starts a TLS echo server that reports the server name of each
+// handshake.
+func sniTarget(t *testing.T) (string, <-chan string) {
+	serverCfg, _ := tlsConfigs(t)
+	names := make(chan string, 1)
+	serverCfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		names <- hello.ServerName
+		return nil, nil
+	}
+	return serveTLSEcho(t, serverCfg), names
+}
+
+func TestTargetTLSServerName(t *testing.T) {
+	addr, names := sniTarget(t)
+	port := addr[strings.LastIndex(addr, ":"):]
+	h := NewHandler("tls://localhost"+port, WithTargetTLS(&tls.Config{InsecureSkipVerify: true}))
+	echoOnce(t, startHandler(t, h))
+	if name := <-names; name != "localhost" {
+		t.Fatalf("server name %q, want the target host", name)
+	}
+
+	h = NewHandler("tls://localhost"+port, WithTargetTLS(&tls.Config{
+		ServerName:         "backend.example",
+		InsecureSkipVerify: true,
+	}))
+	echoOnce(t, startHandler(t, h))
+	if name := <-names; name != "backend.example" {
+		t.Fatalf("server name %q, want the configured one", name)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+const DefaultUpstreamKeepAlive = 30 * time.Second
+
+// WithUpstreamTCPOptions sets TCP_NODELAY and the keepalive period on target
+// connections. By default NoDelay is enabled and keepalive probes are sent
+// every 30s; a non-positive keepAlive disables them. Targets reached over a
+// transport other than plain TCP are left untouched.
+func WithUpstreamTCPOptions(noDelay bool, keepAlive time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.upstreamNoDelay = noDelay
+		h.upstreamKeepAlive = keepAlive
+	}
+}
+
+func (h *Handler) applyTCPOptions(s *session, conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	_ = tc.SetNoDelay(h.upstreamNoDelay)
+	if h.upstreamKeepAlive > 0 {
+		_ = tc.SetKeepAlive(true)
+		_ = tc.SetKeepAlivePeriod(h.upstreamKeepAlive)
+	} else {
+		_ = tc.SetKeepAlive(false)
+	}
+	if s != nil {
+		s.mu.Lock()
+		s.tcpNoDelay = h.upstreamNoDelay
+		s.tcpKeepAlive = max(h.upstreamKeepAlive, 0)
+		s.mu.Unlock()
+	}
+}
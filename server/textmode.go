@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+
+	"golang.org/x/net/websocket"
+)
+
+// TextModeProtocol is the websocket subprotocol for clients, such as browsers,
+// that tunnel over text frames. Each frame carries base64 of a chunk of the
+// stream in both directions; binary frames are not accepted.
+const TextModeProtocol = "wst-base64"
+
+var (
+	errBinaryInTextMode = errors.New("binary frame in text mode session")
+	errInvalidBase64    = errors.New("invalid base64 in text frame")
+)
+
+func (h *Handler) isTextMode(config *websocket.Config) bool {
+	return h.protocolMode(config) == TextModeProtocol
+}
+
+// base64Reader decodes a single text frame, reporting malformed or truncated
+// input as errInvalidBase64.
+type base64Reader struct {
+	r io.Reader
+}
+
+func (r base64Reader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	var corrupt base64.CorruptInputError
+	if errors.As(err, &corrupt) || err == io.ErrUnexpectedEOF {
+		err = errInvalidBase64
+	}
+	return n, err
+}
+
+// base64Writer writes each chunk as one base64 encoded frame, so it must sit
+// below any writer that merges or splits writes.
+type base64Writer struct {
+	deadlineWriter
+	buf []byte
+}
+
+func (w *base64Writer) Write(b []byte) (int, error) {
+	n := base64.StdEncoding.EncodedLen(len(b))
+	if cap(w.buf) < n {
+		w.buf = make([]byte, n)
+	}
+	base64.StdEncoding.Encode(w.buf[:n], b)
+	if _, err := w.deadlineWriter.Write(w.buf[:n]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zijiren233/gwst/client"
+	"golang.org/x/net/websocket"
+)
+
+// dialTextMode connects to url with the client library in text mode.
+func dialTextMode(t *testing.T, url string, opts ...client.ConnectOption) *client.Conn {
+	t.Helper()
+	conn, err := client.Connect(context.Background(), append([]client.ConnectOption{
+		client.WithAddr(strings.TrimPrefix(url, "ws://")),
+		client.WithTextMode(),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*client.Conn)
+}
+
+func TestClientTextMode(t *testing.T) {
+	c := dialTextMode(t, startHandler(t, NewHandler(echoTarget(t))), client.WithMaxFrameSize(1000))
+	if p := c.ResponseHeader().Get("Sec-Websocket-Protocol"); p != TextModeProtocol {
+		t.Fatalf("selected %q, want %s", p, TextModeProtocol)
+	}
+	msg := make([]byte, 10000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go func() { _, _ = c.Write(msg) }()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("echo differs from what was sent")
+	}
+}
+
+func TestClientTextModeFrames(t *testing.T) {
+	// A raw websocket server standing in for a text-only path: it checks
+	// that the client only sends base64 text frames of bounded size.
+	frames := make(chan string, 16)
+	srv := websocket.Server{
+		Handshake: func(config *websocket.Config, _ *http.Request) error {
+			config.Protocol = []string{TextModeProtocol}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			for {
+				var msg string
+				if err := websocket.Message.Receive(ws, &msg); err != nil {
+					close(frames)
+					return
+				}
+				frames <- msg
+			}
+		},
+	}
+	c := dialTextMode(t, startHandler(t, srv), client.WithMaxFrameSize(8))
+	if _, err := c.Write([]byte("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for len(got) < len("hello, world") {
+		msg := <-frames
+		if len(msg) > 8 {
+			t.Fatalf("frame of %d bytes, over the limit", len(msg))
+		}
+		b, err := base64.StdEncoding.DecodeString(msg)
+		if err != nil {
+			t.Fatalf("frame %q is not base64: %v", msg, err)
+		}
+		got = append(got, b...)
+	}
+	if string(got) != "hello, world" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestClientTextModeInbandTarget(t *testing.T) {
+	target := echoTarget(t)
+	h := NewHandler("", WithInbandTarget(func(network, addr string) error { return nil }))
+	c := dialTextMode(t, startHandler(t, h), client.WithInbandTarget(target))
+	if _, err := c.Write([]byte("in-band")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("in-band"))
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != "in-band" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrHandlerClosed     = errors.New("handler closed")
+	ErrManualAcceptOff   = errors.New("handler is not in manual accept mode")
+	ErrTunnelAlreadyUsed = errors.New("tunnel already piped or closed")
+)
+
+func WithManualAccept() HandlerOption {
+	return func(h *Handler) {
+		h.acceptCh = make(chan *Tunnel)
+	}
+}
+
+type Tunnel struct {
+	s        *session
+	done     chan struct{}
+	doneOnce sync.Once
+	used     atomic.Bool
+	// mu orders SetTarget against claiming the tunnel, so that the target
+	// cannot change once it is being piped.
+	mu sync.Mutex
+}
+
+func newTunnel(s *session) *Tunnel {
+	return &Tunnel{
+		s:    s,
+		done: make(chan struct{}),
+	}
+}
+
+func (t *Tunnel) Conn() net.Conn {
+	return t.s.ws
+}
+
+func (t *Tunnel) Request() *http.Request {
+	return t.s.ws.Request()
+}
+
+func (t *Tunnel) Target() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.s.currentTarget()
+}
+
+// SetTarget changes the target Pipe dials. It has no effect once the tunnel
+// has been piped or closed.
+func (t *Tunnel) SetTarget(target string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.used.Load() {
+		t.s.setTarget(target)
+	}
+}
+
+// claim marks the tunnel used, reporting false if it already was.
+func (t *Tunnel) claim() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.used.CompareAndSwap(false, true)
+}
+
+// Ping measures the round-trip time to the client. The pong is only observed
+// while the tunnel is being piped, since that is when frames are read.
+func (t *Tunnel) Ping(ctx context.Context) (time.Duration, error) {
+	return t.s.pinger.Ping(ctx, t.s.ws)
+}
+
+func (t *Tunnel) finish() {
+	t.doneOnce.Do(func() {
+		close(t.done)
+	})
+}
+
+func (t *Tunnel) Pipe() error {
+	if !t.claim() {
+		return ErrTunnelAlreadyUsed
+	}
+	defer t.finish()
+	t.s.h.handleNetwork(t.s)
+	return t.s.stats().Err
+}
+
+// PipeConn relays the tunnel to conn instead of dialing the target. conn is
+// closed when the tunnel ends.
+func (t *Tunnel) PipeConn(conn net.Conn) error {
+	if !t.claim() {
+		conn.Close()
+		return ErrTunnelAlreadyUsed
+	}
+	defer t.finish()
+	if !t.s.setConn(conn) {
+		return net.ErrClosed
+	}
+	t.s.h.handleNetwork(t.s)
+	return t.s.stats().Err
+}
+
+func (t *Tunnel) Close() error {
+	t.claim()
+	t.s.abort(CloseNormalClosure, "tunnel closed")
+	t.finish()
+	return nil
+}
+
+func (h *Handler) Accept() (*Tunnel, error) {
+	if h.acceptCh == nil {
+		return nil, ErrManualAcceptOff
+	}
+	select {
+	case t := <-h.acceptCh:
+		return t, nil
+	case <-h.shutdownCh:
+		return nil, ErrHandlerClosed
+	}
+}
+
+func (h *Handler) handOff(s *session) {
+	t := newTunnel(s)
+	select {
+	case h.acceptCh <- t:
+	case <-s.ctx.Done():
+		return
+	case <-h.shutdownCh:
+		return
+	}
+	select {
+	case <-t.done:
+	case <-s.ctx.Done():
+		if t.used.Load() {
+			<-t.done
+		}
+	}
+}
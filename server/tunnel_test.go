@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func acceptTunnel(t *testing.T, h *Handler) *Tunnel {
+	t.Helper()
+	tun, err := h.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tun
+}
+
+func TestTunnelSetTarget(t *testing.T) {
+	h := NewHandler("127.0.0.1:1", WithManualAccept())
+	ws := dialWS(t, startHandler(t, h), nil)
+	tun := acceptTunnel(t, h)
+	target := echoTarget(t)
+	tun.SetTarget(target)
+	if got := tun.Target(); got != target {
+		t.Fatalf("Target() = %q, want %q", got, target)
+	}
+	go func() { _ = tun.Pipe() }()
+	sendBinary(t, ws, []byte("hi"))
+	if f := readFrame(t, ws); string(f.payload) != "hi" {
+		t.Fatalf("got %q", f.payload)
+	}
+	tun.SetTarget("127.0.0.1:1")
+	if got := tun.Target(); got != target {
+		t.Fatalf("SetTarget after Pipe changed the target to %q", got)
+	}
+}
+
+func TestTunnelSetTargetConcurrentPipe(t *testing.T) {
+	// Run with -race: SetTarget must not race with Pipe reading the target.
+	h := NewHandler("", WithManualAccept())
+	ws := dialWS(t, startHandler(t, h), nil)
+	tun := acceptTunnel(t, h)
+	target := echoTarget(t)
+	tun.SetTarget(target)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			tun.SetTarget(target)
+		}
+	}()
+	go func() { _ = tun.Pipe() }()
+	wg.Wait()
+	sendBinary(t, ws, []byte("hi"))
+	if f := readFrame(t, ws); string(f.payload) != "hi" {
+		t.Fatalf("got %q", f.payload)
+	}
+}
+
+func TestTunnelPipeTwice(t *testing.T) {
+	h := NewHandler(echoTarget(t), WithManualAccept())
+	dialWS(t, startHandler(t, h), nil)
+	tun := acceptTunnel(t, h)
+	if err := tun.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tun.Pipe(); err != ErrTunnelAlreadyUsed {
+		t.Fatalf("Pipe after Close: %v, want ErrTunnelAlreadyUsed", err)
+	}
+}
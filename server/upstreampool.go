@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// UpstreamPoolStats describes the pool of WithUpstreamPool.
+type UpstreamPoolStats struct {
+	Hits   int64
+	Misses int64
+	Idle   int
+}
+
+// WithUpstreamPool keeps target connections of sessions that ended cleanly
+// for reuse by later sessions to the same target, saving the TCP and TLS
+// handshakes of many short tunnels. A connection is pooled when the client
+// closed the websocket normally, the target neither closed it nor failed,
+// and the target was the last to send, so no request is left unanswered. It
+// is checked to have no pending data or EOF before reuse. Up to maxIdle
+// connections per target are kept for at most idleTTL.
+//
+// Only enable it for request-response protocols whose connections are in a
+// clean state between sessions: a reply that is still arriving when the
+// client closes, or any per-connection state such as authentication, carries
+// over to the next session. The pool is not used with WithProxyProtocol, whose header is per
+// client.
+func WithUpstreamPool(maxIdle int, idleTTL time.Duration) HandlerOption {
+	if maxIdle <= 0 {
+		panic("wst: upstream pool size must be positive")
+	}
+	if idleTTL <= 0 {
+		panic("wst: upstream pool idle TTL must be positive")
+	}
+	return func(h *Handler) {
+		h.upstreamPool = &upstreamPool{
+			maxIdle: maxIdle,
+			ttl:     idleTTL,
+			idle:    make(map[string][]idleConn),
+		}
+	}
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+type upstreamPool struct {
+	mu      sync.Mutex
+	idle    map[string][]idleConn
+	closed  bool
+	maxIdle int
+	ttl     time.Duration
+	hits    atomic.Int64
+	misses  atomic.Int64
+}
+
+// get returns the most recently pooled usable connection for key, or nil.
+func (p *upstreamPool) get(key string) net.Conn {
+	for {
+		p.mu.Lock()
+		conns := p.idle[key]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			p.misses.Add(1)
+			return nil
+		}
+		ic := conns[len(conns)-1]
+		p.idle[key] = conns[:len(conns)-1]
+		p.mu.Unlock()
+		if time.Since(ic.since) <= p.ttl && idleUsable(ic.conn) {
+			p.hits.Add(1)
+			return ic.conn
+		}
+		_ = ic.conn.Close()
+	}
+}
+
+func (p *upstreamPool) put(key string, conn net.Conn) {
+	now := time.Now()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	conns := p.idle[key]
+	var stale []idleConn
+	for len(conns) > 0 && (len(conns) >= p.maxIdle || now.Sub(conns[0].since) > p.ttl) {
+		stale = append(stale, conns[0])
+		conns = conns[1:]
+	}
+	p.idle[key] = append(conns, idleConn{conn: conn, since: now})
+	p.mu.Unlock()
+	for _, ic := range stale {
+		_ = ic.conn.Close()
+	}
+}
+
+func (p *upstreamPool) close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]idleConn)
+	p.closed = true
+	p.mu.Unlock()
+	for _, conns := range idle {
+		for _, ic := range conns {
+			_ = ic.conn.Close()
+		}
+	}
+}
+
+func (p *upstreamPool) stats() UpstreamPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := UpstreamPoolStats{Hits: p.hits.Load(), Misses: p.misses.Load()}
+	for _, conns := range p.idle {
+		stats.Idle += len(conns)
+	}
+	return stats
+}
+
+// idleUsable reports whether an idle connection has no pending data and has
+// not been closed by the target.
+func idleUsable(conn net.Conn) bool {
+	if sc, ok := conn.(syscall.Conn); ok {
+		if r, ok := readable(sc); ok {
+			return !r
+		}
+	}
+	// TLS buffers data above the socket, so try to read it.
+	_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	var ne net.Error
+	return n == 0 && errors.As(err, &ne) && ne.Timeout() && conn.SetReadDeadline(time.Time{}) == nil
+}
+
+// pooledConn is a target connection that returns to the pool when closed
+// after markReusable, unless it saw an error or EOF, the last data went to
+// the target, or data arrived after markReusable.
+type pooledConn struct {
+	net.Conn
+	pool     *upstreamPool
+	key      string
+	reuse    atomic.Bool
+	awaiting atomic.Bool
+	mu       sync.Mutex // held by Read
+	broken   bool
+	closed   bool
+	once     sync.Once
+}
+
+func (c *pooledConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.awaiting.Store(false)
+	}
+	var ne net.Error
+	if n > 0 && c.reuse.Load() || err != nil && !(c.reuse.Load() && errors.As(err, &ne) && ne.Timeout()) {
+		c.broken = true
+	}
+	return n, err
+}
+
+func (c *pooledConn) Write(b []byte) (int, error) {
+	c.awaiting.Store(true)
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.markBroken()
+	}
+	return n, err
+}
+
+func (c *pooledConn) CloseWrite() error {
+	c.markBroken()
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *pooledConn) markBroken() {
+	c.mu.Lock()
+	c.broken = true
+	c.mu.Unlock()
+}
+
+// markReusable makes Close return the connection to the pool.
+func (c *pooledConn) markReusable() {
+	c.reuse.Store(true)
+}
+
+func (c *pooledConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		if !c.reuse.Load() {
+			err = c.Conn.Close()
+			return
+		}
+		// Interrupt a pending Read, which may still pick up data the client
+		// will never see.
+		_ = c.Conn.SetReadDeadline(time.Unix(1, 0))
+		c.mu.Lock()
+		c.closed = true
+		broken := c.broken || c.awaiting.Load()
+		c.mu.Unlock()
+		if broken || c.Conn.SetDeadline(time.Time{}) != nil {
+			err = c.Conn.Close()
+			return
+		}
+		c.pool.put(c.key, c.Conn)
+	})
+	return err
+}
+
+// unwrapPooled returns the connection beneath a pooledConn.
+func unwrapPooled(conn net.Conn) net.Conn {
+	if pc, ok := conn.(*pooledConn); ok {
+		return pc.Conn
+	}
+	return conn
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// lineTarget answers each line it reads on a connection: "slow X" with X
+// after 200ms, "push X" with X and then an unsolicited line, and anything
+// else with the line itself. It counts the connections it accepts.
+func lineTarget(t *testing.T) (string, *atomic.Int32) {
+	var accepted atomic.Int32
+	return startTarget(t, func(conn net.Conn) {
+		defer conn.Close()
+		accepted.Add(1)
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd, arg, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " "); cmd {
+			case "slow":
+				time.Sleep(200 * time.Millisecond)
+				_, err = fmt.Fprintf(conn, "%s\n", arg)
+			case "push":
+				_, err = fmt.Fprintf(conn, "%s\n", arg)
+				go func() {
+					time.Sleep(100 * time.Millisecond)
+					fmt.Fprintf(conn, "pushed after %s\n", arg)
+				}()
+			default:
+				_, err = conn.Write([]byte(line))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}), &accepted
+}
+
+// roundTrip sends req as a line and returns the line that comes back.
+func roundTrip(t *testing.T, ws *websocket.Conn, req string) string {
+	t.Helper()
+	resp, err := roundTripErr(ws, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func roundTripErr(ws *websocket.Conn, req string) (string, error) {
+	if _, err := ws.Write([]byte(req + "\n")); err != nil {
+		return "", err
+	}
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var resp []byte
+	buf := make([]byte, 256)
+	for !strings.HasSuffix(string(resp), "\n") {
+		n, err := ws.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		resp = append(resp, buf[:n]...)
+	}
+	return strings.TrimSuffix(string(resp), "\n"), nil
+}
+
+func TestUpstreamPoolReuse(t *testing.T) {
+	target, accepted := lineTarget(t)
+	h := NewHandler(target, WithUpstreamPool(4, time.Minute))
+	url := startHandler(t, h)
+	for i := 0; i < 5; i++ {
+		ws := dialWS(t, url, nil)
+		if got, want := roundTrip(t, ws, fmt.Sprint("req", i)), fmt.Sprint("req", i); got != want {
+			t.Fatalf("session %d got %q, want %q", i, got, want)
+		}
+		ws.Close()
+		waitDrained(t, h)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Fatalf("target accepted %d connections, want 1", n)
+	}
+	if s := h.Stats().UpstreamPool; s.Hits != 4 || s.Misses != 1 || s.Idle != 1 {
+		t.Fatalf("pool stats %+v, want 4 hits, 1 miss, 1 idle", s)
+	}
+}
+
+func TestUpstreamPoolUnansweredRequest(t *testing.T) {
+	// The first session leaves before its reply arrives; the next must not
+	// receive it.
+	target, accepted := lineTarget(t)
+	h := NewHandler(target, WithUpstreamPool(4, time.Minute))
+	url := startHandler(t, h)
+
+	ws := dialWS(t, url, nil)
+	sendBinary(t, ws, []byte("slow first\n"))
+	time.Sleep(20 * time.Millisecond)
+	ws.Close()
+	waitDrained(t, h)
+
+	ws = dialWS(t, url, nil)
+	for _, req := range []string{"second", "slow third"} {
+		want := strings.TrimPrefix(req, "slow ")
+		if got := roundTrip(t, ws, req); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Fatalf("target accepted %d connections, want 2", n)
+	}
+	if s := h.Stats().UpstreamPool; s.Hits != 0 {
+		t.Fatalf("pool stats %+v, want no hits", s)
+	}
+}
+
+func TestUpstreamPoolUnsolicitedData(t *testing.T) {
+	// The target sends more after the session ended; the idle connection is
+	// dropped instead of handing that data to the next session.
+	target, accepted := lineTarget(t)
+	h := NewHandler(target, WithUpstreamPool(4, time.Minute))
+	url := startHandler(t, h)
+
+	ws := dialWS(t, url, nil)
+	if got := roundTrip(t, ws, "push first"); got != "first" {
+		t.Fatalf("got %q", got)
+	}
+	ws.Close()
+	waitDrained(t, h)
+	time.Sleep(200 * time.Millisecond)
+
+	ws = dialWS(t, url, nil)
+	if got := roundTrip(t, ws, "second"); got != "second" {
+		t.Fatalf("got %q, want the reply to this session", got)
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Fatalf("target accepted %d connections, want 2", n)
+	}
+	if s := h.Stats().UpstreamPool; s.Hits != 0 || s.Misses != 2 {
+		t.Fatalf("pool stats %+v, want 2 misses", s)
+	}
+}
+
+func TestUpstreamPoolInterleaved(t *testing.T) {
+	// Concurrent clients each run short sessions with their own payloads,
+	// some leaving a request unanswered, over shared pooled connections.
+	target, _ := lineTarget(t)
+	h := NewHandler(target, WithUpstreamPool(4, time.Minute))
+	url := startHandler(t, h)
+
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				ws, err := dialWSErr(url, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for j := 0; j < 3; j++ {
+					req := fmt.Sprintf("client%d-session%d-req%d", c, i, j)
+					if got, err := roundTripErr(ws, req); err != nil || got != req {
+						t.Errorf("sent %q, got %q, %v", req, got, err)
+					}
+				}
+				if i%3 == 0 {
+					_, _ = ws.Write([]byte(fmt.Sprintf("slow client%d-session%d-unanswered\n", c, i)))
+				}
+				ws.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	waitDrained(t, h)
+	if s := h.Stats().UpstreamPool; s.Hits == 0 || s.Hits+s.Misses != 40 {
+		t.Fatalf("pool stats %+v, want some of 40 sessions served from the pool", s)
+	}
+}
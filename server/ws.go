@@ -2,37 +2,120 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
 	"net"
 	"net/http"
 	"sync"
 	"time"
 )
 
+const (
+	DefaultMaxHeaderBytes  = 16 * 1024
+	DefaultShutdownTimeout = 3 * time.Second
+)
+
 type Server struct {
 	listenErr         error
 	shutdowned        chan struct{}
 	onListened        chan struct{}
 	server            *http.Server
 	wsHandler         *Handler
+	handlers          []mountedHandler
+	onListen          func(net.Addr)
+	tlsConfig         *tls.Config
+	clientCAs         *x509.CertPool
+	logger            *slog.Logger
+	shutdownTimeout   time.Duration
 	path              string
 	listenAddr        string
 	onListenCloseOnce sync.Once
+	maxHeaderBytes    int
+	reusePort         bool
 }
 
 type ServerOption func(*Server)
 
+type mountedHandler struct {
+	handler http.Handler
+	pattern string
+}
+
+// WithMaxHeaderBytes sets the request header limit applied to the websocket
+// handshake. Every connection may buffer up to n bytes while the handshake is
+// read, so large values raise the worst-case memory per pending connection.
+func WithMaxHeaderBytes(n int) ServerOption {
+	return func(s *Server) {
+		s.maxHeaderBytes = n
+	}
+}
+
+func WithOnListen(fn func(addr net.Addr)) ServerOption {
+	return func(s *Server) {
+		s.onListen = fn
+	}
+}
+
+func WithShutdownTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.shutdownTimeout = d
+	}
+}
+
+// WithServerTLS serves wss using cfg. Set cfg.ClientAuth and cfg.ClientCAs,
+// or use WithClientCAs, to require client certificates.
+func WithServerTLS(cfg *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tlsConfig = cfg
+	}
+}
+
+// WithClientCAs requires clients to present a certificate issued by one of
+// pool. It needs WithServerTLS, given before or after it.
+func WithClientCAs(pool *x509.CertPool) ServerOption {
+	return func(s *Server) {
+		s.clientCAs = pool
+	}
+}
+
+// WithHandle serves handler at pattern next to the tunnel path, for example a
+// NewEchoHandler for diagnostics. A *Handler mounted this way is shut down
+// along with the server.
+func WithHandle(pattern string, handler http.Handler) ServerOption {
+	return func(s *Server) {
+		s.handlers = append(s.handlers, mountedHandler{pattern: pattern, handler: handler})
+	}
+}
+
+func WithReusePort() ServerOption {
+	return func(s *Server) {
+		s.reusePort = true
+	}
+}
+
 func NewServer(listenAddr, path string, wsHandler *Handler, opts ...ServerOption) *Server {
 	ps := &Server{
-		listenAddr: listenAddr,
-		wsHandler:  wsHandler,
-		path:       path,
-		onListened: make(chan struct{}),
-		shutdowned: make(chan struct{}),
+		maxHeaderBytes:  DefaultMaxHeaderBytes,
+		shutdownTimeout: DefaultShutdownTimeout,
+		listenAddr:      listenAddr,
+		wsHandler:       wsHandler,
+		path:            path,
+		onListened:      make(chan struct{}),
+		shutdowned:      make(chan struct{}),
 	}
 
 	for _, opt := range opts {
 		opt(ps)
 	}
+	if ps.clientCAs != nil {
+		if ps.tlsConfig == nil {
+			panic("wst: WithClientCAs requires WithServerTLS")
+		}
+		ps.tlsConfig = ps.tlsConfig.Clone()
+		ps.tlsConfig.ClientCAs = ps.clientCAs
+		ps.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
 
 	return ps
 }
@@ -78,13 +161,26 @@ func (ps *Server) listenAndServe(server *http.Server) error {
 	if addr == "" {
 		addr = ":http"
 	}
-	ln, err := net.Listen("tcp", addr)
+	var lc net.ListenConfig
+	if ps.reusePort {
+		lc.Control = reusePortControl
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
 	if err != nil {
 		ps.listenErr = err
 		return err
 	}
+	if ps.tlsConfig != nil {
+		ln = tls.NewListener(ln, ps.tlsConfig)
+	}
 	defer ln.Close()
 
+	if ps.logger != nil {
+		ps.logger.Info("listening", slog.String("addr", ln.Addr().String()))
+	}
+	if ps.onListen != nil {
+		ps.onListen(ln.Addr())
+	}
 	ps.closeOnListened()
 
 	return server.Serve(ln)
@@ -94,23 +190,47 @@ func (ps *Server) Server() *http.Server {
 	if ps.server == nil {
 		mux := http.NewServeMux()
 		mux.Handle(ps.path, ps.wsHandler)
+		for _, m := range ps.handlers {
+			mux.Handle(m.pattern, m.handler)
+		}
 		ps.server = &http.Server{
 			Addr:              ps.listenAddr,
 			Handler:           mux,
 			ReadHeaderTimeout: time.Second * 5,
-			MaxHeaderBytes:    16 * 1024,
+			MaxHeaderBytes:    ps.maxHeaderBytes,
 		}
 	}
 	return ps.server
 }
 
 func (ps *Server) Close() error {
-	timeoutCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	if ps.shutdownTimeout <= 0 {
+		return ps.Shutdown(context.Background())
+	}
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), ps.shutdownTimeout)
 	defer cancel()
 	return ps.Shutdown(timeoutCtx)
 }
 
+// Shutdown stops accepting new connections and waits for active tunnels to
+// finish until ctx is done, after which the remaining tunnels are closed with
+// status 1001.
 func (ps *Server) Shutdown(ctx context.Context) error {
 	ps.closeOnListened()
-	return ps.server.Shutdown(ctx)
+	err := ps.server.Shutdown(ctx)
+	if herr := ps.wsHandler.Shutdown(ctx); err == nil {
+		err = herr
+	}
+	for _, m := range ps.handlers {
+		if h, ok := m.handler.(*Handler); ok {
+			if herr := h.Shutdown(ctx); err == nil {
+				err = herr
+			}
+		}
+	}
+	return err
+}
+
+func (ps *Server) Accept() (*Tunnel, error) {
+	return ps.wsHandler.Accept()
 }
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMaxHeaderBytesLargeToken(t *testing.T) {
+	token := strings.Repeat("t", 32<<10)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+
+	url := startServer(t, NewHandler(echoTarget(t), WithAuthToken(token)), WithMaxHeaderBytes(64<<10))
+	ws := dialWS(t, url, header)
+	sendBinary(t, ws, []byte("ping"))
+	if f := readFrame(t, ws); string(f.payload) != "ping" {
+		t.Fatalf("echo = %q", f.payload)
+	}
+
+	url = startServer(t, NewHandler(echoTarget(t), WithAuthToken(token)))
+	if _, err := dialWSErr(url, header); err == nil {
+		t.Fatal("32 KiB token accepted with the default header limit")
+	}
+}
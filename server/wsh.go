@@ -2,47 +2,168 @@ package main
 
 import (
 	"context"
+	"crypto/cipher"
+	"crypto/tls"
 	"errors"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/zijiren233/gwst/client"
+	"github.com/zijiren233/gwst/internal/wire"
 	"golang.org/x/net/websocket"
 )
 
 const (
-	DefaultBufferSize   = 16 * 1024
-	DefaultWriteTimeout = 15 * time.Second
+	DefaultBufferSize        = 16 * 1024
+	DefaultWriteTimeout      = 15 * time.Second
+	DefaultTargetDialTimeout = 10 * time.Second
 )
 
-var sharedBufferPool = sync.Pool{
-	New: func() interface{} {
-		buffer := make([]byte, DefaultBufferSize)
-		return &buffer
-	},
+var defaultDialer = &net.Dialer{
+	Timeout:   time.Second * 10,
+	KeepAlive: time.Second * 30,
 }
 
-func newBufferPool(size int) *sync.Pool {
-	if size == DefaultBufferSize || size <= 0 {
-		return &sharedBufferPool
-	}
-	return &sync.Pool{
-		New: func() interface{} {
-			buffer := make([]byte, size)
-			return &buffer
-		},
-	}
+type GetTargetFunc func(req *http.Request) (string, []string, error)
+
+// TargetSpec describes the target of a session, as picked by a
+// GetTargetSpecFunc.
+type TargetSpec struct {
+	// Addr is the target, as accepted by NewHandler.
+	Addr string
+	// Fallbacks are tried in order when Addr cannot be dialed.
+	Fallbacks []string
+	// LocalAddr, an IP or IP:port, binds the dials of this target in place of
+	// WithUpstreamLocalAddr.
+	LocalAddr string
 }
 
-type GetTargetFunc func(req *http.Request) (string, []string, error)
+type GetTargetSpecFunc func(req *http.Request) (TargetSpec, error)
+
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
 
 type Handler struct {
-	bufferPool        *sync.Pool
-	wsServer          *websocket.Server
-	defaultTargetAddr string
-	bufferSize        int
+	dialer                ContextDialer
+	pools                 atomic.Pointer[copyPools]
+	wsServer              *websocket.Server
+	targetTLSConfig       *tls.Config
+	backendTLSConfig      *tls.Config
+	balanceStrategy       Strategy
+	socks5                *socks5Config
+	upstreamWST           *client.ConnectConfig
+	targetHintPolicy      TargetPolicy
+	onClose               func(ConnStats)
+	maxBytes              int64
+	maxBytesDirection     Direction
+	targetDialTimeout     time.Duration
+	balancer              *balancer
+	dialRetryAttempts     int
+	dialRetryBackoff      time.Duration
+	healthCooldown        time.Duration
+	pingInterval          time.Duration
+	pongTimeout           time.Duration
+	upWriteTimeout        time.Duration
+	downWriteTimeout      time.Duration
+	coalesceDelay         time.Duration
+	coalesceBytes         int
+	idleTimeout           time.Duration
+	maxSessionDuration    time.Duration
+	connRate              int
+	connBurst             int
+	connRateShared        bool
+	healthFailures        int
+	sessions              map[string]*session
+	sessionsMu            sync.Mutex
+	acceptCh              chan *Tunnel
+	baseCtx               context.Context
+	cancelBase            context.CancelFunc
+	shutdownCh            chan struct{}
+	preflightDial         bool
+	closed                bool
+	maxConns              int64
+	active                atomic.Int64
+	dnsCacheFor           time.Duration
+	perIP                 *perIPLimiter
+	trustedProxies        []netip.Prefix
+	onConnect             func(Session)
+	onDisconnect          func(Session, SessionStats, error)
+	logger                *slog.Logger
+	rejectLogLimit        *tokenBucket
+	metrics               MetricsCollector
+	proxyProtocol         int
+	upBufferSize          int
+	downBufferSize        int
+	startBufferSize       int
+	upstreamKeepAlive     time.Duration
+	upstreamNoDelay       bool
+	panicHandler          func(any)
+	upstreamLocalAddr     *net.TCPAddr
+	noFailover            bool
+	healthSend            []byte
+	healthExpect          []byte
+	healthInterval        time.Duration
+	healthTimeout         time.Duration
+	acceptLimit           *tokenBucket
+	acceptPerIPLimit      *perIPLimiter
+	acceptRate            int
+	acceptBurst           int
+	acceptPerIP           bool
+	allowedOrigins        []originPattern
+	originCheck           func(*http.Request) error
+	redirect              func(*http.Request) (string, bool)
+	auth                  []authenticator
+	authQueryParam        string
+	handshakeFn           HandshakeFunc
+	defaultHandshake      bool
+	onHandshake           func(*http.Request) error
+	handshakeHook         HandshakeHook
+	inbandPolicy          TargetPolicy
+	inbandTimeout         time.Duration
+	exposeBackend         bool
+	obfuscation           cipher.Block
+	labeler               func(*http.Request) map[string]string
+	metricLabelKeys       []string
+	upstreamPool          *upstreamPool
+	onBackendDial         func(string) error
+	onConnected           func(Session)
+	maxFrameSize          int
+	compress              bool
+	compressLevel         int
+	allowCIDRs            prefixSet
+	denyCIDRs             prefixSet
+	ipFilterForwarded     bool
+	fallback              http.Handler
+	fallbackOnAuth        bool
+	subprotocolRoutes     map[string]string
+	halfClose             bool
+	halfCloseTimeout      time.Duration
+	maxMessageSize        int
+	pathPrefix            string
+	getTarget             GetTargetSpecFunc
+	echo                  bool
+	resumeGrace           time.Duration
+	resumeBuffer          int
+	resumeBufferLimit     int64
+	resumeBuffered        atomic.Int64
+	resumePolicy          func(*http.Request) bool
+	resumables            map[string]*resumableConn
+	resumablesMu          sync.Mutex
+	handshakeSlots        chan struct{}
+	handshakeQueueTimeout time.Duration
+	counters              handlerCounters
+	nullBackend           NullBackendMode
+	nullBackendRate       int64
+	defaultTargetAddr     string
+	bufferSize            int
 }
 
 type HandlerOption func(*Handler)
@@ -53,6 +174,74 @@ func WithHandlerBufferSize(size int) HandlerOption {
 	}
 }
 
+// WithHandlerUpBufferSize sets the copy buffer size for the client to target
+// direction, overriding WithHandlerBufferSize.
+func WithHandlerUpBufferSize(size int) HandlerOption {
+	if size <= 0 {
+		panic("wst: up buffer size must be positive")
+	}
+	return func(h *Handler) {
+		h.upBufferSize = size
+	}
+}
+
+// WithHandlerDownBufferSize sets the copy buffer size for the target to client
+// direction, overriding WithHandlerBufferSize.
+func WithHandlerDownBufferSize(size int) HandlerOption {
+	if size <= 0 {
+		panic("wst: down buffer size must be positive")
+	}
+	return func(h *Handler) {
+		h.downBufferSize = size
+	}
+}
+
+// WithHandlerStartBufferSize sets the buffer size a copy starts with before
+// switching to its direction's buffer size; it defaults to SmallBufferSize.
+// A size of at least the buffer size makes copies use the full buffer from
+// the start, which suits handlers that mostly carry bulk transfers.
+func WithHandlerStartBufferSize(size int) HandlerOption {
+	if size <= 0 {
+		panic("wst: start buffer size must be positive")
+	}
+	return func(h *Handler) {
+		h.startBufferSize = size
+	}
+}
+
+func WithHandlerDialer(d ContextDialer) HandlerOption {
+	return func(h *Handler) {
+		h.dialer = d
+	}
+}
+
+func WithWriteTimeout(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.upWriteTimeout = d
+		h.downWriteTimeout = d
+	}
+}
+
+func WithUpstreamWriteTimeout(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.upWriteTimeout = d
+	}
+}
+
+func WithClientWriteTimeout(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.downWriteTimeout = d
+	}
+}
+
+// WithTargetDialTimeout bounds each target dial, including each failover to
+// another backend or fallback target and each retry.
+func WithTargetDialTimeout(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.targetDialTimeout = d
+	}
+}
+
 func checkOrigin(config *websocket.Config, req *http.Request) (err error) {
 	config.Origin, err = websocket.Origin(config, req)
 	if err == nil && config.Origin == nil {
@@ -61,9 +250,91 @@ func checkOrigin(config *websocket.Config, req *http.Request) (err error) {
 	return err
 }
 
+// validateHandshake runs the handshake validator and the origin checks.
+func (h *Handler) validateHandshake(config *websocket.Config, req *http.Request) error {
+	if err := h.handshakeFn(config, req); err != nil {
+		outcome := HandshakeRejectedHook
+		if h.defaultHandshake {
+			outcome = HandshakeRejectedOrigin
+		}
+		h.logRejected(req, http.StatusForbidden, err.Error())
+		h.metrics.Handshake(outcome)
+		return err
+	}
+	if config.Origin == nil {
+		// A custom validator may skip CheckOrigin; the allowlist still needs
+		// the origin.
+		config.Origin, _ = websocket.Origin(config, req)
+	}
+	if err := h.checkAllowedOrigin(config.Origin, req); err != nil {
+		h.logRejected(req, http.StatusForbidden, err.Error())
+		h.metrics.Handshake(HandshakeRejectedOrigin)
+		return err
+	}
+	return nil
+}
+
+func (h *Handler) runOnHandshake(req *http.Request) error {
+	if h.onHandshake == nil {
+		return nil
+	}
+	if err := h.onHandshake(req); err != nil {
+		h.logRejected(req, http.StatusForbidden, err.Error())
+		h.metrics.Handshake(HandshakeRejectedHook)
+		return err
+	}
+	return nil
+}
+
+func (h *Handler) handshake(config *websocket.Config, req *http.Request) error {
+	if checked := checkedHandshake(req); checked != nil {
+		config.Protocol = checked.Protocol
+		config.Header = checked.Header.Clone()
+	} else {
+		if err := h.validateHandshake(config, req); err != nil {
+			return err
+		}
+		if err := h.runOnHandshake(req); err != nil {
+			return err
+		}
+	}
+	if h.subprotocolRoutes != nil {
+		if err := h.selectRoutedProtocol(config, req); err != nil {
+			return err
+		}
+	} else {
+		h.selectProtocol(config)
+	}
+	if h.obfuscation != nil {
+		if err := h.negotiateObfuscation(config, req); err != nil {
+			return err
+		}
+	}
+	h.negotiateHalfClose(config, req)
+	if config.Location != nil && h.isSecure(req) {
+		config.Location.Scheme = "wss"
+	}
+	if config.Header == nil {
+		config.Header = make(http.Header)
+	}
+	config.Header.Set(ConnIDHeader, ConnIDFromContext(req.Context()))
+	setResumeHeaders(config.Header, req)
+	return nil
+}
+
 func NewHandler(targetAddr string, opts ...HandlerOption) *Handler {
+	baseCtx, cancelBase := context.WithCancel(context.Background())
 	h := &Handler{
 		defaultTargetAddr: targetAddr,
+		pingInterval:      DefaultPingInterval,
+		upWriteTimeout:    DefaultWriteTimeout,
+		downWriteTimeout:  DefaultWriteTimeout,
+		upstreamNoDelay:   true,
+		upstreamKeepAlive: DefaultUpstreamKeepAlive,
+		shutdownCh:        make(chan struct{}),
+		baseCtx:           baseCtx,
+		cancelBase:        cancelBase,
+		maxMessageSize:    DefaultMaxMessageSize,
 	}
 
 	for _, opt := range opts {
@@ -73,35 +344,167 @@ func NewHandler(targetAddr string, opts ...HandlerOption) *Handler {
 	if h.bufferSize == 0 {
 		h.bufferSize = DefaultBufferSize
 	}
-	h.bufferPool = newBufferPool(h.bufferSize)
+	h.pools.Store(h.newCopyPools(h.bufferSize))
+
+	if h.halfCloseTimeout == 0 {
+		h.halfCloseTimeout = DefaultHalfCloseTimeout
+	}
+
+	if h.targetDialTimeout == 0 {
+		h.targetDialTimeout = DefaultTargetDialTimeout
+	}
+
+	if h.resumeBuffer == 0 {
+		h.resumeBuffer = DefaultResumeBuffer
+		h.resumeBufferLimit = DefaultResumeBufferLimit
+	}
+
+	if h.dialer == nil {
+		h.dialer = defaultDialer
+	}
+	if h.upstreamLocalAddr != nil || h.getTarget != nil {
+		h.dialer = &localAddrDialer{dialer: h.dialer, local: h.upstreamLocalAddr}
+	}
+	if h.dnsCacheFor > 0 {
+		h.dialer = newCachingDialer(h.dialer, h.dnsCacheFor)
+	}
+	if h.socks5 != nil {
+		h.dialer = newSOCKS5Dialer(h.socks5, h.dialer)
+	}
+	if h.upstreamWST != nil {
+		h.dialer = newWSTDialer(h.upstreamWST, h.dialer)
+	}
+
+	h.initBalancer()
+	h.initAcceptLimit()
+
+	h.initLogger()
+	h.startHealthCheck()
+	if h.metrics == nil {
+		h.metrics = nopMetrics{}
+	}
+	if h.handshakeFn == nil {
+		h.handshakeFn = checkOrigin
+		h.defaultHandshake = true
+	}
+	h.metrics = countingMetrics{MetricsCollector: h.metrics, counters: &h.counters}
 
 	h.wsServer = &websocket.Server{
 		Handler:   h.handleWebSocket,
-		Handshake: checkOrigin,
+		Handshake: h.handshake,
 	}
 
 	return h
 }
 
-func (h *Handler) getBuffer() *[]byte {
-	return h.bufferPool.Get().(*[]byte)
-}
-
-func (h *Handler) putBuffer(buffer *[]byte) {
-	if buffer != nil {
-		*buffer = (*buffer)[:cap(*buffer)]
-		h.bufferPool.Put(buffer)
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.pathPrefix != "" {
+		var ok bool
+		if req, ok = h.matchPath(req); !ok {
+			if h.fallback != nil {
+				h.fallback.ServeHTTP(w, req)
+			} else {
+				http.NotFound(w, req)
+			}
+			return
+		}
 	}
-}
+	if h.fallback != nil && !isUpgradeRequest(req) {
+		h.fallback.ServeHTTP(w, req)
+		return
+	}
+	if !h.allowIP(req) {
+		h.logRejected(req, http.StatusForbidden, "client ip not allowed")
+		h.metrics.Handshake(HandshakeRejectedIP)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if !h.allowAccept(req) {
+		h.logRejected(req, http.StatusTooManyRequests, "accept rate exceeded")
+		h.metrics.Handshake(HandshakeRejectedRateLimit)
+		rejectTooManyRequests(w)
+		return
+	}
+	if h.handshakeSlots != nil {
+		slot, ok := h.acquireHandshake(req)
+		if !ok {
+			h.logRejected(req, http.StatusServiceUnavailable, "too many concurrent handshakes")
+			h.metrics.Handshake(HandshakeRejectedHandshakeLimit)
+			rejectUnavailable(w, DefaultRetryAfter)
+			return
+		}
+		defer slot.release()
+		req = req.WithContext(context.WithValue(req.Context(), handshakeSlotKey{}, slot))
+	}
+	req, ok := h.authenticate(w, req)
+	if !ok {
+		return
+	}
+	if h.redirect != nil {
+		if location, ok := h.redirect(req); ok {
+			h.metrics.Handshake(HandshakeRedirected)
+			http.Redirect(w, req, location, http.StatusTemporaryRedirect)
+			return
+		}
+	}
+	if !h.acquireConn() {
+		h.logRejected(req, http.StatusServiceUnavailable, "too many connections")
+		h.metrics.Handshake(HandshakeRejectedMaxConns)
+		rejectUnavailable(w, DefaultRetryAfter)
+		return
+	}
+	defer h.releaseConn()
 
-func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	h.wsServer.ServeHTTP(w, req)
-}
+	if h.perIP != nil {
+		release, ok := h.perIP.acquire(h.clientIP(req))
+		if !ok {
+			h.logRejected(req, http.StatusTooManyRequests, "per-ip limit exceeded")
+			h.metrics.Handshake(HandshakeRejectedPerIPLimit)
+			rejectTooManyRequests(w)
+			return
+		}
+		defer release()
+	}
 
-var pingCodec = websocket.Codec{
-	Marshal: func(_ any) ([]byte, byte, error) {
-		return nil, websocket.PingFrame, nil
-	},
+	req = withConnID(req)
+	if h.targetHintPolicy != nil {
+		if req, ok = h.resolveTargetHint(w, req); !ok {
+			return
+		}
+	}
+	if h.labeler != nil {
+		req = h.withLabels(req)
+	}
+	if h.handshakeHook != nil && isUpgradeRequest(req) {
+		if req, ok = h.checkHandshake(w, req); !ok {
+			return
+		}
+	}
+	var rr *resumeRequest
+	if h.resumeGrace > 0 {
+		if req, ok = h.prepareResume(w, req); !ok {
+			return
+		}
+		rr = resumeFromContext(req)
+	}
+	if rr != nil && rr.handle != nil {
+		h.upgrade(w, req)
+		rr.handle.detach()
+		return
+	}
+	if rr != nil {
+		defer h.releaseResume(rr)
+	}
+	if h.getTarget != nil && req.Context().Value(targetContextKey{}) == nil {
+		if req, ok = h.resolveTarget(w, req); !ok {
+			return
+		}
+	}
+	if h.preflightDial && !h.echo && h.inbandPolicy == nil {
+		h.servePreflight(w, req)
+		return
+	}
+	h.upgrade(w, req)
 }
 
 func (h *Handler) handleWebSocket(ws *websocket.Conn) {
@@ -109,88 +512,358 @@ func (h *Handler) handleWebSocket(ws *websocket.Conn) {
 
 	ws.PayloadType = websocket.BinaryFrame
 
-	exit := make(chan struct{})
-	defer close(exit)
+	s, ok := ws.Request().Context().Value(sessionContextKey{}).(*session)
+	if !ok {
+		target, _ := h.sessionTarget(ws.Request())
+		s = newSession(h, ws.Request(), target)
+		s.attachResume()
+	}
+	s.ws = ws
+	defer s.finish()
+	defer s.recoverPanic()
 
-	go func() {
-		ticker := time.NewTicker(time.Second * 30)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				err := pingCodec.Send(ws, nil)
-				if err == nil {
-					continue
-				}
-				_ = ws.Close()
-				return
-			case <-exit:
-				return
-			}
-		}
-	}()
+	s.logger.Info("handshake accepted",
+		slog.String("remote_addr", ws.Request().RemoteAddr),
+		slog.String("path", ws.Request().URL.Path),
+	)
+	h.metrics.Handshake(HandshakeAccepted)
+	h.metrics.SessionStarted(s.info())
+	if h.onConnect != nil {
+		h.onConnect(s.info())
+	}
 
-	h.handleNetwork(ws, h.defaultTargetAddr)
-}
+	go h.keepalive(s)
 
-func (h *Handler) handleNetwork(ws *websocket.Conn, addr string) {
-	conn, err := dial(ws.Request().Context(), "tcp", addr)
-	if err != nil {
+	if !h.trackSession(s) {
+		s.abort(CloseGoingAway, "server shutting down")
 		return
 	}
-	defer conn.Close()
+	defer h.untrackSession(s)
 
-	go func() {
-		buffer := h.getBuffer()
-		defer h.putBuffer(buffer)
-		_, _ = CopyBufferWithWriteTimeout(conn, ws, *buffer, DefaultWriteTimeout)
-	}()
+	if h.acceptCh != nil {
+		s.endHandshake()
+		h.handOff(s)
+		return
+	}
+	if h.echo {
+		s.endHandshake()
+		h.handleEcho(s)
+		return
+	}
+	h.handleNetwork(s)
+}
 
-	buffer := h.getBuffer()
-	defer h.putBuffer(buffer)
-	_, _ = CopyBufferWithWriteTimeout(ws, conn, *buffer, DefaultWriteTimeout)
+func (h *Handler) trackSession(s *session) bool {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+	if h.closed {
+		return false
+	}
+	if h.sessions == nil {
+		h.sessions = make(map[string]*session)
+	}
+	h.sessions[s.id] = s
+	h.counters.totalSessions++
+	return true
+}
+
+func (h *Handler) untrackSession(s *session) {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+	delete(h.sessions, s.id)
+	h.counters.bytesUp += s.bytesUp.Load()
+	h.counters.bytesDown += s.bytesDown.Load()
 }
 
-func dial(_ context.Context, network, addr string) (net.Conn, error) {
-	return net.Dial(network, addr)
+// CloseConn closes the session with the given connection ID, as reported in
+// the X-WST-Conn-Id header, logs and callbacks. It sends a close frame and
+// half-closes the target, then tears the session down after a short drain.
+// It reports whether a matching session was found.
+func (h *Handler) CloseConn(id string) bool {
+	h.sessionsMu.Lock()
+	s, ok := h.sessions[id]
+	h.sessionsMu.Unlock()
+	if !ok {
+		return false
+	}
+	s.logger.Info("closing session on request")
+	s.closeGracefully(CloseNormalClosure, "closed by server")
+	return true
 }
 
-type deadlineWriter interface {
-	io.Writer
-	SetWriteDeadline(time.Time) error
+func (h *Handler) isClosed() bool {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+	return h.closed
 }
 
-func CopyBufferWithWriteTimeout(dst deadlineWriter, src io.Reader, buf []byte, timeout time.Duration) (written int64, err error) {
+func (h *Handler) activeSessions() []*session {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+	sessions := make([]*session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (h *Handler) Shutdown(ctx context.Context) error {
+	// Cancelling the base context ends target dials still in progress once
+	// the sessions have drained or been aborted.
+	defer h.cancelBase()
+	h.sessionsMu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.shutdownCh)
+	}
+	h.sessionsMu.Unlock()
+	h.closeResumables()
+	if h.upstreamPool != nil {
+		h.upstreamPool.close()
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
 	for {
-		nr, er := src.Read(buf)
-		if nr > 0 {
-			err = dst.SetWriteDeadline(time.Now().Add(timeout))
-			if err != nil {
-				break
+		sessions := h.activeSessions()
+		if len(sessions) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for _, s := range sessions {
+				s.abort(CloseGoingAway, "server shutting down")
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func dialErrorReason(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "target dial timeout"
+	case errors.Is(err, ErrTargetTLSHandshake):
+		return ErrTargetTLSHandshake.Error()
+	case errors.Is(err, ErrUpstreamProxy):
+		return ErrUpstreamProxy.Error()
+	case errors.Is(err, ErrDialVetoed):
+		return ErrDialVetoed.Error()
+	default:
+		return "target dial failed"
+	}
+}
+
+func (h *Handler) handleNetwork(s *session) {
+	defer s.recoverPanic()
+	text := h.isTextMode(s.ws.Config())
+	if text {
+		s.ws.PayloadType = websocket.TextFrame
+	}
+	fr := newFrameReader(s.ws)
+	fr.lastFrame = &s.lastFrame
+	fr.waitSince = &s.readWait
+	fr.pinger = &s.pinger
+	fr.maxSize = h.maxMessageSize
+	fr.text = text
+	fr.wire = &s.wireUp
+
+	var client io.Reader = fr
+	if s.getConn() == nil {
+		if h.inbandPolicy != nil && !h.readInbandTarget(s, fr, text) {
+			return
+		}
+		watch := watchClient(s, fr)
+		client = watch
+		start := time.Now()
+		conn, err := h.dialWithRetry(s)
+		h.metrics.TargetDialed(s.target, time.Since(start), err)
+		if err != nil {
+			level := slog.LevelError
+			if s.closedOnPurpose(err) {
+				level = slog.LevelDebug
 			}
-			nw, ew := dst.Write(buf[0:nr])
-			if nw < 0 || nr < nw {
-				nw = 0
-				if ew == nil {
-					ew = errors.New("invalid write result")
+			s.logger.Log(s.ctx, level, "target dial failed",
+				slog.String("target", s.target),
+				slog.Duration("duration", time.Since(start)),
+				slog.Any("error", err),
+			)
+			s.setErr(peerTarget, err)
+			if h.inbandPolicy != nil {
+				status := InbandDialFailed
+				if errors.Is(err, ErrDialVetoed) {
+					status = InbandNotAllowed
 				}
+				_ = s.writeInbandStatus(status, text)
+			}
+			if errors.Is(err, ErrDialVetoed) {
+				s.abort(ClosePolicyViolation, dialErrorReason(err))
+			} else {
+				s.abort(CloseInternalError, dialErrorReason(err))
 			}
-			written += int64(nw)
-			if ew != nil {
-				err = ew
-				break
+			watch.wait()
+			return
+		}
+		s.logger.Debug("target dialed",
+			slog.String("target", s.target),
+			slog.Duration("duration", time.Since(start)),
+		)
+		if !s.setConn(h.resumable(s, conn)) {
+			watch.wait()
+			return
+		}
+		if h.inbandPolicy != nil {
+			if err := s.writeInbandStatus(InbandOK, text); err != nil {
+				s.setErr(peerClient, err)
+				s.abort(CloseInternalError, "in-band target ack failed")
+				watch.wait()
+				return
+			}
+		}
+	}
+	s.endHandshake()
+	conn := s.getConn()
+	defer conn.Close()
+	if h.exposeBackend {
+		if err := s.sendBackendInfo(conn); err != nil {
+			s.logger.Debug("sending backend info failed", slog.Any("error", err))
+		}
+	}
+	if h.onConnected != nil {
+		h.onConnected(s.info())
+	}
+
+	if h.idleTimeout > 0 {
+		stop := s.startIdleTimer(h.idleTimeout)
+		defer stop()
+	}
+	if h.maxSessionDuration > 0 {
+		stop := s.startLifetimeTimer(h.maxSessionDuration)
+		defer stop()
+	}
+
+	upLimit, downLimit := s.rateLimiters()
+	compressed := h.compress && h.isCompressed(s.ws.Config())
+
+	upDone := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer s.recoverPanic()
+		src := client
+		if h.obfuscation != nil {
+			src = wire.NewObfuscatingReader(src, h.obfuscation)
+		}
+		if compressed {
+			src = &gzipReader{src: src}
+		}
+		_, err := copyAdaptive(s.meter(conn, &s.bytesUp, peerTarget), s.limit(s.track(src, peerClient), upLimit), s.pools.start, s.pools.up, h.upWriteTimeout)
+		if fr.closeErr != nil {
+			s.setClientClose(fr.closeErr)
+			if pc, ok := conn.(*pooledConn); ok && fr.closeErr.Code == CloseNormalClosure && s.stats().TargetErr == nil {
+				pc.markReusable()
 			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
+		}
+		if err == nil && fr.eof && s.halfClosing() {
+			if cw, ok := conn.(closeWriter); ok && cw.CloseWrite() == nil {
+				s.logger.Debug("client half-closed")
+				close(upDone)
+				return
 			}
 		}
-		if er != nil {
-			if er != io.EOF {
-				err = er
+		code, reason, protocolErr := readErrorClose(err)
+		if err != nil && fr.closeErr == nil && !protocolErr {
+			s.logRelayError("up", err)
+		}
+		if fr.closeErr == nil && !fr.eof && !protocolErr && s.stats().TargetErr == nil {
+			s.markTransportLost()
+		}
+		if protocolErr {
+			s.abort(code, reason)
+		} else if err != nil && fr.closeErr == nil {
+			s.abort(CloseInternalError, "client relay failed")
+		} else {
+			s.abort(CloseNormalClosure, "client closed")
+		}
+	}()
+
+	var dst deadlineWriter = &countingWriter{deadlineWriter: h.wsWriter(s), n: &s.wireDown}
+	maxFrameSize := h.maxFrameSize
+	if text {
+		dst = &base64Writer{deadlineWriter: dst}
+		maxFrameSize = max(maxFrameSize/4*3, 3)
+	}
+	if h.maxFrameSize > 0 {
+		dst = &frameSplitter{deadlineWriter: dst, max: maxFrameSize}
+	}
+	var cw *coalescingWriter
+	if h.coalesceDelay > 0 && h.coalesceBytes > 0 {
+		cw = newCoalescingWriter(dst, h.coalesceDelay, h.coalesceBytes)
+		dst = cw
+	}
+	if h.obfuscation != nil {
+		dst = wire.NewObfuscatingWriter(dst, h.obfuscation)
+	}
+	var zw *gzipWriter
+	if compressed {
+		zw = newGzipWriter(dst, h.compressLevel)
+		dst = zw
+	}
+
+	src := s.limit(s.track(conn, peerTarget), downLimit)
+	if sc, ok := unwrapPooled(conn).(syscall.Conn); ok && cw != nil {
+		src = &idleFlushReader{Reader: src, conn: sc, w: cw}
+	}
+	_, err := copyAdaptive(s.meter(dst, &s.bytesDown, peerClient), src, s.pools.start, s.pools.down, h.downWriteTimeout)
+	if zw != nil && err == nil {
+		err = zw.Close()
+	}
+	if cw != nil {
+		if ferr := cw.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	if err != nil {
+		s.logRelayError("down", err)
+		if s.stats().TargetErr == nil {
+			s.markTransportLost()
+		}
+		s.abort(CloseInternalError, "target relay failed")
+	} else {
+		if s.halfClosing() && s.ctx.Err() == nil && writeHalfClose(s.ws) == nil {
+			s.logger.Debug("target half-closed")
+			timer := time.NewTimer(h.halfCloseTimeout)
+			select {
+			case <-upDone:
+			case <-s.ctx.Done():
+			case <-timer.C:
+				s.logger.Debug("client did not finish after target half-close")
 			}
-			break
+			timer.Stop()
 		}
+		s.abort(CloseNormalClosure, "target closed")
 	}
-	return written, err
+	// abort closed both conns, unblocking the client to target copy; wait
+	// for it so that it never outlives the session.
+	wg.Wait()
+}
+
+func (h *Handler) dialSession(ctx context.Context, s *session) (net.Conn, error) {
+	if h.nullBackend != 0 {
+		return h.dialNullBackend(), nil
+	}
+	if h.balancer != nil && h.inbandPolicy == nil && !s.hinted {
+		return h.dialBackend(ctx, s)
+	}
+	return h.dialTargets(ctx, s)
+}
+
+type deadlineWriter = wire.DeadlineWriter
+
+// CopyBufferWithWriteTimeout copies src to dst, failing a write that stalls
+// for longer than timeout; see wire.CopyBufferWithWriteTimeout.
+func CopyBufferWithWriteTimeout(dst deadlineWriter, src io.Reader, buf []byte, timeout time.Duration) (written int64, err error) {
+	return wire.CopyBufferWithWriteTimeout(dst, src, buf, timeout)
 }
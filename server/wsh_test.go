@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// recordingDialer dials with net.Dialer and records each dial.
+type recordingDialer struct {
+	mu    sync.Mutex
+	dials []string
+	ctxOK bool
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials = append(d.dials, network+" "+addr)
+	d.ctxOK = ctx.Err() == nil
+	d.mu.Unlock()
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, addr)
+}
+
+func TestHandlerDialer(t *testing.T) {
+	target := echoTarget(t)
+	d := &recordingDialer{}
+	echoOnce(t, startHandler(t, NewHandler(target, WithHandlerDialer(d))))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.dials) != 1 || d.dials[0] != "tcp "+target {
+		t.Fatalf("dials %q, want one to %s", d.dials, target)
+	}
+	if !d.ctxOK {
+		t.Fatal("dial context already done")
+	}
+}
+
+func TestHandlerDialerError(t *testing.T) {
+	d := dialerFunc(func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("refused by test")
+	})
+	h := NewHandler("127.0.0.1:1", WithHandlerDialer(d))
+	ws := dialWS(t, startHandler(t, h), nil)
+	if code := readClose(t, ws); code != CloseInternalError {
+		t.Fatalf("close code %d, want %d", code, CloseInternalError)
+	}
+}
+
+func TestHandlerDefaultDialer(t *testing.T) {
+	h := NewHandler("127.0.0.1:1")
+	if h.dialer != defaultDialer {
+		t.Fatalf("dialer %T, want the default", h.dialer)
+	}
+	if defaultDialer.Timeout != DefaultTargetDialTimeout || defaultDialer.KeepAlive <= 0 {
+		t.Fatalf("default dialer timeout %v, keepalive %v", defaultDialer.Timeout, defaultDialer.KeepAlive)
+	}
+}
+
+// blockingDialer blocks every dial until its context is done.
+var blockingDialer = dialerFunc(func(ctx context.Context, _, _ string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+})
+
+func TestTargetDialTimeout(t *testing.T) {
+	h := NewHandler("10.255.255.1:9", WithHandlerDialer(blockingDialer), WithTargetDialTimeout(100*time.Millisecond))
+	ws := dialWS(t, startHandler(t, h), nil)
+	start := time.Now()
+	ce := readCloseError(t, ws)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("dial gave up after %v", elapsed)
+	}
+	if ce.Code != CloseInternalError || ce.Reason != "target dial timeout" {
+		t.Fatalf("closed with %d %q", ce.Code, ce.Reason)
+	}
+}
+
+func TestClientCloseCancelsTargetDial(t *testing.T) {
+	started, ended := make(chan struct{}, 1), make(chan error, 1)
+	h := NewHandler("10.255.255.1:9",
+		WithHandlerDialer(hangingDialer(started, ended)),
+		WithTargetDialTimeout(time.Minute),
+	)
+	ws := dialWS(t, startHandler(t, h), nil)
+	<-started
+	ws.Close()
+	select {
+	case err := <-ended:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("dial ended with %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target dial still running after the client closed")
+	}
+	waitDrained(t, h)
+}
+
+func TestDataDuringDialIsRelayed(t *testing.T) {
+	// What the client sends while the target is dialed is read ahead and
+	// must still reach the target in order.
+	h := NewHandler(echoTarget(t), WithHandlerDialer(dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		time.Sleep(200 * time.Millisecond)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})))
+	ws := dialWS(t, startHandler(t, h), nil)
+	want := strings.Repeat("0123456789", 1000)
+	for i := 0; i < len(want); i += 3000 {
+		sendBinary(t, ws, []byte(want[i:min(i+3000, len(want))]))
+	}
+	var got []byte
+	for len(got) < len(want) {
+		got = append(got, readFrame(t, ws).payload...)
+	}
+	if string(got) != want {
+		t.Fatalf("echoed %d bytes that differ from the %d sent", len(got), len(want))
+	}
+}
+
+// stalledTarget returns a dialer whose connections never read what the
+// handler writes to them.
+func stalledTarget(t *testing.T) ContextDialer {
+	return dialerFunc(func(context.Context, string, string) (net.Conn, error) {
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { peer.Close() })
+		return conn, nil
+	})
+}
+
+func TestUpstreamWriteTimeout(t *testing.T) {
+	h := NewHandler("stalled:1", WithHandlerDialer(stalledTarget(t)), WithUpstreamWriteTimeout(100*time.Millisecond))
+	ws := dialWS(t, startHandler(t, h), nil)
+	sendBinary(t, ws, []byte("stuck"))
+	start := time.Now()
+	readClose(t, ws)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("stalled write ended after %v", elapsed)
+	}
+}
+
+func TestUpstreamWriteTimeoutDisabled(t *testing.T) {
+	h := NewHandler("stalled:1", WithHandlerDialer(stalledTarget(t)), WithWriteTimeout(0))
+	ws := dialWS(t, startHandler(t, h), nil)
+	sendBinary(t, ws, []byte("stuck"))
+	_ = ws.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	var b []byte
+	if err := websocket.Message.Receive(ws, &b); err == nil {
+		t.Fatalf("got %q while the target is stalled", b)
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("session ended without a write timeout: %v", err)
+	}
+}
+
+func TestClientWriteTimeout(t *testing.T) {
+	// The target floods a client that never reads.
+	ended := make(chan struct{})
+	target := startTarget(t, func(conn net.Conn) {
+		defer close(ended)
+		defer conn.Close()
+		chunk := make([]byte, 64<<10)
+		for {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+	h := NewHandler(target, WithClientWriteTimeout(100*time.Millisecond), WithPingInterval(0))
+	dialWS(t, startHandler(t, h), nil)
+	select {
+	case <-ended:
+	case <-time.After(10 * time.Second):
+		t.Fatal("session still open with a client that does not read")
+	}
+}
+
+// hangingDialer blocks every dial until its context is done, reporting the
+// start of each dial on started and its context error on ended.
+func hangingDialer(started chan<- struct{}, ended chan<- error) ContextDialer {
+	return dialerFunc(func(ctx context.Context, _, _ string) (net.Conn, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		ended <- ctx.Err()
+		return nil, ctx.Err()
+	})
+}
+
+func TestShutdownCancelsTargetDial(t *testing.T) {
+	started, ended := make(chan struct{}, 1), make(chan error, 1)
+	h := NewHandler("10.255.255.1:9",
+		WithHandlerDialer(hangingDialer(started, ended)),
+		WithTargetDialTimeout(time.Minute),
+	)
+	ws := dialWS(t, startHandler(t, h), nil)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_ = h.Shutdown(ctx)
+	select {
+	case err := <-ended:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("dial ended with %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target dial still running after Shutdown")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("dial cancelled %v after Shutdown", elapsed)
+	}
+	readClose(t, ws)
+	waitDrained(t, h)
+}
+
+func TestServerShutdownCancelsTargetDial(t *testing.T) {
+	started, ended := make(chan struct{}, 1), make(chan error, 1)
+	h := NewHandler("10.255.255.1:9",
+		WithHandlerDialer(hangingDialer(started, ended)),
+		WithTargetDialTimeout(time.Minute),
+	)
+	addr := make(chan net.Addr, 1)
+	srv := NewServer("127.0.0.1:0", "/ws", h, WithOnListen(func(a net.Addr) { addr <- a }))
+	go func() { _ = srv.Serve() }()
+	dialWS(t, "ws://"+(<-addr).String()+"/ws", nil)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_ = srv.Shutdown(ctx)
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("target dial still running after Server.Shutdown")
+	}
+}
+
+func TestConnDialedAfterAbortIsClosed(t *testing.T) {
+	// The dial ignores its context and finishes after Shutdown aborted the
+	// session; the conn it returns must not leak.
+	started := make(chan struct{}, 1)
+	closed := make(chan struct{})
+	h := NewHandler("slow:1", WithHandlerDialer(dialerFunc(func(context.Context, string, string) (net.Conn, error) {
+		started <- struct{}{}
+		time.Sleep(200 * time.Millisecond)
+		conn, peer := net.Pipe()
+		go func() {
+			defer close(closed)
+			_, _ = peer.Read(make([]byte, 1))
+		}()
+		return conn, nil
+	})), WithPingInterval(20*time.Millisecond))
+	ws := dialWS(t, startHandler(t, h), nil)
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = h.Shutdown(ctx)
+	readClose(t, ws)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("conn dialed after the abort was left open")
+	}
+	waitDrained(t, h)
+}
+
+func TestClientCloseStopsDialRetries(t *testing.T) {
+	// The session context ends with the websocket, so no retry follows the
+	// dial it cancelled.
+	var dials atomic.Int32
+	started := make(chan struct{}, 8)
+	h := NewHandler("10.255.255.1:9",
+		WithHandlerDialer(dialerFunc(func(ctx context.Context, _, _ string) (net.Conn, error) {
+			dials.Add(1)
+			started <- struct{}{}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})),
+		WithTargetDialTimeout(time.Minute),
+		WithTargetDialRetry(5, 10*time.Millisecond),
+	)
+	ws := dialWS(t, startHandler(t, h), nil)
+	<-started
+	ws.Close()
+	waitDrained(t, h)
+	time.Sleep(100 * time.Millisecond)
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("target dialed %d times after the client closed, want 1", n)
+	}
+}